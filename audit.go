@@ -0,0 +1,255 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuditFile is a file of the audit package with its checksum
+type AuditFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// AuditInvoice is an invoice listed in the audit manifest
+type AuditInvoice struct {
+	InvNum        string     `json:"inv_num"`
+	InvOrdNum     string     `json:"inv_ord_num"`
+	InvType       string     `json:"inv_type"`
+	TypeOfInv     string     `json:"type_of_inv"`
+	IssueDateTime time.Time  `json:"issue_date_time"`
+	IIC           string     `json:"iic"`
+	FIC           string     `json:"fic"`
+	BuyerTIN      string     `json:"buyer_tin,omitempty"`
+	BuyerName     string     `json:"buyer_name,omitempty"`
+	TotPriceWoVAT float64    `json:"tot_price_wo_vat"`
+	TotVATAmt     float64    `json:"tot_vat_amt"`
+	TotPrice      float64    `json:"tot_price"`
+	Request       *AuditFile `json:"request"`
+	Response      *AuditFile `json:"response"`
+	PDF           *AuditFile `json:"pdf,omitempty"`
+}
+
+// AuditManifest describes the content of an audit package
+type AuditManifest struct {
+	TIN       string          `json:"tin"`
+	Name      string          `json:"name"`
+	From      time.Time       `json:"from"`
+	To        time.Time       `json:"to"`
+	CreatedAt time.Time       `json:"created_at"`
+	Summary   *Summary        `json:"summary"`
+	Invoices  []*AuditInvoice `json:"invoices"`
+	// Files are all other files of the package
+	Files []*AuditFile `json:"files"`
+}
+
+// AuditOutput describes a written audit package
+type AuditOutput struct {
+	File     string   `json:"file"`
+	Invoices int      `json:"invoices"`
+	Summary  *Summary `json:"summary"`
+}
+
+// auditWriter adds files to the package and records their checksums
+type auditWriter struct {
+	zip *zip.Writer
+}
+
+func (w *auditWriter) add(name string, buf []byte) (*AuditFile, error) {
+	f, err := w.zip.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Write(buf); err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(buf)
+	return &AuditFile{Path: name, SHA256: hex.EncodeToString(sum[:])}, nil
+}
+
+func (w *auditWriter) addFile(name, filePath string) (*AuditFile, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return w.add(name, buf)
+}
+
+func auditManifestCSV(manifest *AuditManifest) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{
+		"inv_num", "inv_ord_num", "inv_type", "type_of_inv", "issue_date_time", "iic", "fic",
+		"buyer_tin", "buyer_name", "tot_price_wo_vat", "tot_vat_amt", "tot_price",
+		"request", "request_sha256", "response", "response_sha256", "pdf", "pdf_sha256",
+	})
+	for _, it := range manifest.Invoices {
+		pdf := &AuditFile{}
+		if it.PDF != nil {
+			pdf = it.PDF
+		}
+		w.Write([]string{
+			it.InvNum,
+			it.InvOrdNum,
+			it.InvType,
+			it.TypeOfInv,
+			it.IssueDateTime.Format(time.RFC3339),
+			it.IIC,
+			it.FIC,
+			it.BuyerTIN,
+			it.BuyerName,
+			strconv.FormatFloat(it.TotPriceWoVAT, 'f', 2, 64),
+			strconv.FormatFloat(it.TotVATAmt, 'f', 2, 64),
+			strconv.FormatFloat(it.TotPrice, 'f', 2, 64),
+			it.Request.Path,
+			it.Request.SHA256,
+			it.Response.Path,
+			it.Response.SHA256,
+			pdf.Path,
+			pdf.SHA256,
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// exportAudit writes invoices archived from startDate to endDate into a ZIP
+// with manifest.json, manifest.csv and the period report
+func exportAudit(startDate, endDate time.Time, filePath string) (*AuditOutput, error) {
+	summary, err := computeSummary(startDate, endDate, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSummaryPDF(summary); err != nil {
+		return nil, err
+	}
+	entries, err := indexEntriesByDay(startDate, endDate)
+	if err != nil {
+		return nil, err
+	}
+	if filePath == "" {
+		fileName := strings.Join([]string{"revizija", startDate.Format("2006-01-02"), endDate.Format("2006-01-02")}, "_")
+		filePath = currentWorkingDirectoryFilePath(fileName + ".zip")
+	}
+
+	// the package is written next to its final name and renamed when complete
+	tmp, err := ioutil.TempFile(filepath.Dir(filePath), ".revizija-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := &auditWriter{zip: zip.NewWriter(tmp)}
+	manifest := &AuditManifest{
+		TIN:       SepConfig.TIN,
+		Name:      SepConfig.Name,
+		From:      startDate,
+		To:        endDate,
+		CreatedAt: time.Now(),
+		Summary:   summary,
+		Invoices:  []*AuditInvoice{},
+		Files:     []*AuditFile{},
+	}
+	for _, e := range entries {
+		it := &AuditInvoice{
+			InvNum:        e.InvNum,
+			InvOrdNum:     e.InvOrdNum,
+			InvType:       e.InvType,
+			TypeOfInv:     e.TypeOfInv,
+			IssueDateTime: e.IssueDateTime,
+			IIC:           e.IIC,
+			FIC:           e.FIC,
+			BuyerTIN:      e.BuyerTIN,
+			BuyerName:     e.BuyerName,
+			TotPriceWoVAT: e.TotPriceWoVAT,
+			TotVATAmt:     e.TotVATAmt,
+			TotPrice:      e.TotPrice,
+		}
+		if it.Request, err = w.addFile(e.Request, absolutePath(e.Request)); err != nil {
+			return nil, err
+		}
+		if it.Response, err = w.addFile(e.Response, absolutePath(e.Response)); err != nil {
+			return nil, err
+		}
+		if e.PDF != "" {
+			if it.PDF, err = w.addFile(e.PDF, absolutePath(e.PDF)); err != nil {
+				return nil, err
+			}
+		}
+		manifest.Invoices = append(manifest.Invoices, it)
+	}
+
+	file, err := w.addFile(filepath.Base(summary.PDFile), summary.PDFile)
+	if err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, file)
+	if _, err := os.Stat(currentWorkingDirectoryFilePath(ledgerFileName)); err == nil {
+		if file, err = w.addFile(ledgerFileName, currentWorkingDirectoryFilePath(ledgerFileName)); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, file)
+	}
+	buf, err := auditManifestCSV(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if file, err = w.add("manifest.csv", buf); err != nil {
+		return nil, err
+	}
+	manifest.Files = append(manifest.Files, file)
+	if buf, err = json.MarshalIndent(manifest, "", "\t"); err != nil {
+		return nil, err
+	}
+	if _, err := w.add("manifest.json", buf); err != nil {
+		return nil, err
+	}
+
+	if err := w.zip.Close(); err != nil {
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return nil, err
+	}
+	return &AuditOutput{File: filePath, Invoices: len(manifest.Invoices), Summary: summary}, nil
+}
+
+func auditExportCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("audit export")
+	fromValue := fs.String("from", "", "")
+	toValue := fs.String("to", "", "")
+	output := fs.String("output", "", "")
+	if err := fs.Parse(args); err != nil || *fromValue == "" || *toValue == "" || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	from, err := time.Parse("2006-01-02", *fromValue)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse("2006-01-02", *toValue)
+	if err != nil {
+		return nil, err
+	}
+	if to.Before(from) {
+		return nil, fmt.Errorf("datum do je prije datuma od")
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return exportAudit(from, to, argPath(*output))
+}
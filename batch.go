@@ -0,0 +1,453 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+)
+
+// batchColumns are the columns of a batch CSV file. Rows sharing tcr and
+// ord_num are items of the same invoice.
+var batchColumns = []string{
+	"ord_num",
+	"kind",
+	"simplified",
+	"issue_date_time",
+	"client_tin",
+	"pay_method",
+	"pay_deadline",
+	"item_name",
+	"item_code",
+	"unit",
+	"quantity",
+	"unit_price",
+	"rebate",
+	"vat_rate",
+	"tcr",
+}
+
+// batchInvoiceColumns describe the invoice rather than an item, so rows of
+// the same invoice must agree on them
+var batchInvoiceColumns = []string{
+	"kind",
+	"simplified",
+	"issue_date_time",
+	"client_tin",
+	"pay_method",
+	"pay_deadline",
+}
+
+// batchKey identifies an invoice of a batch; every TCR numbers its invoices
+type batchKey struct {
+	TCR    string
+	OrdNum uint64
+}
+
+// BatchEntry is a single invoice of a batch together with its source rows
+type BatchEntry struct {
+	Rows  []int
+	Input *InvoiceInput
+}
+
+// BatchResult is the outcome of fiscalizing a single batch entry
+type BatchResult struct {
+	Row    int    `json:"row"`
+	OrdNum uint64 `json:"ord_num"`
+	TCR    string `json:"tcr,omitempty"`
+	OK     bool   `json:"ok"`
+	IIC    string `json:"iic,omitempty"`
+	FIC    string `json:"fic,omitempty"`
+	Queued bool   `json:"queued,omitempty"`
+	// Skipped invoices were issued by an earlier run of the batch
+	Skipped bool   `json:"skipped,omitempty"`
+	Stage   Stage  `json:"stage,omitempty"`
+	Fault   string `json:"fault,omitempty"`
+}
+
+// BatchOutput summarizes a batch run
+type BatchOutput struct {
+	Total      int    `json:"total"`
+	Registered int    `json:"registered"`
+	Queued     int    `json:"queued"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	ResultFile string `json:"result_file"`
+}
+
+// loadBatch reads batch entries from a .json or .csv file
+func loadBatch(filePath string) ([]*BatchEntry, error) {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json":
+		return loadBatchJSON(filePath)
+	case ".csv":
+		return loadBatchCSV(filePath)
+	}
+	return nil, fmt.Errorf("nepodržan format fajla %s", filePath)
+}
+
+func loadBatchJSON(filePath string) ([]*BatchEntry, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	inputs := []*InvoiceInput{}
+	if err := json.Unmarshal(buf, &inputs); err != nil {
+		return nil, err
+	}
+	entries := []*BatchEntry{}
+	for i, in := range inputs {
+		entries = append(entries, &BatchEntry{Rows: []int{i + 1}, Input: in})
+	}
+	return entries, nil
+}
+
+func loadBatchCSV(filePath string) ([]*BatchEntry, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("prazan fajl %s", filePath)
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	for _, name := range []string{"ord_num", "pay_method", "item_name", "quantity", "unit_price", "vat_rate"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("nedostaje kolona %s", name)
+		}
+	}
+	value := func(record []string, name string) string {
+		i, ok := columns[name]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	float := func(record []string, name string, row int) (float64, error) {
+		s := value(record, name)
+		if s == "" {
+			return 0, nil
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return 0, fmt.Errorf("red %d, kolona %s: %v", row, name, err)
+		}
+		return v, nil
+	}
+
+	entries := []*BatchEntry{}
+	byKey := map[batchKey]*BatchEntry{}
+	for i, record := range records[1:] {
+		row := i + 2
+		ordNum, err := strconv.ParseUint(value(record, "ord_num"), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("red %d, kolona ord_num: %v", row, err)
+		}
+		key := batchKey{TCR: tcrCode(value(record, "tcr")), OrdNum: ordNum}
+		entry, ok := byKey[key]
+		if ok {
+			first := records[entry.Rows[0]-1]
+			for _, name := range batchInvoiceColumns {
+				if it := value(record, name); it != "" && !strings.EqualFold(it, value(first, name)) {
+					return nil, fmt.Errorf("red %d, kolona %s: %q se razlikuje od %q u redu %d istog računa", row, name, it, value(first, name), entry.Rows[0])
+				}
+			}
+		} else {
+			simplified, _ := strconv.ParseBool(value(record, "simplified"))
+			entry = &BatchEntry{Input: &InvoiceInput{
+				Kind:          value(record, "kind"),
+				Simplified:    simplified,
+				OrdNum:        ordNum,
+				IssueDateTime: value(record, "issue_date_time"),
+				ClientTIN:     value(record, "client_tin"),
+				PayMethod:     value(record, "pay_method"),
+				PayDeadline:   value(record, "pay_deadline"),
+				TCR:           value(record, "tcr"),
+			}}
+			byKey[key] = entry
+			entries = append(entries, entry)
+		}
+
+		item := ItemInput{
+			Name: value(record, "item_name"),
+			Code: value(record, "item_code"),
+			Unit: value(record, "unit"),
+		}
+		if item.Quantity, err = float(record, "quantity", row); err != nil {
+			return nil, err
+		}
+		if item.UnitPrice, err = float(record, "unit_price", row); err != nil {
+			return nil, err
+		}
+		if item.Rebate, err = float(record, "rebate", row); err != nil {
+			return nil, err
+		}
+		if item.VATRate, err = float(record, "vat_rate", row); err != nil {
+			return nil, err
+		}
+		entry.Rows = append(entry.Rows, row)
+		entry.Input.Items = append(entry.Input.Items, item)
+	}
+	return entries, nil
+}
+
+// runBatch fiscalizes all entries one by one; a failed entry does not stop
+// the batch
+func runBatch(entries []*BatchEntry, progress bool) []*BatchResult {
+	results := []*BatchResult{}
+	for _, entry := range entries {
+		res := fiscalizeBatchEntry(entry)
+		if progress {
+			if res.Queued {
+				fmt.Printf("Račun %d: IKOF %s, čeka naknadnu dostavu\n", res.OrdNum, res.IIC)
+			} else if res.Skipped {
+				fmt.Printf("Račun %d: već izdat, IKOF %s\n", res.OrdNum, res.IIC)
+			} else if res.OK {
+				fmt.Printf("Račun %d: OK, JIKR %s\n", res.OrdNum, res.FIC)
+			} else {
+				fmt.Printf("Račun %d: NIJE USPEŠNO, %s\n", res.OrdNum, res.Fault)
+			}
+		}
+		for _, row := range entry.Rows {
+			it := *res
+			it.Row = row
+			results = append(results, &it)
+		}
+	}
+	return results
+}
+
+func fiscalizeBatchEntry(entry *BatchEntry) *BatchResult {
+	res := &BatchResult{OrdNum: entry.Input.OrdNum, TCR: entry.Input.TCR}
+	kind, err := entry.Input.InvoiceKind()
+	if err != nil {
+		res.Stage = StageGenerate
+		res.Fault = err.Error()
+		return res
+	}
+
+	p := newInvoicePipeline(kind)
+	p.Stages[StageGenerate] = buildInvoiceStage(entry.Input)
+	tx, err := p.NewTransaction()
+	if err != nil {
+		res.Stage = StageGenerate
+		res.Fault = err.Error()
+		return res
+	}
+	tx.Simplified = entry.Input.Simplified
+	err = withTCR(entry.Input.TCR, func() error {
+		issued, err := issuedInvoice(entry.Input)
+		if err != nil {
+			return err
+		}
+		if issued != nil {
+			res.OK, res.Skipped = true, true
+			res.IIC, res.FIC = issued.IIC, issued.FIC
+			removeWorkspace(tx.Dir)
+			return nil
+		}
+		return p.Run(tx)
+	})
+	if res.Skipped {
+		return res
+	}
+
+	res.IIC = tx.IIC
+	res.FIC = tx.FIC
+	res.Queued = tx.Queued
+	if err != nil {
+		if len(tx.Results) > 0 {
+			res.Stage = tx.Results[len(tx.Results)-1].Stage
+		}
+		res.Fault = err.Error()
+		discardTransaction(tx)
+		return res
+	}
+	res.OK = true
+	return res
+}
+
+// issuedInvoice returns the invoice with the number of the input that was
+// archived or queued for subsequent delivery, nil if there is none, so a batch
+// run again does not issue its invoices twice
+func issuedInvoice(in *InvoiceInput) (*IndexEntry, error) {
+	issueDateTime, err := in.issueTime()
+	if err != nil || SepConfig.TCR == nil {
+		// left to the pipeline to report
+		return nil, nil
+	}
+	number := invNum(SepConfig.TCR, in.OrdNum, issueDateTime)
+	if e, err := findInvoiceByInvNum(number); err != nil || e != nil {
+		return e, err
+	}
+	items, err := loadOutbox()
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range items {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromFile(filepath.Join(it.Dir, outboxRequestFile)); err != nil {
+			return nil, err
+		}
+		if invoice := doc.FindElement("//Invoice"); invoice != nil && invoice.SelectAttrValue("InvNum", "") == number {
+			return &IndexEntry{IIC: it.IIC, InvNum: number}, nil
+		}
+	}
+	return nil, nil
+}
+
+// writeBatchResults writes per-row results in the format of the input file
+func writeBatchResults(results []*BatchResult, filePath string) error {
+	if strings.ToLower(filepath.Ext(filePath)) == ".json" {
+		buf, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(filePath, buf, 0644)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"row", "ord_num", "tcr", "ok", "queued", "skipped", "iic", "fic", "stage", "fault"})
+	for _, it := range results {
+		w.Write([]string{
+			strconv.Itoa(it.Row),
+			strconv.FormatUint(it.OrdNum, 10),
+			it.TCR,
+			strconv.FormatBool(it.OK),
+			strconv.FormatBool(it.Queued),
+			strconv.FormatBool(it.Skipped),
+			it.IIC,
+			it.FIC,
+			string(it.Stage),
+			it.Fault,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// batchResultFilePath returns default result file path for an input file
+func batchResultFilePath(inputFilePath string) string {
+	extension := filepath.Ext(inputFilePath)
+	return strings.Join([]string{inputFilePath[0 : len(inputFilePath)-len(extension)], "result"}, "_") + extension
+}
+
+// fiscalizeBatch loads, fiscalizes and writes results of a batch file
+func fiscalizeBatch(inputFilePath, resultFilePath string, progress bool) (*BatchOutput, error) {
+	entries, err := loadBatch(inputFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if resultFilePath == "" {
+		resultFilePath = batchResultFilePath(inputFilePath)
+	}
+	for _, it := range entries {
+		if !cashPayMethods[strings.ToUpper(it.Input.PayMethod)] {
+			continue
+		}
+		if warning := cashDepositWarning(); warning != "" {
+			if progress {
+				fmt.Println(warning)
+			} else {
+				fmt.Fprintln(os.Stderr, warning)
+			}
+		}
+		break
+	}
+
+	results := runBatch(entries, progress)
+	output := &BatchOutput{Total: len(entries), ResultFile: resultFilePath}
+	failed := map[batchKey]bool{}
+	queued := map[batchKey]bool{}
+	skipped := map[batchKey]bool{}
+	for _, it := range results {
+		key := batchKey{TCR: it.TCR, OrdNum: it.OrdNum}
+		if !it.OK {
+			failed[key] = true
+		} else if it.Queued {
+			queued[key] = true
+		} else if it.Skipped {
+			skipped[key] = true
+		}
+	}
+	output.Failed = len(failed)
+	output.Queued = len(queued)
+	output.Skipped = len(skipped)
+	output.Registered = output.Total - output.Failed - output.Queued - output.Skipped
+
+	if err := writeBatchResults(results, resultFilePath); err != nil {
+		return output, err
+	}
+	if output.Failed > 0 {
+		return output, fmt.Errorf("%d od %d računa nije fiskalizovano", output.Failed, output.Total)
+	}
+	return output, nil
+}
+
+func registerBatch() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("GRUPNA FISKALIZACIJA IZ FAJLA")
+	fmt.Println()
+	fmt.Printf("Podržani formati: JSON lista računa ili CSV sa kolonama %s\n", strings.Join(batchColumns, ","))
+	fmt.Println("---------------------------------------------------------------")
+
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+
+	output, err := fiscalizeBatch(gen.Scan("Putanja do fajla: "), "", true)
+	if output != nil {
+		fmt.Println()
+		fmt.Printf("Ukupno računa: %d\n", output.Total)
+		fmt.Printf("Fiskalizovano: %d\n", output.Registered)
+		fmt.Printf("Čeka naknadnu dostavu: %d\n", output.Queued)
+		fmt.Printf("Već izdato: %d\n", output.Skipped)
+		fmt.Printf("Nije uspešno: %d\n", output.Failed)
+		fmt.Printf("Rezultati sačuvani u %s\n", output.ResultFile)
+	}
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+func invoiceBatchCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("invoice batch")
+	input := fs.String("input", "", "")
+	output := fs.String("output", "", "")
+	if err := fs.Parse(args); err != nil || *input == "" {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	return fiscalizeBatch(argPath(*input), argPath(*output), false)
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/sep"
+)
+
+// Exit codes of the command line mode
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+// errUsage is returned by commands called with invalid arguments
+var errUsage = errors.New("pogrešni argumenti")
+
+// Command is a non-interactive counterpart of a menu option
+type Command struct {
+	Name  string
+	Usage string
+	Run   func(args []string) (interface{}, error)
+	// ReadOnly commands write nothing, apart from rebuilding a missing
+	// index, and run without finishing interrupted transactions first, so
+	// they show them as they are. Commands writing a report or an export
+	// are not ReadOnly, as what they write must not miss those transactions.
+	ReadOnly bool
+}
+
+// commands lists all commands available from the command line
+var commands = []*Command{
+	{
+		Name:  "invoice register",
+		Usage: "--input invoice.json",
+		Run:   invoiceRegisterCommand,
+	},
+	{
+		Name:  "invoice batch",
+		Usage: "--input invoices.csv|invoices.json [--output results.csv]",
+		Run:   invoiceBatchCommand,
+	},
+	{
+		Name:  "invoices reindex",
+		Usage: "",
+		Run:   invoicesReindexCommand,
+	},
+	{
+		Name:     "invoices list",
+		Usage:    "[--from 2021-01-01] [--to 2021-01-31] [--client PIB|naziv] [--iic prefix] [--fic prefix] [--min 0] [--max 100] [--type INVOICE|CORRECTIVE|SUMMARY|CASH|NONCASH] [--pay-method BANKNOTE] [--tcr TCRCode|naziv]",
+		Run:      invoicesListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "invoices search",
+		Usage:    "[--from 2021-01-01] [--to 2021-01-31] [--client PIB|naziv] [--iic prefix] [--fic prefix] [--min 0] [--max 100] [--type INVOICE|CORRECTIVE|SUMMARY|CASH|NONCASH] [--pay-method BANKNOTE] [--tcr TCRCode|naziv]",
+		Run:      invoicesSearchCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "invoices reprint",
+		Usage: "[--copy] IIC|FIC|InvNum",
+		Run:   invoicesReprintCommand,
+	},
+	{
+		Name:     "invoices show",
+		Usage:    "IIC|FIC|InvNum",
+		Run:      invoicesShowCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "verify-archive",
+		Usage:    "",
+		Run:      verifyArchiveCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "ledger verify",
+		Usage:    "",
+		Run:      ledgerVerifyCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "ledger seal",
+		Usage: "",
+		Run:   ledgerSealCommand,
+	},
+	{
+		Name:     "iic generate",
+		Usage:    "--issue-date-time 2021-01-01T10:00:00+01:00 --ord-num 1 --total 12.10",
+		Run:      iicGenerateCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "tcr register",
+		Usage: "--busin-unit xx123xx123 --soft-code ss123ss123 --maintainer-code mm123mm123 [--internal-id 1] [--type REGULAR] [--valid-from 2021-01-01] [--label naziv]",
+		Run:   tcrRegisterCommand,
+	},
+	{
+		Name:     "tcr show",
+		Usage:    "",
+		Run:      tcrShowCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "tcr list",
+		Usage:    "",
+		Run:      tcrListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "tcr use",
+		Usage: "TCRCode|naziv",
+		Run:   tcrUseCommand,
+	},
+	{
+		Name:  "tcr label",
+		Usage: "TCRCode|naziv naziv",
+		Run:   tcrLabelCommand,
+	},
+	{
+		Name:  "tcr deactivate",
+		Usage: "[--valid-to 2021-12-31] TCRCode|naziv",
+		Run:   tcrDeactivateCommand,
+	},
+	{
+		Name:  "tcr reactivate",
+		Usage: "[--valid-to 2022-12-31] TCRCode|naziv",
+		Run:   tcrReactivateCommand,
+	},
+	{
+		Name:  "tcr replace",
+		Usage: "--internal-id 2 [--soft-code ss123ss123] [--maintainer-code mm123mm123] [--valid-from 2021-01-01] [--label naziv] TCRCode|naziv",
+		Run:   tcrReplaceCommand,
+	},
+	{
+		Name:  "deposit register",
+		Usage: "--operation INITIAL|WITHDRAW --amount 100.00 [--change-date-time 2021-01-01T08:00:00+01:00]",
+		Run:   depositRegisterCommand,
+	},
+	{
+		Name:     "deposit list",
+		Usage:    "[--date 2021-01-01]",
+		Run:      depositListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "wtn register",
+		Usage: "--input wtn.json",
+		Run:   wtnRegisterCommand,
+	},
+	{
+		Name:     "company show",
+		Usage:    "",
+		Run:      companyShowCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "company set",
+		Usage: "[--name Naziv] [--tin 12345678] [--vat 12/34-56789-0] [--address Adresa] [--town Grad] [--country MNE] [--phone Tel] [--fax Fax] [--bank-account 510-1234567890123-45] [--operator-code ab123ab123]",
+		Run:   companySetCommand,
+	},
+	{
+		Name:  "client add",
+		Usage: "--name Naziv --tin 12345678 [--vat 12/34-56789-0] [--address Adresa] [--town Grad] [--country MNE]",
+		Run:   clientAddCommand,
+	},
+	{
+		Name:  "client edit",
+		Usage: "[--name Naziv] [--tin 12345678] [--vat 12/34-56789-0] [--address Adresa] [--town Grad] [--country MNE] PIB|naziv|#broj",
+		Run:   clientEditCommand,
+	},
+	{
+		Name:  "client delete",
+		Usage: "PIB|naziv|#broj",
+		Run:   clientDeleteCommand,
+	},
+	{
+		Name:  "client merge",
+		Usage: "PIB|naziv|#broj PIB|naziv|#broj",
+		Run:   clientMergeCommand,
+	},
+	{
+		Name:     "clients list",
+		Usage:    "",
+		Run:      clientsListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "clients search",
+		Usage:    "PIB|PDV|naziv|grad",
+		Run:      clientsSearchCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "clients duplicates",
+		Usage:    "",
+		Run:      clientsDuplicatesCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "clients import",
+		Usage: "[--map tin=PIB,name=Naziv] [--comma ;] [--on-conflict skip|update|fail] [--dry-run] clients.csv",
+		Run:   clientsImportCommand,
+	},
+	{
+		Name:  "clients export",
+		Usage: "clients.csv|clients.json",
+		Run:   clientsExportCommand,
+	},
+	{
+		Name:     "outbox list",
+		Usage:    "",
+		Run:      outboxListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "outbox flush",
+		Usage: "[--type NOINTERNET|BOUNDBOOK|SERVICE|TECHNICALERROR|BUSINESSNEEDS]",
+		Run:   outboxFlushCommand,
+	},
+	{
+		Name:  "outbox discard",
+		Usage: "IIC",
+		Run:   outboxDiscardCommand,
+	},
+	{
+		Name:     "journal list",
+		Usage:    "",
+		Run:      journalListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "journal recover",
+		Usage: "",
+		Run:   journalRecoverCommand,
+	},
+	{
+		Name:  "journal resend",
+		Usage: "ID",
+		Run:   journalResendCommand,
+	},
+	{
+		Name:  "journal discard",
+		Usage: "ID",
+		Run:   journalDiscardCommand,
+	},
+	{
+		Name:     "settings show",
+		Usage:    "",
+		Run:      settingsShowCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "settings set",
+		Usage: "[--endpoint http://127.0.0.1:8080/] [--timeout seconds] [--signer safenet|pkcs11|pkcs12] [--pkcs12-file cert.p12] [--pkcs11-module lib.so] [--pkcs11-token label] [--pkcs11-slot n] [--pkcs11-key label] [--pkcs11-key-id hex]",
+		Run:   settingsSetCommand,
+	},
+	{
+		Name:     "secrets list",
+		Usage:    "",
+		Run:      secretsListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "secrets set",
+		Usage: "--name safenet_pin|pkcs11_pin|pkcs12_password < secret.txt",
+		Run:   secretsSetCommand,
+	},
+	{
+		Name:  "secrets rotate",
+		Usage: "[--key-file fisc.key]",
+		Run:   secretsRotateCommand,
+	},
+	{
+		Name:  "secrets wipe",
+		Usage: "[--name safenet_pin]",
+		Run:   secretsWipeCommand,
+	},
+	{
+		Name:     "token list",
+		Usage:    "[--module lib.so]",
+		Run:      tokenListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:     "profile list",
+		Usage:    "",
+		Run:      profileListCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "profile add",
+		Usage: "naziv",
+		Run:   profileAddCommand,
+	},
+	{
+		Name:     "simulate-server",
+		Usage:    "[--listen 127.0.0.1:8080] [--scenario faults.json] [--fault timeout|http500|malformed|soap|nofic] [--request RegisterInvoiceRequest] [--code 0] [--message text] [--skip n] [--times n] [--registered] [--delay seconds] [--duplicate-fault]",
+		Run:      simulateServerCommand,
+		ReadOnly: true,
+	},
+	{
+		Name:  "audit export",
+		Usage: "--from 2021-01-01 --to 2021-01-31 [--output revizija.zip]",
+		Run:   auditExportCommand,
+	},
+	{
+		Name:  "report",
+		Usage: "--from 2021-01-01 --to 2021-01-31 [--tcr TCRCode|naziv]",
+		Run:   reportCommand,
+	},
+}
+
+// CommandOutput is written to stdout as JSON after every command
+type CommandOutput struct {
+	OK     bool        `json:"ok"`
+	Error  string      `json:"error,omitempty"`
+	Result interface{} `json:"result,omitempty"`
+}
+
+// runCommand runs the command given by args, after global options, in the
+// selected profile and returns the exit code
+func runCommand(args []string) int {
+	cmd, rest := findCommand(args)
+	if cmd == nil {
+		printCommandsUsage()
+		return exitUsage
+	}
+
+	var result interface{}
+	err := useProfile(ProfileName)
+	if err == nil {
+		// finish transactions interrupted by a crash before running a command
+		// that changes data
+		if err := loadConfig(); err == nil && !cmd.ReadOnly {
+			if err := loadClients(); err != nil {
+				Clients = &[]sep.Client{}
+			}
+			recoverOnStartup(os.Stderr)
+		}
+		result, err = cmd.Run(rest)
+	}
+	if err == errUsage {
+		fmt.Fprintf(os.Stderr, "upotreba: fisc %s %s\n", cmd.Name, cmd.Usage)
+		return exitUsage
+	}
+
+	output := CommandOutput{OK: err == nil, Result: result}
+	if err != nil {
+		output.Error = err.Error()
+	}
+	buf, jsonErr := json.MarshalIndent(output, "", "\t")
+	if jsonErr != nil {
+		fmt.Fprintln(os.Stderr, jsonErr)
+		return exitError
+	}
+	fmt.Println(string(buf))
+
+	if err != nil {
+		return exitError
+	}
+	return exitOK
+}
+
+// parseGlobalOptions applies options given before the command name, e.g.
+// fisc --profile firma --tcr ab123ab123 invoice register --input invoice.json
+func parseGlobalOptions(args []string) ([]string, error) {
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		name, value := strings.TrimPrefix(args[0], "--"), ""
+		if i := strings.Index(name, "="); i >= 0 {
+			name, value = name[:i], name[i+1:]
+			args = args[1:]
+		} else {
+			if len(args) < 2 {
+				return nil, errUsage
+			}
+			value = args[1]
+			args = args[2:]
+		}
+		switch name {
+		case "tcr":
+			SessionTCR = value
+		case "profile":
+			ProfileName = value
+		default:
+			return nil, errUsage
+		}
+	}
+	return args, nil
+}
+
+// findCommand returns the command with the longest name matching args
+func findCommand(args []string) (*Command, []string) {
+	var found *Command
+	var rest []string
+	for _, cmd := range commands {
+		words := strings.Fields(cmd.Name)
+		if len(words) > len(args) || strings.Join(args[:len(words)], " ") != cmd.Name {
+			continue
+		}
+		if found == nil || len(words) > len(strings.Fields(found.Name)) {
+			found, rest = cmd, args[len(words):]
+		}
+	}
+	return found, rest
+}
+
+func printCommandsUsage() {
+	fmt.Fprintln(os.Stderr, "upotreba: fisc [--profile naziv] [--tcr TCRCode|naziv] [komanda] [argumenti]")
+	fmt.Fprintln(os.Stderr, "bez argumenata pokreće se interaktivni meni")
+	fmt.Fprintln(os.Stderr, "--tcr bira ENU umjesto podrazumijevanog")
+	fmt.Fprintln(os.Stderr)
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  fisc %s %s\n", cmd.Name, cmd.Usage)
+	}
+}
+
+// newFlagSet creates a flag set that reports errors instead of exiting
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	return fs
+}
+
+// argPath resolves a path given on the command line against the directory
+// fisc was invoked from
+func argPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(InvocationDir, path)
+}
+
+// requireConfig loads config.json and clients.json without prompting
+func requireConfig() error {
+	if err := loadConfig(); err != nil {
+		return fmt.Errorf("config.json nije učitan, pokrenite fisc bez argumenata: %v", err)
+	}
+	if err := loadClients(); err != nil {
+		Clients = &[]sep.Client{}
+	}
+	return nil
+}
+
+// requireTCR makes sure config is loaded and a TCR is registered
+func requireTCR() error {
+	if err := requireConfig(); err != nil {
+		return err
+	}
+	if SepConfig.TCR == nil {
+		return fmt.Errorf("ENU nije registrovan")
+	}
+	return nil
+}
+
+// StageOutput is a machine readable StageResult
+type StageOutput struct {
+	Stage      Stage  `json:"stage"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// TransactionOutput is a machine readable Transaction
+type TransactionOutput struct {
+	IIC     string        `json:"iic,omitempty"`
+	FIC     string        `json:"fic,omitempty"`
+	FCDC    string        `json:"fcdc,omitempty"`
+	WTNIC   string        `json:"wtnic,omitempty"`
+	FWTNIC  string        `json:"fwtnic,omitempty"`
+	Queued  bool          `json:"queued,omitempty"`
+	TCRCode string        `json:"tcr_code,omitempty"`
+	Folder  string        `json:"folder,omitempty"`
+	PDF     string        `json:"pdf,omitempty"`
+	Stages  []StageOutput `json:"stages"`
+}
+
+func newTransactionOutput(tx *Transaction) *TransactionOutput {
+	output := &TransactionOutput{
+		IIC:     tx.IIC,
+		FIC:     tx.FIC,
+		FCDC:    tx.FCDC,
+		WTNIC:   tx.WTNIC,
+		FWTNIC:  tx.FWTNIC,
+		Queued:  tx.Queued,
+		TCRCode: tx.TCRCode,
+		Folder:  tx.Folder,
+		PDF:     tx.PDFFilePath,
+		Stages:  []StageOutput{},
+	}
+	for _, res := range tx.Results {
+		it := StageOutput{Stage: res.Stage, DurationMs: int64(res.Duration / time.Millisecond)}
+		if res.Err != nil {
+			it.Error = res.Err.Error()
+		}
+		output.Stages = append(output.Stages, it)
+	}
+	return output
+}
+
+// buildInvoiceStage writes the request from input instead of prompting
+func buildInvoiceStage(in *InvoiceInput) StageFunc {
+	return func(tx *Transaction) error {
+		return writeInvoiceRequest(in, tx.GenFile)
+	}
+}
+
+func invoiceRegisterCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("invoice register")
+	input := fs.String("input", "", "")
+	if err := fs.Parse(args); err != nil || *input == "" {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	in, err := loadInvoiceInput(argPath(*input))
+	if err != nil {
+		return nil, err
+	}
+	if in.TCR != "" {
+		SessionTCR = in.TCR
+		if err := applySessionTCR(); err != nil {
+			return nil, err
+		}
+	}
+	kind, err := in.InvoiceKind()
+	if err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	if cashPayMethods[strings.ToUpper(in.PayMethod)] {
+		if warning := cashDepositWarning(); warning != "" {
+			fmt.Fprintln(os.Stderr, warning)
+		}
+	}
+
+	p := newInvoicePipeline(kind)
+	p.Stages[StageGenerate] = buildInvoiceStage(in)
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	tx.Simplified = in.Simplified
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return newTransactionOutput(tx), err
+	}
+	return newTransactionOutput(tx), nil
+}
+
+// IICOutput is the result of the iic generate command
+type IICOutput struct {
+	IIC          string `json:"iic"`
+	IICSignature string `json:"iic_signature"`
+}
+
+func iicGenerateCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("iic generate")
+	issueDateTime := fs.String("issue-date-time", "", "")
+	ordNum := fs.String("ord-num", "", "")
+	total := fs.String("total", "", "")
+	if err := fs.Parse(args); err != nil || *issueDateTime == "" || *ordNum == "" || *total == "" {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	return computeIIC(*issueDateTime, *ordNum, *total)
+}
+
+// computeIIC returns IIC of an invoice of the configured TCR
+func computeIIC(issueDateTime, ordNum, total string) (*IICOutput, error) {
+	// IIC is computed by the same code used for invoices, from a request
+	// carrying only the attributes IIC depends on
+	doc, root := newRequestDocument("RegisterInvoiceRequest")
+	invoice := root.CreateElement("Invoice")
+	invoice.CreateAttr("IssueDateTime", issueDateTime)
+	invoice.CreateAttr("InvOrdNum", ordNum)
+	invoice.CreateAttr("BusinUnitCode", SepConfig.TCR.BusinUnitCode)
+	invoice.CreateAttr("TCRCode", SepConfig.TCR.TCRCode)
+	invoice.CreateAttr("SoftCode", SepConfig.TCR.SoftCode)
+	invoice.CreateAttr("TotPrice", total)
+	seller := invoice.CreateElement("Seller")
+	seller.CreateAttr("IDNum", SepConfig.TIN)
+
+	dir, err := newWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	defer removeWorkspace(dir)
+	inFile := filepath.Join(dir, "gen.xml")
+	outFile := filepath.Join(dir, "iic.xml")
+	if err := doc.WriteToFile(inFile); err != nil {
+		return nil, err
+	}
+	signer, err := currentSigner()
+	if err != nil {
+		return nil, err
+	}
+	if err := signer.WriteIIC(inFile, outFile); err != nil {
+		return nil, err
+	}
+	doc = etree.NewDocument()
+	if err := doc.ReadFromFile(outFile); err != nil {
+		return nil, err
+	}
+	invoice = doc.FindElement("//Invoice")
+	if invoice == nil {
+		return nil, fmt.Errorf("invalid xml, no Invoice")
+	}
+	return &IICOutput{
+		IIC:          invoice.SelectAttrValue("IIC", ""),
+		IICSignature: invoice.SelectAttrValue("IICSignature", ""),
+	}, nil
+}
+
+func tcrRegisterCommand(args []string) (interface{}, error) {
+	in := &TCRInput{}
+	fs := newFlagSet("tcr register")
+	fs.StringVar(&in.BusinUnitCode, "busin-unit", "", "")
+	fs.StringVar(&in.SoftCode, "soft-code", "", "")
+	fs.StringVar(&in.MaintainerCode, "maintainer-code", "", "")
+	fs.StringVar(&in.InternalID, "internal-id", "", "")
+	fs.StringVar(&in.Type, "type", "REGULAR", "")
+	fs.StringVar(&in.ValidFrom, "valid-from", "", "")
+	label := fs.String("label", "", "")
+	if err := fs.Parse(args); err != nil || in.BusinUnitCode == "" || in.SoftCode == "" || in.MaintainerCode == "" {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+
+	p := newTCRPipeline()
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeTCRRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return newTransactionOutput(tx), err
+	}
+	if *label != "" {
+		if _, err := labelTCR(tx.TCRCode, *label); err != nil {
+			return newTransactionOutput(tx), err
+		}
+	}
+	return newTransactionOutput(tx), nil
+}
+
+func tcrShowCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return struct {
+		TIN          string   `json:"tin"`
+		OperatorCode string   `json:"operator_code"`
+		TCR          *sep.TCR `json:"tcr"`
+	}{
+		TIN:          SepConfig.TIN,
+		OperatorCode: SepConfig.OperatorCode,
+		TCR:          SepConfig.TCR,
+	}, nil
+}
+
+func clientAddCommand(args []string) (interface{}, error) {
+	client := &sep.Client{}
+	fs := newFlagSet("client add")
+	fs.StringVar(&client.Name, "name", "", "")
+	fs.StringVar(&client.TIN, "tin", "", "")
+	fs.StringVar(&client.VAT, "vat", "", "")
+	fs.StringVar(&client.Address, "address", "", "")
+	fs.StringVar(&client.Town, "town", "", "")
+	fs.StringVar(&client.Country, "country", "MNE", "")
+	if err := fs.Parse(args); err != nil || client.Name == "" || client.TIN == "" {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := addClient(client); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func reportCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("report")
+	fromValue := fs.String("from", "", "")
+	toValue := fs.String("to", "", "")
+	tcr := fs.String("tcr", "", "")
+	if err := fs.Parse(args); err != nil || *fromValue == "" || *toValue == "" {
+		return nil, errUsage
+	}
+	from, err := time.Parse("2006-01-02", *fromValue)
+	if err != nil {
+		return nil, err
+	}
+	to, err := time.Parse("2006-01-02", *toValue)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	summary, err := computeSummary(from, to, tcrCode(*tcr))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSummaryPDF(summary); err != nil {
+		return summary, err
+	}
+	return summary, nil
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/noshto/sep"
+)
+
+// Actions of an imported client row
+const (
+	clientAdded   = "add"
+	clientUpdated = "update"
+	clientSkipped = "skip"
+	clientInvalid = "invalid"
+)
+
+// Ways of resolving an imported client whose TIN is already in clients.json
+const (
+	conflictSkip   = "skip"
+	conflictUpdate = "update"
+	conflictFail   = "fail"
+)
+
+// ClientImportRow is a CSV row with what import does with it
+type ClientImportRow struct {
+	Row    int        `json:"row"`
+	Action string     `json:"action"`
+	Client sep.Client `json:"client"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// ClientImportOutput is the result of clients import, or its preview
+type ClientImportOutput struct {
+	DryRun  bool               `json:"dry_run"`
+	Added   int                `json:"added"`
+	Updated int                `json:"updated"`
+	Skipped int                `json:"skipped"`
+	Invalid int                `json:"invalid"`
+	Rows    []*ClientImportRow `json:"rows"`
+}
+
+// parseColumnMap parses tin=PIB,name=Naziv into CSV column names by field,
+// for files whose header does not use the field names
+func parseColumnMap(value string) (map[string]string, error) {
+	columns := map[string]string{}
+	if value == "" {
+		return columns, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("pogrešno mapiranje kolona %q", pair)
+		}
+		field := strings.TrimSpace(strings.ToLower(parts[0]))
+		known := false
+		for _, it := range clientFields {
+			known = known || it.Flag == field
+		}
+		if !known {
+			return nil, fmt.Errorf("nepoznato polje klijenta %s", field)
+		}
+		columns[field] = strings.TrimSpace(strings.ToLower(parts[1]))
+	}
+	return columns, nil
+}
+
+// loadClientsCSV reads clients from a CSV file. Columns are named after
+// client fields unless columnMap names them differently.
+func loadClientsCSV(filePath string, comma rune, columnMap map[string]string) ([]*ClientImportRow, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = comma
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("prazan fajl %s", filePath)
+	}
+	// spreadsheet programs start UTF-8 files with a byte order mark
+	records[0][0] = strings.TrimPrefix(records[0][0], "\ufeff")
+	header := map[string]int{}
+	for i, name := range records[0] {
+		header[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	columns := map[string]int{}
+	for _, field := range clientFields {
+		name := field.Flag
+		if it, ok := columnMap[field.Flag]; ok {
+			name = it
+		}
+		if i, ok := header[name]; ok {
+			columns[field.Flag] = i
+		} else if _, mapped := columnMap[field.Flag]; mapped {
+			return nil, fmt.Errorf("nedostaje kolona %s", name)
+		}
+	}
+	for _, name := range []string{"name", "tin"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("nedostaje kolona %s, zadajte je sa --map %s=naziv", name, name)
+		}
+	}
+
+	rows := []*ClientImportRow{}
+	for i, record := range records[1:] {
+		if len(strings.TrimSpace(strings.Join(record, ""))) == 0 {
+			continue
+		}
+		it := &ClientImportRow{Row: i + 2}
+		for _, field := range clientFields {
+			if col, ok := columns[field.Flag]; ok && col < len(record) {
+				*field.Value(&it.Client) = strings.TrimSpace(record[col])
+			}
+		}
+		if it.Client.Country == "" {
+			it.Client.Country = "MNE"
+		}
+		it.Client.Country = strings.ToUpper(it.Client.Country)
+		rows = append(rows, it)
+	}
+	return rows, nil
+}
+
+// findImportedClient returns the client whose TIN matches an imported one
+// written with or without separators
+func findImportedClient(TIN string) *sep.Client {
+	id := normalizeClientID(TIN)
+	for i := range *Clients {
+		if normalizeClientID((*Clients)[i].TIN) == id {
+			return &(*Clients)[i]
+		}
+	}
+	return nil
+}
+
+// importClients adds imported clients to clients.json. Clients whose TIN is
+// already there are skipped, updated with the non-empty imported details, or
+// fail the whole import. Nothing is saved if any row is invalid. A dry run
+// only reports what would be done.
+func importClients(rows []*ClientImportRow, onConflict string, dryRun bool) (*ClientImportOutput, error) {
+	out := &ClientImportOutput{DryRun: dryRun, Rows: rows}
+	saved := false
+	apply := func() error {
+		if err := loadClientList(); err != nil {
+			return err
+		}
+		seen := map[string]int{}
+		invalid := 0
+		for _, it := range rows {
+			if err := checkClient(&it.Client, nil); err != nil {
+				it.Action, it.Error = clientInvalid, err.Error()
+				invalid++
+				continue
+			}
+			id := normalizeClientID(it.Client.TIN)
+			if row, ok := seen[id]; ok {
+				it.Action, it.Error = clientInvalid, fmt.Sprintf("PIB %s je već u redu %d", it.Client.TIN, row)
+				invalid++
+				continue
+			}
+			seen[id] = it.Row
+
+			existing := findImportedClient(it.Client.TIN)
+			switch {
+			case existing == nil:
+				it.Action = clientAdded
+				*Clients = append(*Clients, it.Client)
+			case onConflict == conflictFail:
+				return fmt.Errorf("red %d: klijent sa PIB %s već postoji", it.Row, it.Client.TIN)
+			case onConflict == conflictUpdate:
+				it.Action = clientSkipped
+				for _, field := range clientFields {
+					value := *field.Value(&it.Client)
+					if value != "" && value != *field.Value(existing) {
+						*field.Value(existing) = value
+						it.Action = clientUpdated
+					}
+				}
+			default:
+				it.Action = clientSkipped
+			}
+		}
+		if dryRun || invalid > 0 {
+			return nil
+		}
+		if err := saveClients(); err != nil {
+			return err
+		}
+		saved = true
+		return nil
+	}
+	var err error
+	if dryRun {
+		err = apply()
+	} else {
+		err = withDataLock(apply)
+	}
+	if !saved {
+		// forget clients that were added or changed but not saved
+		if err := loadClientList(); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range rows {
+		switch it.Action {
+		case clientAdded:
+			out.Added++
+		case clientUpdated:
+			out.Updated++
+		case clientSkipped:
+			out.Skipped++
+		case clientInvalid:
+			out.Invalid++
+		}
+	}
+	return out, nil
+}
+
+// ClientExportOutput describes an exported client list
+type ClientExportOutput struct {
+	File    string `json:"file"`
+	Clients int    `json:"clients"`
+}
+
+// exportClients writes clients.json as JSON or CSV, by the file extension
+func exportClients(filePath string) (*ClientExportOutput, error) {
+	if err := loadClientList(); err != nil {
+		return nil, err
+	}
+	out := &ClientExportOutput{File: filePath, Clients: len(*Clients)}
+	extension := strings.ToLower(filepath.Ext(filePath))
+	if extension == ".json" {
+		buf, err := json.MarshalIndent(Clients, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+		return out, ioutil.WriteFile(filePath, buf, 0644)
+	}
+	if extension != ".csv" {
+		return nil, fmt.Errorf("nepodržan format fajla %s", filePath)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	header := []string{}
+	for _, field := range clientFields {
+		header = append(header, field.Flag)
+	}
+	w.Write(header)
+	for i := range *Clients {
+		record := []string{}
+		for _, field := range clientFields {
+			record = append(record, *field.Value(&(*Clients)[i]))
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	return out, w.Error()
+}
+
+func clientsImportCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("clients import")
+	columnMap := fs.String("map", "", "")
+	comma := fs.String("comma", ",", "")
+	onConflict := fs.String("on-conflict", conflictSkip, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 || utf8.RuneCountInString(*comma) != 1 {
+		return nil, errUsage
+	}
+	switch *onConflict {
+	case conflictSkip, conflictUpdate, conflictFail:
+	default:
+		return nil, errUsage
+	}
+	columns, err := parseColumnMap(*columnMap)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	delimiter, _ := utf8.DecodeRuneInString(*comma)
+	rows, err := loadClientsCSV(argPath(fs.Arg(0)), delimiter, columns)
+	if err != nil {
+		return nil, err
+	}
+	out, err := importClients(rows, *onConflict, *dryRun)
+	if err != nil {
+		return nil, err
+	}
+	if out.Invalid > 0 && !out.DryRun {
+		return out, fmt.Errorf("neispravnih redova: %d, nijedan klijent nije uvezen", out.Invalid)
+	}
+	if out.Invalid > 0 {
+		return out, fmt.Errorf("neispravnih redova: %d", out.Invalid)
+	}
+	return out, nil
+}
+
+func clientsExportCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return exportClients(argPath(args[0]))
+}
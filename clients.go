@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/noshto/gen"
+	"github.com/noshto/sep"
+	bolt "go.etcd.io/bbolt"
+)
+
+// ClientItem is a client as listed by clients list, Number addresses it as
+// #Number when several clients share a TIN
+type ClientItem struct {
+	Number int `json:"number"`
+	sep.Client
+	// Invoices is the number of archived invoices issued to the client
+	Invoices int `json:"invoices"`
+}
+
+// clientField is a client detail that can be edited
+type clientField struct {
+	Flag  string
+	Label string
+	Value func(client *sep.Client) *string
+}
+
+var clientFields = []clientField{
+	{"name", "Ime", func(client *sep.Client) *string { return &client.Name }},
+	{"tin", "Identifikacioni broj (PIB)", func(client *sep.Client) *string { return &client.TIN }},
+	{"vat", "PDV broj (PDV)", func(client *sep.Client) *string { return &client.VAT }},
+	{"address", "Adresa", func(client *sep.Client) *string { return &client.Address }},
+	{"town", "Grad", func(client *sep.Client) *string { return &client.Town }},
+	{"country", "Država (MNE, USA, itd.)", func(client *sep.Client) *string { return &client.Country }},
+}
+
+// checkClient validates a client; TIN and VAT formats are only known for
+// domestic clients. With changes given, details stored before are not
+// checked again, so typos can be fixed one at a time.
+func checkClient(client *sep.Client, changes map[string]string) error {
+	if client.Name == "" {
+		return fmt.Errorf("ime klijenta je obavezno")
+	}
+	if client.TIN == "" {
+		return fmt.Errorf("PIB klijenta je obavezan")
+	}
+	if client.Country != "" && client.Country != "MNE" {
+		return nil
+	}
+	_, countryChanged := changes["country"]
+	changed := func(flag string) bool {
+		_, ok := changes[flag]
+		return changes == nil || ok || countryChanged
+	}
+	if changed("tin") {
+		if err := checkTIN(client.TIN); err != nil {
+			return err
+		}
+	}
+	if changed("vat") {
+		return checkVAT(client.VAT)
+	}
+	return nil
+}
+
+// clientInvoiceCounts returns the number of archived invoices per buyer TIN
+func clientInvoiceCounts() (map[string]int, error) {
+	counts := map[string]int{}
+	err := withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(clientBucket).ForEach(func(k, v []byte) error {
+				if i := bytes.IndexByte(k, '|'); i > 0 {
+					counts[string(k[:i])]++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return counts, nil
+}
+
+// loadClientList reads clients.json, a missing file is an empty list
+func loadClientList() error {
+	if err := loadClients(); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		Clients = &[]sep.Client{}
+	}
+	return nil
+}
+
+// listClients returns clients whose TIN, VAT, name or town contains query,
+// all clients for an empty query
+func listClients(query string) ([]*ClientItem, error) {
+	if err := loadClientList(); err != nil {
+		return nil, err
+	}
+	counts, err := clientInvoiceCounts()
+	if err != nil {
+		return nil, err
+	}
+	query = strings.ToLower(query)
+	items := []*ClientItem{}
+	for i, it := range *Clients {
+		text := strings.ToLower(strings.Join([]string{it.TIN, it.VAT, it.Name, it.Town}, "\n"))
+		if query != "" && !strings.Contains(text, query) {
+			continue
+		}
+		items = append(items, &ClientItem{Number: i + 1, Client: it, Invoices: counts[it.TIN]})
+	}
+	return items, nil
+}
+
+// normalizeClientID makes TINs and VAT numbers written differently comparable
+func normalizeClientID(value string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "", "/", "", ".", "").Replace(value))
+}
+
+// clientDuplicates returns groups of clients sharing a TIN or VAT number
+func clientDuplicates() ([][]*ClientItem, error) {
+	items, err := listClients("")
+	if err != nil {
+		return nil, err
+	}
+	// clients are joined into the group of the first client with the same
+	// TIN or VAT
+	group := make([]int, len(items))
+	first := map[string]int{}
+	var root func(i int) int
+	root = func(i int) int {
+		if group[i] != i {
+			group[i] = root(group[i])
+		}
+		return group[i]
+	}
+	for i, it := range items {
+		group[i] = i
+		for _, key := range []string{"tin:" + normalizeClientID(it.TIN), "vat:" + normalizeClientID(it.VAT)} {
+			if strings.HasSuffix(key, ":") {
+				continue
+			}
+			if j, ok := first[key]; ok {
+				group[root(i)] = root(j)
+			} else {
+				first[key] = i
+			}
+		}
+	}
+	byRoot := map[int][]*ClientItem{}
+	roots := []int{}
+	for i, it := range items {
+		r := root(i)
+		if _, ok := byRoot[r]; !ok {
+			roots = append(roots, r)
+		}
+		byRoot[r] = append(byRoot[r], it)
+	}
+	groups := [][]*ClientItem{}
+	for _, r := range roots {
+		if len(byRoot[r]) > 1 {
+			groups = append(groups, byRoot[r])
+		}
+	}
+	return groups, nil
+}
+
+// findClientIndex returns the position of the client given as #Number, TIN
+// or exact name in the loaded list
+func findClientIndex(key string) (int, error) {
+	if strings.HasPrefix(key, "#") {
+		n, err := strconv.Atoi(key[1:])
+		if err != nil || n < 1 || n > len(*Clients) {
+			return -1, fmt.Errorf("klijent %s nije pronađen", key)
+		}
+		return n - 1, nil
+	}
+	found := []int{}
+	for i, it := range *Clients {
+		if normalizeClientID(it.TIN) == normalizeClientID(key) {
+			found = append(found, i)
+		}
+	}
+	if len(found) == 0 {
+		for i, it := range *Clients {
+			if strings.EqualFold(it.Name, key) {
+				found = append(found, i)
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return -1, fmt.Errorf("klijent %s nije pronađen", key)
+	case 1:
+		return found[0], nil
+	}
+	return -1, fmt.Errorf("više klijenata odgovara %s, koristite #broj iz liste klijenata", key)
+}
+
+// withClients runs fn with clients.json loaded under the data lock and saves
+// the list when fn succeeds
+func withClients(fn func() error) error {
+	return withDataLock(func() error {
+		if err := loadClientList(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		return saveClients()
+	})
+}
+
+// referencedClient refuses changes that would leave archived invoices of
+// the TIN without a client, unless another client keeps the TIN
+func referencedClient(tin string, except int) error {
+	for i, it := range *Clients {
+		if i != except && it.TIN == tin {
+			return nil
+		}
+	}
+	counts, err := clientInvoiceCounts()
+	if err != nil {
+		return err
+	}
+	if n := counts[tin]; n > 0 {
+		return fmt.Errorf("klijent sa PIB %s je na %d arhiviranih računa", tin, n)
+	}
+	return nil
+}
+
+// editClient changes client details, given by flag name
+func editClient(key string, changes map[string]string) (*sep.Client, error) {
+	var client sep.Client
+	err := withClients(func() error {
+		i, err := findClientIndex(key)
+		if err != nil {
+			return err
+		}
+		client = (*Clients)[i]
+		for _, field := range clientFields {
+			if value, ok := changes[field.Flag]; ok {
+				*field.Value(&client) = strings.TrimSpace(value)
+			}
+		}
+		if err := checkClient(&client, changes); err != nil {
+			return err
+		}
+		if client.TIN != (*Clients)[i].TIN {
+			for j, it := range *Clients {
+				if j != i && normalizeClientID(it.TIN) == normalizeClientID(client.TIN) {
+					return fmt.Errorf("klijent sa PIB %s već postoji, spojite klijente", client.TIN)
+				}
+			}
+			if err := referencedClient((*Clients)[i].TIN, i); err != nil {
+				return fmt.Errorf("%v, PIB se ne može promijeniti", err)
+			}
+		}
+		(*Clients)[i] = client
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// deleteClient removes a client no archived invoice refers to
+func deleteClient(key string) (*sep.Client, error) {
+	var client sep.Client
+	err := withClients(func() error {
+		i, err := findClientIndex(key)
+		if err != nil {
+			return err
+		}
+		client = (*Clients)[i]
+		if err := referencedClient(client.TIN, i); err != nil {
+			return fmt.Errorf("%v i ne može se obrisati", err)
+		}
+		*Clients = append((*Clients)[:i], (*Clients)[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// mergeClients removes the duplicate from after filling details missing in
+// into with its details
+func mergeClients(from, into string) (*sep.Client, error) {
+	var client sep.Client
+	err := withClients(func() error {
+		i, err := findClientIndex(from)
+		if err != nil {
+			return err
+		}
+		j, err := findClientIndex(into)
+		if err != nil {
+			return err
+		}
+		if i == j {
+			return fmt.Errorf("klijent se ne može spojiti sam sa sobom")
+		}
+		duplicate := (*Clients)[i]
+		if duplicate.TIN != (*Clients)[j].TIN {
+			if err := referencedClient(duplicate.TIN, i); err != nil {
+				return fmt.Errorf("%v i ne može se spojiti", err)
+			}
+		}
+		for _, field := range clientFields {
+			if value := field.Value(&(*Clients)[j]); *value == "" {
+				*value = *field.Value(&duplicate)
+			}
+		}
+		client = (*Clients)[j]
+		*Clients = append((*Clients)[:i], (*Clients)[i+1:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+// printClients prints clients with their numbers in clients.json
+func printClients(items []*ClientItem) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tIME\tPIB\tPDV\tGRAD\tRAČUNI\t")
+	for _, it := range items {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t\n", it.Number, it.Name, it.TIN, it.VAT, it.Town, it.Invoices)
+	}
+	w.Flush()
+}
+
+func manageClients() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("KLIJENTI")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	items, err := listClients(gen.Scan("Pretraga (PIB, PDV, ime ili grad), prazno za sve: "))
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("Nema klijenata")
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+		return nil
+	}
+	printClients(items)
+	if groups, err := clientDuplicates(); err == nil && len(groups) > 0 {
+		fmt.Printf("UPOZORENJE: grupa klijenata sa istim PIB ili PDV: %d\n", len(groups))
+		for _, group := range groups {
+			numbers := []string{}
+			for _, it := range group {
+				numbers = append(numbers, "#"+strconv.Itoa(it.Number))
+			}
+			fmt.Printf("  %s\n", strings.Join(numbers, ", "))
+		}
+	}
+
+	stringValue := gen.Scan("Izaberite broj klijenta, prazno za izlaz: ")
+	if stringValue == "" {
+		return nil
+	}
+	key := "#" + stringValue
+	fmt.Println("[1] Izmijeni")
+	fmt.Println("[2] Obriši")
+	fmt.Println("[3] Spoji sa drugim klijentom")
+	switch gen.Scan("Izaberite općiju: ") {
+	case "1":
+		i, err := findClientIndex(key)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Unesite nove podatke, prazno zadržava postojeće")
+		changes := map[string]string{}
+		for _, field := range clientFields {
+			if value := gen.Scan(fmt.Sprintf("%s [%s]: ", field.Label, *field.Value(&(*Clients)[i]))); value != "" {
+				changes[field.Flag] = value
+			}
+		}
+		if _, err := editClient(key, changes); err != nil {
+			return err
+		}
+	case "2":
+		if _, err := deleteClient(key); err != nil {
+			return err
+		}
+	case "3":
+		into := gen.Scan("Broj klijenta koji ostaje: ")
+		if _, err := mergeClients(key, "#"+into); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+	fmt.Println("Detalji su uspešno sačuvani")
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+func clientsListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return listClients("")
+}
+
+func clientsSearchCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return listClients(args[0])
+}
+
+func clientsDuplicatesCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return clientDuplicates()
+}
+
+func clientEditCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("client edit")
+	for _, field := range clientFields {
+		fs.String(field.Flag, "", "")
+	}
+	if err := fs.Parse(args); err != nil || fs.NFlag() == 0 || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	changes := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		changes[f.Name] = f.Value.String()
+	})
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return editClient(fs.Arg(0), changes)
+}
+
+func clientDeleteCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return deleteClient(args[0])
+}
+
+func clientMergeCommand(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return mergeClients(args[0], args[1])
+}
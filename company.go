@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/noshto/gen"
+	"github.com/noshto/sep"
+)
+
+// companyHistoryFileName keeps company details as they were before each
+// change, so archived invoices are printed with the details valid when they
+// were issued
+const companyHistoryFileName = "company_history.json"
+
+// CompanyVersion is company details as they were until ValidTo
+type CompanyVersion struct {
+	ValidTo time.Time   `json:"valid_to"`
+	Config  *sep.Config `json:"config"`
+}
+
+// companyField is a company detail that can be edited
+type companyField struct {
+	Flag  string
+	Label string
+	Value func(cfg *sep.Config) *string
+	Check func(value string) error
+}
+
+var companyFields = []companyField{
+	{"name", "Naziv", func(cfg *sep.Config) *string { return &cfg.Name }, checkRequired("naziv")},
+	{"tin", "Identifikacioni broj (PIB)", func(cfg *sep.Config) *string { return &cfg.TIN }, checkTIN},
+	{"vat", "PDV broj (PDV)", func(cfg *sep.Config) *string { return &cfg.VAT }, checkVAT},
+	{"address", "Adresa", func(cfg *sep.Config) *string { return &cfg.Address }, nil},
+	{"town", "Grad", func(cfg *sep.Config) *string { return &cfg.Town }, nil},
+	{"country", "Država", func(cfg *sep.Config) *string { return &cfg.Country }, checkCountry},
+	{"phone", "Tel", func(cfg *sep.Config) *string { return &cfg.Phone }, nil},
+	{"fax", "Fax", func(cfg *sep.Config) *string { return &cfg.Fax }, nil},
+	{"bank-account", "Z.R.", func(cfg *sep.Config) *string { return &cfg.BankAccount }, checkBankAccount},
+	{"operator-code", "Kod operatera", func(cfg *sep.Config) *string { return &cfg.OperatorCode }, nil},
+}
+
+var (
+	tinPattern         = regexp.MustCompile(`^(\d{8}|\d{13})$`)
+	vatPattern         = regexp.MustCompile(`^\d{2}/\d{2}-\d{5}-\d$`)
+	countryPattern     = regexp.MustCompile(`^[A-Z]{3}$`)
+	ibanPattern        = regexp.MustCompile(`^[A-Z]{2}\d{2}[A-Z0-9]{11,30}$`)
+	bankAccountPattern = regexp.MustCompile(`^(\d{3})-(\d{1,13})-(\d{2})$`)
+)
+
+func checkRequired(label string) func(string) error {
+	return func(value string) error {
+		if value == "" {
+			return fmt.Errorf("%s je obavezan", label)
+		}
+		return nil
+	}
+}
+
+// checkTIN accepts a PIB of a company or the JMBG of an entrepreneur
+func checkTIN(value string) error {
+	if !tinPattern.MatchString(value) {
+		return fmt.Errorf("PIB mora imati 8 cifara, ili 13 cifara JMBG")
+	}
+	return nil
+}
+
+// checkVAT accepts an empty VAT number for companies outside the VAT system
+func checkVAT(value string) error {
+	if value != "" && !vatPattern.MatchString(value) {
+		return fmt.Errorf("PDV broj mora biti u formatu 12/34-56789-0")
+	}
+	return nil
+}
+
+func checkCountry(value string) error {
+	if !countryPattern.MatchString(value) {
+		return fmt.Errorf("država mora biti troslovni kôd, npr. MNE")
+	}
+	return nil
+}
+
+// checkBankAccount accepts an IBAN or a domestic account such as
+// 510-1234567890123-45; both end with ISO 7064 MOD 97-10 check digits
+func checkBankAccount(value string) error {
+	if value == "" {
+		return nil
+	}
+	compact := strings.ToUpper(strings.Replace(value, " ", "", -1))
+	if ibanPattern.MatchString(compact) {
+		if (strings.HasPrefix(compact, "ME") && len(compact) != 22) || mod97(compact[4:]+compact[:4]) != 1 {
+			return fmt.Errorf("IBAN %s nije ispravan", value)
+		}
+		return nil
+	}
+	parts := bankAccountPattern.FindStringSubmatch(compact)
+	if parts == nil {
+		return fmt.Errorf("žiro račun mora biti IBAN ili u formatu 510-1234567890123-45")
+	}
+	account := parts[1] + strings.Repeat("0", 13-len(parts[2])) + parts[2] + parts[3]
+	if mod97(account) != 1 {
+		return fmt.Errorf("žiro račun %s nije ispravan, kontrolni broj se ne slaže", value)
+	}
+	return nil
+}
+
+// mod97 returns the remainder of the number written with digits and letters,
+// A being 10, divided by 97
+func mod97(value string) int {
+	rest := 0
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			rest = (rest*10 + int(r-'0')) % 97
+		case r >= 'A' && r <= 'Z':
+			rest = (rest*100 + int(r-'A') + 10) % 97
+		}
+	}
+	return rest
+}
+
+func loadCompanyHistory() ([]*CompanyVersion, error) {
+	history := []*CompanyVersion{}
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath(companyHistoryFileName))
+	if os.IsNotExist(err) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &history); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// saveCompanyHistory writes company_history.json and must be called under
+// the data lock
+func saveCompanyHistory(history []*CompanyVersion) error {
+	buf, err := json.MarshalIndent(history, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(currentWorkingDirectoryFilePath(companyHistoryFileName), buf, 0644)
+}
+
+// companyDetails copies the editable details of a company
+func companyDetails(cfg *sep.Config) *sep.Config {
+	it := &sep.Config{}
+	for _, field := range companyFields {
+		*field.Value(it) = *field.Value(cfg)
+	}
+	return it
+}
+
+// companyConfigAt returns SepConfig with the company details valid at the
+// given time; the TCR and environment are the current ones
+func companyConfigAt(at time.Time) (*sep.Config, error) {
+	history, err := loadCompanyHistory()
+	if err != nil {
+		return nil, err
+	}
+	cfg := *SepConfig
+	for _, it := range history {
+		if at.Before(it.ValidTo) {
+			for _, field := range companyFields {
+				*field.Value(&cfg) = *field.Value(it.Config)
+			}
+			break
+		}
+	}
+	return &cfg, nil
+}
+
+// updateCompany validates and saves changed company details, given by flag
+// name. The details being replaced are added to the history.
+func updateCompany(changes map[string]string) (*sep.Config, error) {
+	for _, field := range companyFields {
+		value, ok := changes[field.Flag]
+		if !ok || field.Check == nil {
+			continue
+		}
+		if err := field.Check(strings.TrimSpace(value)); err != nil {
+			return nil, err
+		}
+	}
+	err := withDataLock(func() error {
+		// another instance may have changed config in the meantime
+		if err := loadConfig(); err != nil {
+			return err
+		}
+		previous := companyDetails(SepConfig)
+		changed := false
+		for _, field := range companyFields {
+			value, ok := changes[field.Flag]
+			if ok && strings.TrimSpace(value) != *field.Value(SepConfig) {
+				*field.Value(SepConfig) = strings.TrimSpace(value)
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+		history, err := loadCompanyHistory()
+		if err != nil {
+			return err
+		}
+		history = append(history, &CompanyVersion{ValidTo: time.Now(), Config: previous})
+		if err := saveCompanyHistory(history); err != nil {
+			return err
+		}
+		return saveSepConfig()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return SepConfig, nil
+}
+
+// printCompany prints company details and how they changed
+func printCompany(history []*CompanyVersion) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, field := range companyFields {
+		fmt.Fprintf(w, "%s:\t%s\t\n", field.Label, *field.Value(SepConfig))
+	}
+	w.Flush()
+	if len(history) == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Println("Prethodni podaci:")
+	from := ""
+	for _, it := range history {
+		fmt.Printf("%s - %s: %s, PIB %s, %s, %s, Z.R. %s\n",
+			from,
+			it.ValidTo.Format("2006-01-02 15:04"),
+			it.Config.Name,
+			it.Config.TIN,
+			it.Config.Address,
+			it.Config.Town,
+			it.Config.BankAccount,
+		)
+		from = it.ValidTo.Format("2006-01-02 15:04")
+	}
+}
+
+func editCompany() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("PODACI FIRME")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	history, err := loadCompanyHistory()
+	if err != nil {
+		return err
+	}
+	printCompany(history)
+	fmt.Println()
+	fmt.Println("Unesite nove podatke, prazno zadržava postojeće")
+	changes := map[string]string{}
+	for _, field := range companyFields {
+		for {
+			value := gen.Scan(fmt.Sprintf("%s [%s]: ", field.Label, *field.Value(SepConfig)))
+			if value == "" {
+				break
+			}
+			if field.Check != nil {
+				if err := field.Check(value); err != nil {
+					fmt.Println(err)
+					continue
+				}
+			}
+			changes[field.Flag] = value
+			break
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	if _, err := updateCompany(changes); err != nil {
+		return err
+	}
+	fmt.Println("Detalji su uspešno sačuvani")
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+// CompanyOutput is the result of company show
+type CompanyOutput struct {
+	Config  *sep.Config       `json:"config"`
+	History []*CompanyVersion `json:"history"`
+}
+
+func companyShowCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	history, err := loadCompanyHistory()
+	if err != nil {
+		return nil, err
+	}
+	return &CompanyOutput{Config: SepConfig, History: history}, nil
+}
+
+func companySetCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("company set")
+	for _, field := range companyFields {
+		fs.String(field.Flag, "", "")
+	}
+	if err := fs.Parse(args); err != nil || fs.NFlag() == 0 || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	changes := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		changes[f.Name] = f.Value.String()
+	})
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return updateCompany(changes)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+)
+
+// depositFiles are the intermediate files of a cash deposit registration
+var depositFiles = Files{
+	Gen:    "deposit.xml",
+	Signed: "deposit.dsig.xml",
+	Reg:    "deposit.reg.xml",
+}
+
+// depositsDir is the folder of a records day holding cash deposits, kept
+// apart from invoices
+const depositsDir = "deposits"
+
+// newCashDepositPipeline creates a pipeline registering a cash deposit. The
+// generate stage is set by the caller.
+func newCashDepositPipeline() *Pipeline {
+	p := NewPipeline("deposit", depositFiles)
+	p.Stages[StageSign] = signStage
+	p.Stages[StageRegister] = registerCashDepositStage
+	p.Stages[StageArchive] = archiveCashDepositStage
+	p.Stages[StageCleanup] = cleanupStage
+	return withJournal(p)
+}
+
+// registerCashDepositStage registers the deposit and checks that a FCDC was
+// issued
+func registerCashDepositStage(tx *Transaction) error {
+	if err := registerStage(tx); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(tx.RegFile)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return &DeliveryError{Err: fmt.Errorf("invalid response, %v", err)}
+	}
+	fcdc := findDescendant(doc.Root(), "FCDC")
+	if fcdc == nil || strings.TrimSpace(fcdc.Text()) == "" {
+		return responseError(buf)
+	}
+	tx.FCDC = strings.TrimSpace(fcdc.Text())
+	return nil
+}
+
+// archiveCashDepositStage copies the request and response into
+// records/<DATE>/deposits
+func archiveCashDepositStage(tx *Transaction) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.SignedFile); err != nil {
+		return err
+	}
+	request := doc.FindElement("//RegisterCashDepositRequest")
+	deposit := findChild(request, "CashDeposit")
+	if deposit == nil {
+		return fmt.Errorf("invalid xml, no CashDeposit")
+	}
+	changeDateTime, err := time.Parse(time.RFC3339, deposit.SelectAttrValue("ChangeDateTime", ""))
+	if err != nil {
+		return err
+	}
+	tx.TCRCode = deposit.SelectAttrValue("TCRCode", "")
+
+	dir := currentWorkingDirectoryFilePath(filepath.Join("records", changeDateTime.Format("2006-01-02"), depositsDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	base := filepath.Join(dir, strings.Join([]string{
+		changeDateTime.Format("20060102150405"),
+		tx.TCRCode,
+		deposit.SelectAttrValue("Operation", ""),
+	}, "_"))
+
+	// like invoices, the signed request is kept as it is
+	reqDoc := etree.NewDocument()
+	reqDoc.SetRoot(request.Copy())
+	attachScope(reqDoc.Root(), request)
+	if err := reqDoc.WriteToFile(base + "_request.xml"); err != nil {
+		return err
+	}
+
+	doc = etree.NewDocument()
+	if err := doc.ReadFromFile(tx.RegFile); err != nil {
+		return err
+	}
+	response := doc.FindElement("//RegisterCashDepositResponse")
+	if response == nil {
+		return fmt.Errorf("invalid xml, no RegisterCashDepositResponse")
+	}
+	respDoc := etree.NewDocument()
+	respDoc.SetRoot(response.Copy())
+	respDoc.IndentTabs()
+	respDoc.Root().SetTail("")
+	if err := respDoc.WriteToFile(base + "_response.xml"); err != nil {
+		return err
+	}
+	tx.Folder = dir
+	return nil
+}
+
+// CashDeposit is an archived cash deposit
+type CashDeposit struct {
+	ChangeDateTime time.Time `json:"change_date_time"`
+	Operation      string    `json:"operation"`
+	CashAmt        float64   `json:"cash_amt"`
+	TCRCode        string    `json:"tcr_code"`
+	FCDC           string    `json:"fcdc"`
+	Request        string    `json:"request"`
+	Response       string    `json:"response"`
+}
+
+// readCashDeposit reads an archived deposit request and its response
+func readCashDeposit(requestFilePath string) (*CashDeposit, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(requestFilePath); err != nil {
+		return nil, err
+	}
+	deposit := findDescendant(doc.Root(), "CashDeposit")
+	if deposit == nil {
+		return nil, fmt.Errorf("invalid xml, no CashDeposit in %s", requestFilePath)
+	}
+	it := &CashDeposit{
+		Operation: deposit.SelectAttrValue("Operation", ""),
+		CashAmt:   parseAmount(deposit.SelectAttrValue("CashAmt", "")),
+		TCRCode:   deposit.SelectAttrValue("TCRCode", ""),
+		Request:   requestFilePath,
+		Response:  archiveBase(requestFilePath) + "_response.xml",
+	}
+	var err error
+	if it.ChangeDateTime, err = time.Parse(time.RFC3339, deposit.SelectAttrValue("ChangeDateTime", "")); err != nil {
+		return nil, err
+	}
+	doc = etree.NewDocument()
+	if err := doc.ReadFromFile(it.Response); err != nil {
+		return nil, err
+	}
+	if fcdc := findDescendant(doc.Root(), "FCDC"); fcdc != nil {
+		it.FCDC = strings.TrimSpace(fcdc.Text())
+	}
+	return it, nil
+}
+
+// listCashDeposits returns deposits archived on the given day, oldest first
+func listCashDeposits(day time.Time) ([]*CashDeposit, error) {
+	dir := currentWorkingDirectoryFilePath(filepath.Join("records", day.Format("2006-01-02"), depositsDir))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*CashDeposit{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deposits := []*CashDeposit{}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), "_request.xml") {
+			continue
+		}
+		it, err := readCashDeposit(filepath.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, it)
+	}
+	sort.SliceStable(deposits, func(i, j int) bool {
+		return deposits[i].ChangeDateTime.Before(deposits[j].ChangeDateTime)
+	})
+	return deposits, nil
+}
+
+// hasCashDeposit reports whether an initial deposit of the TCR was
+// registered on the given day
+func hasCashDeposit(day time.Time, tcrCode string) (bool, error) {
+	deposits, err := listCashDeposits(day)
+	if err != nil {
+		return false, err
+	}
+	for _, it := range deposits {
+		if it.Operation == depositInitial && it.TCRCode == tcrCode && it.FCDC != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cashDepositWarning explains why a cash invoice should not be issued yet,
+// empty if today's deposit is registered
+func cashDepositWarning() string {
+	if SepConfig.TCR == nil {
+		return ""
+	}
+	ok, err := hasCashDeposit(time.Now(), SepConfig.TCR.TCRCode)
+	if err != nil {
+		return fmt.Sprintf("UPOZORENJE: depozit nije provjeren: %v", err)
+	}
+	if !ok {
+		return fmt.Sprintf("UPOZORENJE: depozit za danas nije registrovan na ENU %s", SepConfig.TCR.TCRCode)
+	}
+	return ""
+}
+
+func registerCashDeposit() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("REGISTRACIJA DEPOZITA")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("[1] Početni depozit")
+	fmt.Println("[2] Podizanje gotovine")
+	in := &CashDepositInput{}
+	switch gen.Scan("Vrsta: ") {
+	case "1":
+		in.Operation = depositInitial
+	case "2":
+		in.Operation = depositWithdraw
+	default:
+		return fmt.Errorf("pogrešna vrsta depozita")
+	}
+	amount, err := strconv.ParseFloat(gen.Scan("Iznos: "), 64)
+	if err != nil {
+		return err
+	}
+	in.Amount = amount
+
+	fmt.Printf("Registrovati %s %.02f na ENU %s\n", in.Operation, in.Amount, SepConfig.TCR.TCRCode)
+	fmt.Println("[1] Da")
+	fmt.Println("[2] Ne")
+	if gen.Scan("Nastavite sa slanjem: ") != "1" {
+		return nil
+	}
+
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+	p := withProgress(newCashDepositPipeline())
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeCashDepositRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return err
+	}
+
+	fmt.Printf("Depozit je registrovan, JIKD: %s\n", tx.FCDC)
+	fmt.Printf("Rezultate sačuvani u %s\n", tx.Folder)
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+func depositRegisterCommand(args []string) (interface{}, error) {
+	in := &CashDepositInput{}
+	fs := newFlagSet("deposit register")
+	fs.StringVar(&in.Operation, "operation", "", "")
+	fs.Float64Var(&in.Amount, "amount", -1, "")
+	fs.StringVar(&in.ChangeDateTime, "change-date-time", "", "")
+	if err := fs.Parse(args); err != nil || in.Operation == "" || in.Amount < 0 || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+
+	p := newCashDepositPipeline()
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeCashDepositRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return newTransactionOutput(tx), err
+	}
+	return newTransactionOutput(tx), nil
+}
+
+func depositListCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("deposit list")
+	date := fs.String("date", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	day := time.Now()
+	if *date != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", *date); err != nil {
+			return nil, err
+		}
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return listCashDeposits(day)
+}
@@ -4,12 +4,16 @@ go 1.15
 
 require (
 	github.com/beevik/etree v1.1.0
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/noshto/dsig v0.0.12
 	github.com/noshto/gen v0.0.39
 	github.com/noshto/iic v0.0.16
 	github.com/noshto/pdf v0.0.15
 	github.com/noshto/reg v0.0.7
 	github.com/noshto/sep v0.0.22
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.11.0
+	software.sslmate.com/src/go-pkcs12 v0.4.0
 )
 
 // replace github.com/noshto/dsig => ../dsig
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/sep"
+	bolt "go.etcd.io/bbolt"
+)
+
+// indexFileName is the database of archived invoices
+const indexFileName = "index.db"
+
+// Index buckets; all but invoices map a key to IIC
+var (
+	invoicesBucket = []byte("invoices")
+	ficBucket      = []byte("fic")
+	invNumBucket   = []byte("inv_num")
+	clientBucket   = []byte("client")
+	dayBucket      = []byte("day")
+	indexBuckets   = [][]byte{invoicesBucket, ficBucket, invNumBucket, clientBucket, dayBucket}
+)
+
+// IndexEntry is an archived invoice with its key fields
+type IndexEntry struct {
+	IIC           string    `json:"iic"`
+	FIC           string    `json:"fic"`
+	InvNum        string    `json:"inv_num"`
+	InvOrdNum     string    `json:"inv_ord_num"`
+	InvType       string    `json:"inv_type"`
+	TypeOfInv     string    `json:"type_of_inv"`
+	Simplified    bool      `json:"simplified"`
+	IssueDateTime time.Time `json:"issue_date_time"`
+	TCRCode       string    `json:"tcr_code"`
+	SellerTIN     string    `json:"seller_tin"`
+	BuyerTIN      string    `json:"buyer_tin,omitempty"`
+	BuyerName     string    `json:"buyer_name,omitempty"`
+	PayMethods    []string  `json:"pay_methods"`
+	CorrectedIIC  string    `json:"corrected_iic,omitempty"`
+	TotPriceWoVAT float64   `json:"tot_price_wo_vat"`
+	TotVATAmt     float64   `json:"tot_vat_amt"`
+	TotPrice      float64   `json:"tot_price"`
+
+	// amounts of the period report, see computeSummary
+	PBWoR float64 `json:"price_before_rebate"`
+	R     float64 `json:"rebate"`
+	PBR   float64 `json:"price_after_rebate"`
+	VA    float64 `json:"vat"`
+
+	// Day is the records folder, files are relative to the data directory
+	Day      string `json:"day"`
+	Request  string `json:"request"`
+	Response string `json:"response"`
+	PDF      string `json:"pdf,omitempty"`
+
+	// Copies is the number of times the invoice was printed again
+	Copies int `json:"copies"`
+}
+
+// openIndex opens index.db, creating it if needed
+func openIndex() (*bolt.DB, error) {
+	db, err := bolt.Open(currentWorkingDirectoryFilePath(indexFileName), 0644, &bolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, name := range indexBuckets {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// withIndex runs fn with index.db open; the index is built from records the
+// first time it is used
+func withIndex(fn func(db *bolt.DB) error) error {
+	if _, err := os.Stat(currentWorkingDirectoryFilePath(indexFileName)); os.IsNotExist(err) {
+		if _, err := reindex(); err != nil {
+			return err
+		}
+	}
+	db, err := openIndex()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return fn(db)
+}
+
+// relativePath returns path relative to the data directory
+func relativePath(path string) string {
+	rel, err := filepath.Rel(WorkDir, path)
+	if err != nil {
+		return path
+	}
+	return filepath.ToSlash(rel)
+}
+
+// absolutePath resolves a path stored in the index
+func absolutePath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(WorkDir, filepath.FromSlash(path))
+}
+
+func parseAmount(s string) float64 {
+	f, _ := strconv.ParseFloat(s, 64)
+	return f
+}
+
+// readIndexEntry reads the key fields of an archived invoice
+func readIndexEntry(day, requestFilePath, responseFilePath, pdfFilePath string) (*IndexEntry, error) {
+	buf, err := ioutil.ReadFile(requestFilePath)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil, err
+	}
+	invoice := findDescendant(doc.Root(), "Invoice")
+	if invoice == nil {
+		return nil, fmt.Errorf("invalid xml, no Invoice in %s", requestFilePath)
+	}
+	issueDateTime, err := time.Parse(time.RFC3339, invoice.SelectAttrValue("IssueDateTime", ""))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", requestFilePath, err)
+	}
+
+	e := &IndexEntry{
+		IIC:           invoice.SelectAttrValue("IIC", ""),
+		InvNum:        invoice.SelectAttrValue("InvNum", ""),
+		InvOrdNum:     invoice.SelectAttrValue("InvOrdNum", ""),
+		InvType:       invoice.SelectAttrValue("InvType", "INVOICE"),
+		TypeOfInv:     invoice.SelectAttrValue("TypeOfInv", ""),
+		Simplified:    invoice.SelectAttrValue("IsSimplifiedInv", "") == "true",
+		IssueDateTime: issueDateTime,
+		TCRCode:       invoice.SelectAttrValue("TCRCode", ""),
+		PayMethods:    []string{},
+		TotPriceWoVAT: parseAmount(invoice.SelectAttrValue("TotPriceWoVAT", "")),
+		TotVATAmt:     parseAmount(invoice.SelectAttrValue("TotVATAmt", "")),
+		TotPrice:      parseAmount(invoice.SelectAttrValue("TotPrice", "")),
+		Day:           day,
+		Request:       relativePath(requestFilePath),
+		Response:      relativePath(responseFilePath),
+	}
+	if e.IIC == "" {
+		return nil, fmt.Errorf("invalid xml, no IIC in %s", requestFilePath)
+	}
+	if it := findChild(invoice, "Seller"); it != nil {
+		e.SellerTIN = it.SelectAttrValue("IDNum", "")
+	}
+	if it := findChild(invoice, "Buyer"); it != nil {
+		e.BuyerTIN = it.SelectAttrValue("IDNum", "")
+		e.BuyerName = it.SelectAttrValue("Name", "")
+	}
+	if it := findChild(invoice, "CorrectiveInv"); it != nil {
+		e.CorrectedIIC = it.SelectAttrValue("IICRef", "")
+		if e.InvType == "INVOICE" {
+			e.InvType = "CORRECTIVE"
+		}
+	}
+	if it := findChild(invoice, "PayMethods"); it != nil {
+		for _, method := range it.ChildElements() {
+			e.PayMethods = append(e.PayMethods, method.SelectAttrValue("Type", ""))
+		}
+	}
+	if pdfFilePath != "" {
+		if _, err := os.Stat(pdfFilePath); err == nil {
+			e.PDF = relativePath(pdfFilePath)
+		}
+	}
+
+	meta, err := loadArchiveMeta(requestFilePath)
+	if err != nil {
+		return nil, err
+	}
+	e.Copies = meta.Copies
+
+	// report amounts are computed the way printSummary always did
+	request := sep.RegisterInvoiceRequest{}
+	if err := xml.Unmarshal(buf, &request); err != nil {
+		return nil, fmt.Errorf("%s: %v", requestFilePath, err)
+	}
+	if request.Invoice != nil && request.Invoice.Items != nil {
+		for _, i := range *request.Invoice.Items {
+			upbr := i.UPB - i.UPB*(i.R/100)
+			e.PBWoR += float64(i.UPB * i.Q)
+			e.PBR += float64(upbr * i.Q)
+			e.R += float64(i.UPB*i.Q - upbr*i.Q)
+			e.VA += float64(upbr * (i.VR / 100) * i.Q)
+		}
+	}
+
+	if responseFilePath != "" {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromFile(responseFilePath); err == nil {
+			if it := findDescendant(doc.Root(), "FIC"); it != nil {
+				e.FIC = strings.TrimSpace(it.Text())
+			}
+		}
+	}
+	return e, nil
+}
+
+func indexKey(parts ...string) []byte {
+	return []byte(strings.Join(parts, "|"))
+}
+
+// secondaryKeys returns keys of the entry in each lookup bucket
+func (e *IndexEntry) secondaryKeys() map[string][]byte {
+	keys := map[string][]byte{
+		string(dayBucket): indexKey(e.Day, e.IssueDateTime.UTC().Format("20060102150405"), e.IIC),
+	}
+	if e.FIC != "" {
+		keys[string(ficBucket)] = []byte(e.FIC)
+	}
+	if e.InvNum != "" {
+		keys[string(invNumBucket)] = []byte(e.InvNum)
+	}
+	if e.BuyerTIN != "" {
+		keys[string(clientBucket)] = indexKey(e.BuyerTIN, e.IIC)
+	}
+	return keys
+}
+
+// putIndexEntry stores the entry, replacing an earlier version of it
+func putIndexEntry(tx *bolt.Tx, e *IndexEntry) error {
+	invoices := tx.Bucket(invoicesBucket)
+	if buf := invoices.Get([]byte(e.IIC)); buf != nil {
+		old := &IndexEntry{}
+		if err := json.Unmarshal(buf, old); err == nil {
+			for bucket, key := range old.secondaryKeys() {
+				if err := tx.Bucket([]byte(bucket)).Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := invoices.Put([]byte(e.IIC), buf); err != nil {
+		return err
+	}
+	for bucket, key := range e.secondaryKeys() {
+		if err := tx.Bucket([]byte(bucket)).Put(key, []byte(e.IIC)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// indexInvoice adds an archived invoice to the index
+func indexInvoice(day, requestFilePath, responseFilePath, pdfFilePath string) error {
+	e, err := readIndexEntry(day, requestFilePath, responseFilePath, pdfFilePath)
+	if err != nil {
+		return err
+	}
+	db, err := openIndex()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(func(tx *bolt.Tx) error {
+		return putIndexEntry(tx, e)
+	})
+}
+
+// reindex rebuilds index.db from the records folders
+func reindex() (int, error) {
+	db, err := openIndex()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	recordsDir := currentWorkingDirectoryFilePath("records")
+	days, err := ioutil.ReadDir(recordsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	count := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range indexBuckets {
+			if err := tx.DeleteBucket(name); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		for _, day := range days {
+			if !day.IsDir() {
+				continue
+			}
+			dayDir := filepath.Join(recordsDir, day.Name())
+			files, err := ioutil.ReadDir(dayDir)
+			if err != nil {
+				return err
+			}
+			for _, fi := range files {
+				if !strings.HasSuffix(fi.Name(), "_request.xml") {
+					continue
+				}
+				base := strings.TrimSuffix(fi.Name(), "_request.xml")
+				e, err := readIndexEntry(
+					day.Name(),
+					filepath.Join(dayDir, fi.Name()),
+					filepath.Join(dayDir, base+"_response.xml"),
+					filepath.Join(dayDir, base+"_request.pdf"),
+				)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					continue
+				}
+				if err := putIndexEntry(tx, e); err != nil {
+					return err
+				}
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// getIndexEntry returns the invoice with the given IIC
+func getIndexEntry(tx *bolt.Tx, IIC string) (*IndexEntry, error) {
+	buf := tx.Bucket(invoicesBucket).Get([]byte(IIC))
+	if buf == nil {
+		return nil, nil
+	}
+	e := &IndexEntry{}
+	if err := json.Unmarshal(buf, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// lookupInvoice finds an invoice by IIC, FIC or invoice number
+func lookupInvoice(key string) (*IndexEntry, error) {
+	var found *IndexEntry
+	err := withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			IIC := key
+			if it := tx.Bucket(ficBucket).Get([]byte(key)); it != nil {
+				IIC = string(it)
+			} else if it := tx.Bucket(invNumBucket).Get([]byte(key)); it != nil {
+				IIC = string(it)
+			}
+			var err error
+			found, err = getIndexEntry(tx, strings.ToUpper(IIC))
+			if found == nil && err == nil {
+				found, err = getIndexEntry(tx, IIC)
+			}
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("račun %s nije pronađen", key)
+	}
+	return found, nil
+}
+
+// findInvoiceByInvNum returns the archived invoice with the number, nil if
+// there is none
+func findInvoiceByInvNum(invNum string) (*IndexEntry, error) {
+	var found *IndexEntry
+	err := withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			IIC := tx.Bucket(invNumBucket).Get([]byte(invNum))
+			if IIC == nil {
+				return nil
+			}
+			var err error
+			found, err = getIndexEntry(tx, string(IIC))
+			return err
+		})
+	})
+	return found, err
+}
+
+// indexEntriesByDay returns invoices archived from startDate to endDate, in
+// order of archiving
+func indexEntriesByDay(startDate, endDate time.Time) ([]*IndexEntry, error) {
+	entries := []*IndexEntry{}
+	err := withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			from := []byte(startDate.Format("2006-01-02"))
+			to := endDate.Format("2006-01-02")
+			c := tx.Bucket(dayBucket).Cursor()
+			for k, v := c.Seek(from); k != nil && strings.SplitN(string(k), "|", 2)[0] <= to; k, v = c.Next() {
+				e, err := getIndexEntry(tx, string(v))
+				if err != nil {
+					return err
+				}
+				if e != nil {
+					entries = append(entries, e)
+				}
+			}
+			return nil
+		})
+	})
+	return entries, err
+}
+
+func invoicesReindexCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	count, err := reindex()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]int{"indexed": count}, nil
+}
+
+func invoicesShowCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	e, err := lookupInvoice(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return e.withAbsolutePaths(), nil
+}
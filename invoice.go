@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+)
+
+// InvoiceKind identifies a type of invoice handled by the pipeline
+type InvoiceKind int
+
+// Invoice kinds
+const (
+	RegularInvoice InvoiceKind = iota
+	CorrectiveInvoice
+	SummaryInvoice
+)
+
+// invoiceFiles are the intermediate files of an invoice transaction
+var invoiceFiles = Files{
+	Gen:    "gen.xml",
+	IIC:    "iic.xml",
+	Signed: "dsig.xml",
+	Reg:    "reg.xml",
+	PDF:    "inv.pdf",
+}
+
+// newInvoicePipeline creates a pipeline fiscalizing invoices of the given kind
+func newInvoicePipeline(kind InvoiceKind) *Pipeline {
+	p := NewPipeline("invoice", invoiceFiles)
+	p.Stages[StageGenerate] = generateInvoiceStage(kind)
+	p.Stages[StageIIC] = writeIICStage
+	p.Stages[StageSign] = signStage
+	p.Stages[StageRegister] = registerInvoiceStage
+	p.Stages[StageRender] = renderInvoiceStage
+	p.Stages[StageArchive] = archiveInvoiceStage
+	p.Stages[StageCleanup] = cleanupStage
+	return withJournal(withOutbox(p))
+}
+
+// generateInvoiceStage asks the user for invoice details and writes the request
+func generateInvoiceStage(kind InvoiceKind) StageFunc {
+	return func(tx *Transaction) (err error) {
+		if SepConfig.TCR != nil {
+			if err := checkTCR(SepConfig.TCR, time.Now()); err != nil {
+				return err
+			}
+		}
+		params := &gen.Params{
+			SepConfig:  SepConfig,
+			Clients:    Clients,
+			OutFile:    tx.GenFile,
+			Simplified: tx.Simplified,
+		}
+		switch kind {
+		case RegularInvoice:
+			tx.PDF.InternalInvNum, err = gen.GenerateRegisterInvoiceRequest(params)
+		case CorrectiveInvoice:
+			tx.PDF.InternalInvNum, err = gen.GenerateCorrectiveRegisterInvoiceRequest(params)
+		case SummaryInvoice:
+			tx.PDF.InternalInvNum, err = gen.GenerateSummaryRegisterInvoiceRequest(params)
+		default:
+			err = fmt.Errorf("unknown invoice kind %d", kind)
+		}
+		return err
+	}
+}
+
+// confirmInvoice shows generated invoice and asks the user to proceed
+func confirmInvoice(tx *Transaction, res *StageResult) error {
+	if res.Err != nil {
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("Molim provjerite svi podatke prije slanja u poresku!")
+	fmt.Println()
+	gen.PrintInvoiceDetails(tx.GenFile, SepConfig, Clients, tx.PDF.InternalInvNum)
+
+	// cash invoices are issued only after the day's deposit
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.GenFile); err == nil {
+		if invoice := findDescendant(doc.Root(), "Invoice"); invoice != nil && invoice.SelectAttrValue("TypeOfInv", "") == "CASH" {
+			if warning := cashDepositWarning(); warning != "" {
+				fmt.Println(warning)
+				fmt.Println()
+			}
+		}
+	}
+
+	fmt.Println("Nastavite sa slanjem")
+	fmt.Println("[1] Da")
+	fmt.Println("[2] Ne")
+	stringValue := gen.Scan("Nastavite sa slanjem: ")
+	uintValue, err := strconv.ParseUint(stringValue, 10, 64)
+	if err != nil {
+		return err
+	}
+	if uintValue != 1 {
+		return fmt.Errorf("slanje otkazano")
+	}
+	fmt.Println("Nastavi sa slanjem")
+	return nil
+}
+
+func registerInvoice(kind InvoiceKind, simplified bool) error {
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+
+	p := withProgress(newInvoicePipeline(kind)).After(StageGenerate, confirmInvoice)
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return err
+	}
+	tx.Simplified = simplified
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return err
+	}
+
+	if tx.Queued {
+		fmt.Println(tx.DeliveryErr)
+		fmt.Println("Račun je potpisan sa IKOF i biće naknadno dostavljen")
+		fmt.Printf("Račun sačuvan u %s\n", tx.Folder)
+		fmt.Printf("PDF fajl sačuvan u %s\n", tx.PDFFilePath)
+		return nil
+	}
+
+	fmt.Printf("Rezultate sačuvani u %s\n", tx.Folder)
+	fmt.Printf("PDF fajl sačuvan u %s\n", tx.PDFFilePath)
+	return nil
+}
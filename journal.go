@@ -0,0 +1,567 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// journalOrphanedAfter is how long a transaction of another host may make no
+// progress before this host recovers it
+const journalOrphanedAfter = 24 * time.Hour
+
+// Journal stage statuses
+const (
+	journalStarted = "started"
+	journalDone    = "done"
+	journalFailed  = "failed"
+)
+
+// JournalStage records progress of a single stage
+type JournalStage struct {
+	Stage  Stage     `json:"stage"`
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// JournalEntry records a transaction stage by stage, so that it can be
+// finished after a crash
+type JournalEntry struct {
+	ID             string          `json:"id"`
+	Pipeline       string          `json:"pipeline"`
+	StartedAt      time.Time       `json:"started_at"`
+	Host           string          `json:"host"`
+	PID            int             `json:"pid"`
+	Dir            string          `json:"dir"`
+	Simplified     bool            `json:"simplified,omitempty"`
+	GenFile        string          `json:"gen_file,omitempty"`
+	IICFile        string          `json:"iic_file,omitempty"`
+	SignedFile     string          `json:"signed_file,omitempty"`
+	RegFile        string          `json:"reg_file,omitempty"`
+	PDFFile        string          `json:"pdf_file,omitempty"`
+	IIC            string          `json:"iic,omitempty"`
+	FIC            string          `json:"fic,omitempty"`
+	FCDC           string          `json:"fcdc,omitempty"`
+	WTNIC          string          `json:"wtnic,omitempty"`
+	FWTNIC         string          `json:"fwtnic,omitempty"`
+	TCRCode        string          `json:"tcr_code,omitempty"`
+	Queued         bool            `json:"queued,omitempty"`
+	InternalInvNum json.RawMessage `json:"internal_inv_num,omitempty"`
+	Stages         []JournalStage  `json:"stages"`
+}
+
+func journalDir() string {
+	return currentWorkingDirectoryFilePath("journal")
+}
+
+func (e *JournalEntry) filePath() string {
+	return filepath.Join(journalDir(), strings.Join([]string{e.ID, "json"}, "."))
+}
+
+// status returns the last recorded status of the stage
+func (e *JournalEntry) status(stage Stage) string {
+	status := ""
+	for _, it := range e.Stages {
+		if it.Stage == stage {
+			status = it.Status
+		}
+	}
+	return status
+}
+
+// lastDone returns the last stage completed successfully
+func (e *JournalEntry) lastDone() Stage {
+	last := Stage("")
+	for _, it := range e.Stages {
+		if it.Status == journalDone {
+			last = it.Stage
+		}
+	}
+	return last
+}
+
+// updatedAt returns when the transaction last made progress
+func (e *JournalEntry) updatedAt() time.Time {
+	if len(e.Stages) == 0 {
+		return e.StartedAt
+	}
+	return e.Stages[len(e.Stages)-1].At
+}
+
+// abandoned reports whether the process running the transaction is gone, so
+// the entry can be recovered. Transactions of other hosts are left to them
+// unless they made no progress for journalOrphanedAfter.
+func (e *JournalEntry) abandoned() bool {
+	if !ownerRunning(e.Host, e.PID) {
+		return true
+	}
+	host, _ := os.Hostname()
+	return e.Host != host && time.Since(e.updatedAt()) > journalOrphanedAfter
+}
+
+// record updates the entry from the transaction and appends a stage status
+func (e *JournalEntry) record(tx *Transaction, stage Stage, status string, err error) error {
+	e.IIC = tx.IIC
+	e.FIC = tx.FIC
+	e.FCDC = tx.FCDC
+	e.WTNIC = tx.WTNIC
+	e.FWTNIC = tx.FWTNIC
+	e.TCRCode = tx.TCRCode
+	e.Queued = tx.Queued
+	buf, jsonErr := json.Marshal(tx.PDF.InternalInvNum)
+	if jsonErr != nil {
+		return jsonErr
+	}
+	e.InternalInvNum = buf
+
+	it := JournalStage{Stage: stage, Status: status, At: time.Now()}
+	if err != nil {
+		it.Error = err.Error()
+	}
+	e.Stages = append(e.Stages, it)
+	return e.save()
+}
+
+// save writes the entry durably, so a crash never leaves a partial file
+func (e *JournalEntry) save() error {
+	if err := os.MkdirAll(journalDir(), 0755); err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(e, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmpFilePath := strings.Join([]string{e.filePath(), "tmp"}, ".")
+	f, err := os.Create(tmpFilePath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilePath, e.filePath())
+}
+
+func (e *JournalEntry) remove() error {
+	if err := os.Remove(e.filePath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// transaction restores the transaction the entry was recorded for
+func (e *JournalEntry) transaction() (*Transaction, error) {
+	tx := &Transaction{
+		Dir:        e.Dir,
+		Simplified: e.Simplified,
+		GenFile:    e.GenFile,
+		IICFile:    e.IICFile,
+		SignedFile: e.SignedFile,
+		RegFile:    e.RegFile,
+		PDFFile:    e.PDFFile,
+		IIC:        e.IIC,
+		FIC:        e.FIC,
+		FCDC:       e.FCDC,
+		WTNIC:      e.WTNIC,
+		FWTNIC:     e.FWTNIC,
+		TCRCode:    e.TCRCode,
+		Queued:     e.Queued,
+		Journal:    e,
+	}
+	if len(e.InternalInvNum) > 0 {
+		if err := json.Unmarshal(e.InternalInvNum, &tx.PDF.InternalInvNum); err != nil {
+			return nil, err
+		}
+	}
+	return tx, nil
+}
+
+// loadJournal returns all unfinished journal entries, oldest first
+func loadJournal() ([]*JournalEntry, error) {
+	files, err := ioutil.ReadDir(journalDir())
+	if os.IsNotExist(err) {
+		return []*JournalEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*JournalEntry{}
+	for _, fi := range files {
+		if filepath.Ext(fi.Name()) != ".json" {
+			continue
+		}
+		entry, err := readJournalEntry(filepath.Join(journalDir(), fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].StartedAt.Before(entries[j].StartedAt)
+	})
+	return entries, nil
+}
+
+func readJournalEntry(filePath string) (*JournalEntry, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	entry := &JournalEntry{}
+	if err := json.Unmarshal(buf, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// withJournal records every stage of the pipeline in the journal. The entry
+// is removed once the transaction is finished, or when it failed before the
+// document reached the tax service.
+func withJournal(p *Pipeline) *Pipeline {
+	for _, stage := range Stages {
+		p.Before(stage, func(tx *Transaction, res *StageResult) error {
+			if tx.Journal == nil {
+				entry, err := newJournalEntry(p.Name, tx)
+				if err != nil {
+					return err
+				}
+				tx.Journal = entry
+			}
+			return tx.Journal.record(tx, res.Stage, journalStarted, nil)
+		})
+		p.After(stage, func(tx *Transaction, res *StageResult) error {
+			if res.Err != nil {
+				if err := tx.Journal.record(tx, res.Stage, journalFailed, res.Err); err != nil {
+					return err
+				}
+				if res.Stage == StageCleanup || tx.Journal.status(StageRegister) != journalDone {
+					return tx.Journal.remove()
+				}
+				return nil
+			}
+			if err := tx.Journal.record(tx, res.Stage, journalDone, nil); err != nil {
+				return err
+			}
+			if res.Stage == StageCleanup {
+				return tx.Journal.remove()
+			}
+			return nil
+		})
+	}
+	return p
+}
+
+// newJournalEntry starts a journal entry. Transactions sharing files with an
+// unfinished one are refused, since they would overwrite its files.
+func newJournalEntry(pipeline string, tx *Transaction) (*JournalEntry, error) {
+	entries, err := loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range entries {
+		if it.Dir != tx.Dir {
+			continue
+		}
+		// nothing was sent, e.g. the user cancelled after generation
+		if it.status(StageRegister) == "" {
+			if err := it.remove(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return nil, fmt.Errorf("nedovršena transakcija %s, pokrenite oporavak", it.ID)
+	}
+	host, _ := os.Hostname()
+	return &JournalEntry{
+		ID:         strings.Join([]string{time.Now().Format("20060102150405"), newUUID()}, "_"),
+		Pipeline:   pipeline,
+		StartedAt:  time.Now(),
+		Host:       host,
+		PID:        os.Getpid(),
+		Dir:        tx.Dir,
+		Simplified: tx.Simplified,
+		GenFile:    tx.GenFile,
+		IICFile:    tx.IICFile,
+		SignedFile: tx.SignedFile,
+		RegFile:    tx.RegFile,
+		PDFFile:    tx.PDFFile,
+	}, nil
+}
+
+// RecoveryResult is the outcome of finishing an interrupted transaction
+type RecoveryResult struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	IIC    string `json:"iic,omitempty"`
+	FIC    string `json:"fic,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Recovery actions
+const (
+	recoveryDiscarded = "discarded"
+	recoveryArchived  = "archived"
+	recoveryQueued    = "queued"
+	recoveryResent    = "resent"
+	recoveryManual    = "manual"
+)
+
+// recoverJournal finishes transactions interrupted by a crash:
+// - not yet sent documents are discarded,
+// - invoices whose delivery outcome is unknown are queued for resubmission,
+// - other documents whose delivery outcome is unknown are left to the user,
+// - registered documents are rendered and archived.
+// Transactions still run by other instances are left alone.
+func recoverJournal() ([]*RecoveryResult, error) {
+	entries, err := loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	results := []*RecoveryResult{}
+	for _, entry := range entries {
+		claimed, err := claimJournalEntry(entry)
+		if err != nil {
+			return results, err
+		}
+		if !claimed {
+			continue
+		}
+		res := &RecoveryResult{ID: entry.ID}
+		results = append(results, res)
+		if err := recoverEntry(entry, res); err != nil {
+			res.Error = err.Error()
+		}
+		res.IIC = entry.IIC
+		res.FIC = entry.FIC
+	}
+	return results, nil
+}
+
+// claimJournalEntry makes this process the owner of an abandoned entry, so
+// no other instance recovers it at the same time
+func claimJournalEntry(entry *JournalEntry) (bool, error) {
+	claimed := false
+	err := withDataLock(func() error {
+		current, err := readJournalEntry(entry.filePath())
+		if os.IsNotExist(err) {
+			// recovered by another instance
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !current.abandoned() {
+			return nil
+		}
+		*entry = *current
+		entry.Host, _ = os.Hostname()
+		entry.PID = os.Getpid()
+		claimed = true
+		return entry.save()
+	})
+	return claimed, err
+}
+
+func recoverEntry(entry *JournalEntry, res *RecoveryResult) error {
+	newPipeline, ok := resumablePipelines[entry.Pipeline]
+	if !ok {
+		return fmt.Errorf("unknown pipeline %s", entry.Pipeline)
+	}
+	p := newPipeline()
+	tx, err := entry.transaction()
+	if err != nil {
+		return err
+	}
+
+	switch entry.status(StageRegister) {
+	case "", journalFailed:
+		// the tax service never accepted the document
+		res.Action = recoveryDiscarded
+		cleanupStage(tx)
+		return entry.remove()
+
+	case journalStarted:
+		// outcome unknown, invoices are resubmitted as subsequent delivery,
+		// which the tax service recognizes by IIC
+		if entry.IIC != "" {
+			res.Action = recoveryQueued
+			if err := enqueue(entry.Pipeline, tx); err != nil {
+				return err
+			}
+			cleanupStage(tx)
+			return entry.remove()
+		}
+		// other documents would be registered twice if the first request
+		// got through
+		res.Action = recoveryManual
+		return fmt.Errorf("ishod registracije nije poznat, provjerite ga kod poreske uprave pa pokrenite fisc journal resend %s ako nije registrovan, ili fisc journal discard %s ako jeste", entry.ID, entry.ID)
+	}
+
+	res.Action = recoveryArchived
+	from := StageRender
+	switch entry.lastDone() {
+	case StageRender:
+		from = StageArchive
+	case StageArchive:
+		from = StageCleanup
+	}
+	return p.RunFrom(tx, from)
+}
+
+// resolveEntry finishes an entry left for manual resolution, once the user
+// found out whether the tax service registered the document. A document that
+// was not registered is sent again, otherwise the entry is discarded.
+func resolveEntry(id string, resend bool) (*RecoveryResult, error) {
+	entries, err := loadJournal()
+	if err != nil {
+		return nil, err
+	}
+	var entry *JournalEntry
+	for _, it := range entries {
+		if it.ID == id {
+			entry = it
+		}
+	}
+	if entry == nil {
+		return nil, fmt.Errorf("transakcija %s ne postoji", id)
+	}
+	claimed, err := claimJournalEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, fmt.Errorf("transakciju %s izvršava %s (pid %d)", id, entry.Host, entry.PID)
+	}
+	tx, err := entry.transaction()
+	if err != nil {
+		return nil, err
+	}
+	res := &RecoveryResult{ID: entry.ID}
+	if !resend {
+		res.Action = recoveryDiscarded
+		cleanupStage(tx)
+		return res, entry.remove()
+	}
+	newPipeline, ok := resumablePipelines[entry.Pipeline]
+	if !ok {
+		return nil, fmt.Errorf("unknown pipeline %s", entry.Pipeline)
+	}
+	res.Action = recoveryResent
+	err = newPipeline().RunFrom(tx, StageRegister)
+	res.IIC, res.FIC = entry.IIC, entry.FIC
+	return res, err
+}
+
+// resumablePipelines creates pipelines by name for recovery
+var resumablePipelines = map[string]func() *Pipeline{
+	"invoice": func() *Pipeline { return newInvoicePipeline(RegularInvoice) },
+	"tcr":     newTCRPipeline,
+	"deposit": newCashDepositPipeline,
+	"wtn":     newWTNPipeline,
+}
+
+// recoverOnStartup finishes interrupted transactions and reports to w
+func recoverOnStartup(w io.Writer) {
+	entries, err := loadJournal()
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return
+	}
+	abandoned := 0
+	for _, it := range entries {
+		if it.abandoned() {
+			abandoned++
+		}
+	}
+	if abandoned == 0 {
+		return
+	}
+	fmt.Fprintf(w, "Oporavak %d nedovršenih transakcija\n", abandoned)
+	if err := loadSigner(); err != nil {
+		fmt.Fprintln(w, err)
+	}
+	results, err := recoverJournal()
+	printRecoveryResults(w, results)
+	if err != nil {
+		fmt.Fprintln(w, err)
+	}
+}
+
+func printRecoveryResults(w io.Writer, results []*RecoveryResult) {
+	for _, it := range results {
+		if it.Error != "" {
+			fmt.Fprintf(w, "Transakcija %s: NIJE USPEŠNO, %s\n", it.ID, it.Error)
+			continue
+		}
+		fmt.Fprintf(w, "Transakcija %s: %s", it.ID, it.Action)
+		if it.IIC != "" {
+			fmt.Fprintf(w, ", IKOF %s", it.IIC)
+		}
+		if it.FIC != "" {
+			fmt.Fprintf(w, ", JIKR %s", it.FIC)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+func journalListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	return loadJournal()
+}
+
+func journalRecoverCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	_ = loadSigner()
+	results, err := recoverJournal()
+	if err != nil {
+		return results, err
+	}
+	for _, it := range results {
+		if it.Error != "" {
+			return results, fmt.Errorf("nisu sve transakcije oporavljene")
+		}
+	}
+	return results, nil
+}
+
+func journalResendCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	return resolveEntry(args[0], true)
+}
+
+func journalDiscardCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	return resolveEntry(args[0], false)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// ledgerFileName is the hash chain over archived invoices, one JSON entry per
+// line
+const ledgerFileName = "ledger.jsonl"
+
+// genesisHash is the previous hash of the first entry
+var genesisHash = strings.Repeat("0", 64)
+
+// LedgerEntry seals an archived invoice. Hash is SHA-256 of the JSON encoding
+// of the entry with empty Hash, so it covers the files and the previous
+// entry.
+type LedgerEntry struct {
+	Seq          int       `json:"seq"`
+	At           time.Time `json:"at"`
+	IIC          string    `json:"iic"`
+	Request      string    `json:"request"`
+	RequestHash  string    `json:"request_hash"`
+	Response     string    `json:"response"`
+	ResponseHash string    `json:"response_hash"`
+	PDF          string    `json:"pdf,omitempty"`
+	PDFHash      string    `json:"pdf_hash,omitempty"`
+	Prev         string    `json:"prev"`
+	Hash         string    `json:"hash"`
+}
+
+func (e *LedgerEntry) computeHash() (string, error) {
+	it := *e
+	it.Hash = ""
+	buf, err := json.Marshal(&it)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func hashFile(filePath string) (string, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// loadLedger reads all entries; a line that can't be parsed ends the ledger
+// and is returned as an error together with the entries before it
+func loadLedger() ([]*LedgerEntry, error) {
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath(ledgerFileName))
+	if os.IsNotExist(err) {
+		return []*LedgerEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := []*LedgerEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := &LedgerEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			return entries, fmt.Errorf("%s, line %d: %v", ledgerFileName, line, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// newLedgerEntry hashes the files of an archived invoice
+func newLedgerEntry(requestFilePath, responseFilePath, pdfFilePath string) (*LedgerEntry, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(requestFilePath); err != nil {
+		return nil, err
+	}
+	invoice := findDescendant(doc.Root(), "Invoice")
+	if invoice == nil {
+		return nil, fmt.Errorf("invalid xml, no Invoice in %s", requestFilePath)
+	}
+	e := &LedgerEntry{
+		IIC:      invoice.SelectAttrValue("IIC", ""),
+		Request:  relativePath(requestFilePath),
+		Response: relativePath(responseFilePath),
+	}
+	var err error
+	if e.RequestHash, err = hashFile(requestFilePath); err != nil {
+		return nil, err
+	}
+	if e.ResponseHash, err = hashFile(responseFilePath); err != nil {
+		return nil, err
+	}
+	if pdfFilePath != "" {
+		e.PDF = relativePath(pdfFilePath)
+		if e.PDFHash, err = hashFile(pdfFilePath); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// appendLedger seals an archived invoice and must be called under the data
+// lock, as the archive stage is. An invoice already sealed with the same
+// files is not appended again, so archiving can be repeated after a crash.
+func appendLedger(requestFilePath, responseFilePath, pdfFilePath string) error {
+	e, err := newLedgerEntry(requestFilePath, responseFilePath, pdfFilePath)
+	if err != nil {
+		return err
+	}
+	entries, err := loadLedger()
+	if err != nil {
+		return err
+	}
+	e.Seq, e.Prev = 1, genesisHash
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		e.Seq, e.Prev = last.Seq+1, last.Hash
+	}
+	for _, it := range entries {
+		if it.IIC == e.IIC && it.RequestHash == e.RequestHash && it.ResponseHash == e.ResponseHash && it.PDFHash == e.PDFHash {
+			return nil
+		}
+	}
+	e.At = time.Now()
+	if e.Hash, err = e.computeHash(); err != nil {
+		return err
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(currentWorkingDirectoryFilePath(ledgerFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LedgerBreak is the first entry of the ledger that does not verify
+type LedgerBreak struct {
+	Seq    int    `json:"seq"`
+	IIC    string `json:"iic,omitempty"`
+	File   string `json:"file,omitempty"`
+	Reason string `json:"reason"`
+}
+
+// LedgerReport is the result of ledger verification
+type LedgerReport struct {
+	Entries int          `json:"entries"`
+	Head    string       `json:"head,omitempty"`
+	Valid   bool         `json:"valid"`
+	Broken  *LedgerBreak `json:"broken,omitempty"`
+	// Unsealed are archived requests that are not in the ledger
+	Unsealed []string `json:"unsealed"`
+}
+
+// verifyLedger walks the chain from the first entry and stops at the first
+// entry whose hash, link or files don't match
+func verifyLedger() (*LedgerReport, error) {
+	report := &LedgerReport{Unsealed: []string{}}
+	entries, loadErr := loadLedger()
+	if entries == nil {
+		return nil, loadErr
+	}
+	report.Entries = len(entries)
+
+	prev := genesisHash
+	sealed := map[string]bool{}
+	for i, e := range entries {
+		broken := func(file, format string, args ...interface{}) {
+			report.Broken = &LedgerBreak{Seq: e.Seq, IIC: e.IIC, File: file, Reason: fmt.Sprintf(format, args...)}
+		}
+		if e.Seq != i+1 {
+			broken("", "entry %d has sequence number %d", i+1, e.Seq)
+			break
+		}
+		if e.Prev != prev {
+			broken("", "previous hash does not match entry %d", e.Seq-1)
+			break
+		}
+		if hash, err := e.computeHash(); err != nil || hash != e.Hash {
+			broken("", "entry hash does not match its content")
+			break
+		}
+		files := [][2]string{{e.Request, e.RequestHash}, {e.Response, e.ResponseHash}}
+		if e.PDF != "" {
+			files = append(files, [2]string{e.PDF, e.PDFHash})
+		}
+		for _, it := range files {
+			hash, err := hashFile(absolutePath(it[0]))
+			if os.IsNotExist(err) {
+				broken(it[0], "file is missing")
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if hash != it[1] {
+				broken(it[0], "file was changed")
+				break
+			}
+		}
+		if report.Broken != nil {
+			break
+		}
+		prev = e.Hash
+		sealed[e.Request] = true
+	}
+	if report.Broken == nil && loadErr != nil {
+		report.Broken = &LedgerBreak{Seq: len(entries) + 1, Reason: loadErr.Error()}
+	}
+	report.Valid = report.Broken == nil
+	if len(entries) > 0 {
+		report.Head = entries[len(entries)-1].Hash
+	}
+
+	// archived invoices the ledger doesn't cover, e.g. a deleted tail
+	if report.Valid {
+		requests, err := archivedRequests()
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range requests {
+			if !sealed[relativePath(it)] {
+				report.Unsealed = append(report.Unsealed, relativePath(it))
+			}
+		}
+	}
+	return report, nil
+}
+
+// archivedRequests returns paths of all archived requests, oldest first
+func archivedRequests() ([]string, error) {
+	recordsDir := currentWorkingDirectoryFilePath("records")
+	days, err := ioutil.ReadDir(recordsDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	requests := []string{}
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(recordsDir, day.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if strings.HasSuffix(fi.Name(), "_request.xml") {
+				requests = append(requests, filepath.Join(recordsDir, day.Name(), fi.Name()))
+			}
+		}
+	}
+	sort.Strings(requests)
+	return requests, nil
+}
+
+// sealArchive appends archived invoices missing from the ledger, such as
+// invoices archived before the ledger existed
+func sealArchive() (*LedgerReport, error) {
+	report, err := verifyLedger()
+	if err != nil {
+		return nil, err
+	}
+	if !report.Valid {
+		return report, fmt.Errorf("lanac je prekinut kod unosa %d: %s", report.Broken.Seq, report.Broken.Reason)
+	}
+	err = withDataLock(func() error {
+		for _, it := range report.Unsealed {
+			base := archiveBase(absolutePath(it))
+			pdfFilePath := base + "_request.pdf"
+			if _, err := os.Stat(pdfFilePath); os.IsNotExist(err) {
+				pdfFilePath = ""
+			}
+			if err := appendLedger(absolutePath(it), base+"_response.xml", pdfFilePath); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return verifyLedger()
+}
+
+func ledgerVerifyCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	report, err := verifyLedger()
+	if err != nil {
+		return nil, err
+	}
+	if !report.Valid {
+		return report, fmt.Errorf("lanac je prekinut kod unosa %d: %s", report.Broken.Seq, report.Broken.Reason)
+	}
+	if len(report.Unsealed) > 0 {
+		return report, fmt.Errorf("računi van lanca: %d, pokrenite fisc ledger seal", len(report.Unsealed))
+	}
+	return report, nil
+}
+
+func ledgerSealCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	return sealArchive()
+}
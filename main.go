@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -13,12 +12,10 @@ import (
 	"time"
 
 	"github.com/beevik/etree"
-	"github.com/noshto/dsig"
 	"github.com/noshto/dsig/pkg/safenet"
 	"github.com/noshto/gen"
 	"github.com/noshto/iic"
 	"github.com/noshto/pdf"
-	"github.com/noshto/reg"
 	"github.com/noshto/sep"
 )
 
@@ -28,35 +25,44 @@ var (
 	SepConfig     = &sep.Config{}
 	SafenetConfig = &safenet.Config{}
 	WorkDir       = ""
+	InvocationDir = ""
 )
 
 func main() {
-	WorkDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+	var err error
+	InvocationDir, err = os.Getwd()
+	if err != nil {
+		showErrorAndExit(err)
+	}
+	BaseDir, err = filepath.Abs(filepath.Dir(os.Args[0]))
 	if err != nil {
 		showErrorAndExit(err)
 	}
-	os.Chdir(WorkDir)
 
-	// create config.json
-	if err := loadConfig(); err != nil {
-		registerCompany()
+	// global options such as --profile come before the command
+	args, err := parseGlobalOptions(os.Args[1:])
+	if err != nil {
+		printCommandsUsage()
+		os.Exit(exitUsage)
 	}
-	// if it fails - exit
-	if err := loadConfig(); err != nil {
+
+	// run a single command when arguments are given
+	if len(args) > 0 {
+		os.Exit(runCommand(args))
+	}
+	if err := useProfile(ProfileName); err != nil {
 		showErrorAndExit(err)
 	}
 
-	// make sure TCR registered, if not - register
-	if SepConfig.TCR == nil {
-		if err := registerTCR(); err != nil {
+	Interactive = true
+
+	// with several companies, the one to work for is chosen first
+	if ProfileName == "" {
+		if err := chooseProfile(false); err != nil {
 			showErrorAndExit(err)
 		}
 	}
-
-	// load clients list, if fails - init with empty list
-	if err := loadClients(); err != nil {
-		Clients = &[]sep.Client{}
-	}
+	startSession()
 
 	for {
 		printUsage()
@@ -71,19 +77,19 @@ func main() {
 		case 0:
 			os.Exit(0)
 		case 1:
-			if err := registerInvoice(false); err != nil {
+			if err := registerInvoice(RegularInvoice, false); err != nil {
 				showErrorAndExit(err)
 			}
 		case 2:
-			if err := registerInvoice(true); err != nil {
+			if err := registerInvoice(RegularInvoice, true); err != nil {
 				showErrorAndExit(err)
 			}
 		case 3:
-			if err := registerCorrectiveInvoice(false); err != nil {
+			if err := registerInvoice(CorrectiveInvoice, false); err != nil {
 				showErrorAndExit(err)
 			}
 		case 4:
-			if err := registerSummaryInvoice(false); err != nil {
+			if err := registerInvoice(SummaryInvoice, false); err != nil {
 				showErrorAndExit(err)
 			}
 		case 5:
@@ -116,11 +122,86 @@ func main() {
 			if err != nil {
 				showErrorAndExit(err)
 			}
-			printSummary(from, to)
+			stringValue = gen.Scan("ENU (kôd ili naziv), prazno za sve: ")
+			printSummary(from, to, tcrCode(stringValue))
+		case 10:
+			if err := registerBatch(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 11:
+			if err := manageOutbox(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 12:
+			if err := searchInvoicesMenu(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 13:
+			if err := registerCashDeposit(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 14:
+			if err := registerWTN(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 15:
+			if err := selectTCRMenu(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 16:
+			// TCRs of one company mean nothing to another
+			SessionTCR = ""
+			if err := chooseProfile(true); err != nil {
+				showErrorAndExit(err)
+			}
+			startSession()
+		case 17:
+			if err := editCompany(); err != nil {
+				showErrorAndExit(err)
+			}
+		case 18:
+			if err := manageClients(); err != nil {
+				showErrorAndExit(err)
+			}
 		}
 	}
 }
 
+// startSession prepares the company of the profile in use for the menu
+func startSession() {
+	// create config.json
+	if err := loadConfig(); err != nil {
+		registerCompany()
+	}
+	// if it fails - exit
+	if err := loadConfig(); err != nil {
+		showErrorAndExit(err)
+	}
+
+	// make sure TCR registered, if not - register
+	if SepConfig.TCR == nil {
+		if err := registerTCR(); err != nil {
+			showErrorAndExit(err)
+		}
+	}
+
+	// load clients list, if fails - init with empty list
+	if err := loadClients(); err != nil {
+		Clients = &[]sep.Client{}
+	}
+
+	// with several cash registers, the one used in this session is chosen
+	if err := chooseSessionTCR(); err != nil {
+		showErrorAndExit(err)
+	}
+
+	// finish transactions interrupted by a crash
+	recoverOnStartup(os.Stdout)
+
+	// deliver invoices queued while tax service was unreachable
+	flushOutboxOnStartup()
+}
+
 func printCodes() {
 	fmt.Println("---------------------------------------------------------------")
 	fmt.Println()
@@ -153,6 +234,9 @@ func printCodes() {
 // printUsage prints welcome message
 func printUsage() {
 	fmt.Println("---------------------------------------------------------------")
+	if ProfileName != "" {
+		fmt.Printf("Profil: %s, %s (PIB %s)\n", ProfileName, SepConfig.Name, SepConfig.TIN)
+	}
 	fmt.Println()
 	fmt.Println("Izaberite općiju:")
 	fmt.Println("[1] REGISTRACIJA I FISKALIZACIJA RAČUNA")
@@ -164,6 +248,15 @@ func printUsage() {
 	fmt.Println("[7] REGISTRACIJA KLIJENATA")
 	fmt.Println("[8] PREGLED PODATAKA ENU")
 	fmt.Println("[9] PREGLED IZVESTAJA ZA PERIOD")
+	fmt.Println("[10] GRUPNA FISKALIZACIJA IZ FAJLA")
+	fmt.Println("[11] NEPOSLATI RAČUNI")
+	fmt.Println("[12] PRETRAGA RAČUNA")
+	fmt.Println("[13] REGISTRACIJA DEPOZITA")
+	fmt.Println("[14] REGISTRACIJA OTPREMNICE")
+	fmt.Println("[15] UPRAVLJANJE ENU")
+	fmt.Println("[16] PROMJENA PROFILA")
+	fmt.Println("[17] PODACI FIRME")
+	fmt.Println("[18] KLIJENTI")
 	fmt.Println("[0] IZAĆI")
 }
 
@@ -173,386 +266,33 @@ func showErrorAndExit(err error) {
 	os.Exit(0)
 }
 
-func registerInvoice(simplified bool) error {
-	if err := loadSafenetConfig(); err != nil {
-		if err := setSafenetConfig(); err != nil {
-			return err
-		}
-	}
-
-	InternalOrdNum, err := gen.GenerateRegisterInvoiceRequest(&gen.Params{
-		SepConfig:  SepConfig,
-		Clients:    Clients,
-		OutFile:    currentWorkingDirectoryFilePath("gen.xml"),
-		Simplified: simplified,
-	})
-	if err != nil {
-		return err
-	}
-
-	fmt.Println()
-	fmt.Println("Molim provjerite svi podatke prije slanja u poresku!")
-	fmt.Println()
-	gen.PrintInvoiceDetails(currentWorkingDirectoryFilePath("gen.xml"), SepConfig, Clients, InternalOrdNum)
-
-	fmt.Println("Nastavite sa slanjem")
-	fmt.Println("[1] Da")
-	fmt.Println("[2] Ne")
-	stringValue := gen.Scan("Nastavite sa slanjem: ")
-	uintValue, err := strconv.ParseUint(stringValue, 10, 64)
-	if err != nil {
-		return err
-	}
-	if uintValue != 1 {
-		return fmt.Errorf("slanje otkazano")
-	}
-
-	fmt.Println("Nastavi sa slanjem")
-	fmt.Print("Generisanje JIKR: ")
-	if err := iic.WriteIIC(&iic.Params{
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("gen.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("iic.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje DSIG: ")
-	if err := dsig.Sign(&dsig.Params{
-		SepConfig:     SepConfig,
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("iic.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("dsig.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Registrovanje: ")
-	if err := reg.Register(&reg.Params{
-		SafenetConfig: SafenetConfig,
-		SepConfig:     SepConfig,
-		InFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("reg.xml"),
-	}); err != nil {
-		return err
-	}
-	// check whether api succeeded
-	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("reg.xml"))
-	if err != nil {
-		return err
-	}
-	RegisterInvoiceResponse := sep.RegisterInvoiceResponse{}
-	if err := xml.Unmarshal(buf, &RegisterInvoiceResponse); err != nil {
-		return err
-	}
-	if RegisterInvoiceResponse.Body.RegisterInvoiceResponse.FIC == "" {
-		fmt.Println(RegisterInvoiceResponse.Body.Fault)
-		return fmt.Errorf("%v", RegisterInvoiceResponse.Body.Fault)
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje PDF: ")
-	if err := pdf.GeneratePDF(&pdf.Params{
-		SepConfig:      SepConfig,
-		Clients:        Clients,
-		InternalInvNum: InternalOrdNum,
-		ReqFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		RespFile:       currentWorkingDirectoryFilePath("reg.xml"),
-		OutFile:        currentWorkingDirectoryFilePath("inv.pdf"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čuvanje rezultata: ")
-	folder, pdfFilePath, err := save(
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	)
-	if err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čišćenje: ")
-	if err := clean(
-		currentWorkingDirectoryFilePath("gen.xml"),
-		currentWorkingDirectoryFilePath("iic.xml"),
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	); err != nil {
-		fmt.Println("NIJE USPEŠNO")
-		return nil
-	}
-	fmt.Println("OK")
-
-	fmt.Printf("Rezultate sačuvani u %s\n", folder)
-	fmt.Printf("PDF fajl sačuvan u %s\n", pdfFilePath)
-
-	return nil
-}
-
-func registerCorrectiveInvoice(simplified bool) error {
-	if err := loadSafenetConfig(); err != nil {
-		if err := setSafenetConfig(); err != nil {
-			return err
-		}
-	}
-
-	InternalOrdNum, err := gen.GenerateCorrectiveRegisterInvoiceRequest(&gen.Params{
-		SepConfig:  SepConfig,
-		Clients:    Clients,
-		OutFile:    currentWorkingDirectoryFilePath("gen.xml"),
-		Simplified: simplified,
-	})
-	if err != nil {
-		return err
-	}
-
-	fmt.Println()
-	fmt.Println("Molim provjerite svi podatke prije slanja u poresku!")
+func generateIIC() error {
 	fmt.Println()
-	gen.PrintInvoiceDetails(currentWorkingDirectoryFilePath("gen.xml"), SepConfig, Clients, InternalOrdNum)
-
-	fmt.Println("Nastavite sa slanjem")
-	fmt.Println("[1] Da")
-	fmt.Println("[2] Ne")
-	stringValue := gen.Scan("Nastavite sa slanjem: ")
-	uintValue, err := strconv.ParseUint(stringValue, 10, 64)
-	if err != nil {
-		return err
-	}
-	if uintValue != 1 {
-		return fmt.Errorf("slanje otkazano")
-	}
-
-	fmt.Println("Nastavi sa slanjem")
-	fmt.Print("Generisanje JIKR: ")
-	if err := iic.WriteIIC(&iic.Params{
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("gen.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("iic.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje DSIG: ")
-	if err := dsig.Sign(&dsig.Params{
-		SepConfig:     SepConfig,
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("iic.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("dsig.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Registrovanje: ")
-	if err := reg.Register(&reg.Params{
-		SafenetConfig: SafenetConfig,
-		SepConfig:     SepConfig,
-		InFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("reg.xml"),
-	}); err != nil {
-		return err
-	}
-	// check whether api succeeded
-	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("reg.xml"))
-	if err != nil {
-		return err
-	}
-	RegisterInvoiceResponse := sep.RegisterInvoiceResponse{}
-	if err := xml.Unmarshal(buf, &RegisterInvoiceResponse); err != nil {
-		return err
-	}
-	if RegisterInvoiceResponse.Body.RegisterInvoiceResponse.FIC == "" {
-		fmt.Println(RegisterInvoiceResponse.Body.Fault)
-		return fmt.Errorf("%v", RegisterInvoiceResponse.Body.Fault)
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje PDF: ")
-	if err := pdf.GeneratePDF(&pdf.Params{
-		SepConfig:      SepConfig,
-		Clients:        Clients,
-		InternalInvNum: InternalOrdNum,
-		ReqFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		RespFile:       currentWorkingDirectoryFilePath("reg.xml"),
-		OutFile:        currentWorkingDirectoryFilePath("inv.pdf"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("VERIFIKACIJA IKOF")
 
-	fmt.Print("Čuvanje rezultata: ")
-	folder, pdfFilePath, err := save(
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	)
-	if err != nil {
+	if err := loadOrSetSigner(); err != nil {
 		return err
 	}
-	fmt.Println("OK")
-
-	fmt.Print("Čišćenje: ")
-	if err := clean(
-		currentWorkingDirectoryFilePath("gen.xml"),
-		currentWorkingDirectoryFilePath("iic.xml"),
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	); err != nil {
-		fmt.Println("NIJE USPEŠNO")
-		return nil
-	}
-	fmt.Println("OK")
-
-	fmt.Printf("Rezultate sačuvani u %s\n", folder)
-	fmt.Printf("PDF fajl sačuvan u %s\n", pdfFilePath)
-
-	return nil
-}
-
-func registerSummaryInvoice(simplified bool) error {
-	if err := loadSafenetConfig(); err != nil {
-		if err := setSafenetConfig(); err != nil {
+	signer, ok := AppSigner.(*SafeNetSigner)
+	if !ok {
+		out, err := computeIIC(
+			gen.Scan("Unesite datum i vrijeme izdavanja (2006-01-02T15:04:05+01:00): "),
+			gen.Scan("Unesite redni broj računa: "),
+			gen.Scan("Unesite ukupnu cijenu: "),
+		)
+		if err != nil {
 			return err
 		}
-	}
-
-	InternalOrdNum, err := gen.GenerateSummaryRegisterInvoiceRequest(&gen.Params{
-		SepConfig:  SepConfig,
-		Clients:    Clients,
-		OutFile:    currentWorkingDirectoryFilePath("gen.xml"),
-		Simplified: simplified,
-	})
-	if err != nil {
-		return err
-	}
-
-	fmt.Println()
-	fmt.Println("Molim provjerite svi podatke prije slanja u poresku!")
-	fmt.Println()
-	gen.PrintInvoiceDetails(currentWorkingDirectoryFilePath("gen.xml"), SepConfig, Clients, InternalOrdNum)
+		fmt.Println()
+		fmt.Println("---------------------------------------------------------------")
+		fmt.Printf("IKOF: %s\n", out.IIC)
+		fmt.Printf("IKOF Podpis: %s\n", out.IICSignature)
 
-	fmt.Println("Nastavite sa slanjem")
-	fmt.Println("[1] Da")
-	fmt.Println("[2] Ne")
-	stringValue := gen.Scan("Nastavite sa slanjem: ")
-	uintValue, err := strconv.ParseUint(stringValue, 10, 64)
-	if err != nil {
-		return err
-	}
-	if uintValue != 1 {
-		return fmt.Errorf("slanje otkazano")
-	}
-
-	fmt.Println("Nastavi sa slanjem")
-	fmt.Print("Generisanje JIKR: ")
-	if err := iic.WriteIIC(&iic.Params{
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("gen.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("iic.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje DSIG: ")
-	if err := dsig.Sign(&dsig.Params{
-		SepConfig:     SepConfig,
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("iic.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("dsig.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Registrovanje: ")
-	if err := reg.Register(&reg.Params{
-		SafenetConfig: SafenetConfig,
-		SepConfig:     SepConfig,
-		InFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("reg.xml"),
-	}); err != nil {
-		return err
-	}
-	// check whether api succeeded
-	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("reg.xml"))
-	if err != nil {
-		return err
-	}
-	RegisterInvoiceResponse := sep.RegisterInvoiceResponse{}
-	if err := xml.Unmarshal(buf, &RegisterInvoiceResponse); err != nil {
-		return err
-	}
-	if RegisterInvoiceResponse.Body.RegisterInvoiceResponse.FIC == "" {
-		fmt.Println(RegisterInvoiceResponse.Body.Fault)
-		return fmt.Errorf("%v", RegisterInvoiceResponse.Body.Fault)
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Generisanje PDF: ")
-	if err := pdf.GeneratePDF(&pdf.Params{
-		SepConfig:      SepConfig,
-		Clients:        Clients,
-		InternalInvNum: InternalOrdNum,
-		ReqFile:        currentWorkingDirectoryFilePath("dsig.xml"),
-		RespFile:       currentWorkingDirectoryFilePath("reg.xml"),
-		OutFile:        currentWorkingDirectoryFilePath("inv.pdf"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čuvanje rezultata: ")
-	folder, pdfFilePath, err := save(
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	)
-	if err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čišćenje: ")
-	if err := clean(
-		currentWorkingDirectoryFilePath("gen.xml"),
-		currentWorkingDirectoryFilePath("iic.xml"),
-		currentWorkingDirectoryFilePath("dsig.xml"),
-		currentWorkingDirectoryFilePath("reg.xml"),
-		currentWorkingDirectoryFilePath("inv.pdf"),
-	); err != nil {
-		fmt.Println("NIJE USPEŠNO")
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli: ")
 		return nil
 	}
-	fmt.Println("OK")
-
-	fmt.Printf("Rezultate sačuvani u %s\n", folder)
-	fmt.Printf("PDF fajl sačuvan u %s\n", pdfFilePath)
-
-	return nil
-}
-
-func generateIIC() error {
-	fmt.Println()
-	fmt.Println("---------------------------------------------------------------")
-	fmt.Println("VERIFIKACIJA IKOF")
-
-	if err := loadSafenetConfig(); err != nil {
-		if err := setSafenetConfig(); err != nil {
-			return err
-		}
-	}
-	iic, sig, err := iic.GenerateIIC(SafenetConfig, gen.GeneratePlainIIC())
+	iic, sig, err := iic.GenerateIIC(signer.Config, gen.GeneratePlainIIC())
 	if err != nil {
 		return err
 	}
@@ -569,97 +309,6 @@ func currentWorkingDirectoryFilePath(fileName string) string {
 	return filepath.Join(WorkDir, fileName)
 }
 
-func registerTCR() error {
-	if err := gen.GenerateRegisterTCRRequest(&gen.Params{
-		SepConfig: SepConfig,
-		OutFile:   currentWorkingDirectoryFilePath("tcr.xml"),
-	}); err != nil {
-		return err
-	}
-
-	if err := loadSafenetConfig(); err != nil {
-		if err := setSafenetConfig(); err != nil {
-			return err
-		}
-	}
-
-	fmt.Print("Generisanje DSIG: ")
-	if err := dsig.Sign(&dsig.Params{
-		SepConfig:     SepConfig,
-		SafenetConfig: SafenetConfig,
-		InFile:        currentWorkingDirectoryFilePath("tcr.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("tcr.dsig.xml"),
-	}); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Registrovanje: ")
-	if err := reg.Register(&reg.Params{
-		SafenetConfig: SafenetConfig,
-		SepConfig:     SepConfig,
-		InFile:        currentWorkingDirectoryFilePath("tcr.dsig.xml"),
-		OutFile:       currentWorkingDirectoryFilePath("tcr.reg.xml"),
-	}); err != nil {
-		return err
-	}
-	// check whether api succeeded
-	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("tcr.reg.xml"))
-	if err != nil {
-		return err
-	}
-	RegisterTCRResponse := sep.RegisterTCRResponse{}
-	if err := xml.Unmarshal(buf, &RegisterTCRResponse); err != nil {
-		return err
-	}
-	if RegisterTCRResponse.Body.RegisterTCRResponse.TCRCode == "" {
-		fmt.Println(RegisterTCRResponse.Body.Fault)
-		return fmt.Errorf("%v", RegisterTCRResponse.Body.Fault)
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čuvanje rezultata: ")
-	doc := etree.NewDocument()
-	if err := doc.ReadFromFile(currentWorkingDirectoryFilePath("tcr.dsig.xml")); err != nil {
-		return err
-	}
-	elem := doc.FindElement("//TCR")
-	if elem == nil {
-		return fmt.Errorf("invalid xml, no RegisterTCRRequest")
-	}
-	elemDoc := etree.NewDocument()
-	elemDoc.SetRoot(elem.Copy())
-	buf, err = elemDoc.WriteToBytes()
-	if err != nil {
-		return err
-	}
-
-	TCR := sep.TCR{}
-	if err := xml.Unmarshal(buf, &TCR); err != nil {
-		return err
-	}
-	TCR.TCRCode = string(RegisterTCRResponse.Body.RegisterTCRResponse.TCRCode)
-	SepConfig.TCR = &TCR
-	if err := saveSepConfig(); err != nil {
-		return err
-	}
-	fmt.Println("OK")
-
-	fmt.Print("Čišćenje: ")
-	if err := clean(
-		currentWorkingDirectoryFilePath("tcr.xml"),
-		currentWorkingDirectoryFilePath("tcr.dsig.xml"),
-		currentWorkingDirectoryFilePath("tcr.reg.xml"),
-	); err != nil {
-		fmt.Println("NIJE USPEŠNO")
-		return nil
-	}
-
-	fmt.Println("Detalji ENU su uspešno registrovani i sačuvani")
-	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
-	return nil
-}
-
 // generateClient asks user to fill in new client details
 func generateClient() *sep.Client {
 	fmt.Println()
@@ -680,18 +329,35 @@ func generateClient() *sep.Client {
 
 func registerClient() error {
 	client := generateClient()
-	if Clients == nil {
-		Clients = &[]sep.Client{*client}
-	} else {
-		*Clients = append(*Clients, *client)
+	if err := addClient(client); err != nil {
+		fmt.Println(err)
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+		return nil
 	}
-	saveClients()
 
 	fmt.Println("Detalji klijenta su uspešno sačuvani")
 	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
 	return nil
 }
 
+// addClient appends client to clients.json while holding the data lock, so
+// clients added by other instances are kept
+func addClient(client *sep.Client) error {
+	return withDataLock(func() error {
+		if err := loadClients(); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if Clients == nil {
+			Clients = &[]sep.Client{}
+		}
+		if findClient(client.TIN) != nil {
+			return fmt.Errorf("klijent sa PIB %s već postoji", client.TIN)
+		}
+		*Clients = append(*Clients, *client)
+		return saveClients()
+	})
+}
+
 func registerCompany() error {
 	fmt.Println("---------------------------------------------------------------")
 	fmt.Println("Welcome to FISC - simple util that saves you from frustrating process of invoices fiscalization!")
@@ -718,7 +384,9 @@ func registerCompany() error {
 	if err != nil {
 		return err
 	}
-	err = ioutil.WriteFile(currentWorkingDirectoryFilePath("config.json"), buf, 0644)
+	err = withDataLock(func() error {
+		return ioutil.WriteFile(currentWorkingDirectoryFilePath("config.json"), buf, 0644)
+	})
 	if err != nil {
 		return err
 	}
@@ -737,7 +405,8 @@ func loadConfig() error {
 	if err != nil {
 		return err
 	}
-	return nil
+	defaultTCR = SepConfig.TCR
+	return applySessionTCR()
 }
 
 func loadClients() error {
@@ -773,43 +442,66 @@ func loadSafenetConfig() error {
 	if err != nil {
 		return err
 	}
+
+	// PIN kept in clear text by older versions is moved to secrets.json
+	if SafenetConfig.UnlockPin != "" {
+		if err := saveSafeNetConfig(SafenetConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "PIN za digitalni token nije šifrovan: %v\n", err)
+		}
+		return nil
+	}
+	pin, err := getSecret(secretSafeNetPIN)
+	if err != nil {
+		return err
+	}
+	if pin == "" {
+		return fmt.Errorf("PIN za digitalni token nije sačuvan")
+	}
+	SafenetConfig.UnlockPin = pin
 	return nil
 }
 
 func setSafenetConfig() error {
-	SafenetConfig = &safenet.Config{
-		LibPath:   "",
-		UnlockPin: gen.Scan("Unesite PIN za digitalni token: "),
+	SafenetConfig = &safenet.Config{}
+	// the library installed by SafeNet is found without asking
+	if _, err := safenetModule(SafenetConfig); err != nil {
+		SafenetConfig.LibPath = gen.Scan("Unesite putanju do PKCS#11 biblioteke SafeNet tokena: ")
 	}
+	SafenetConfig.UnlockPin = gen.Scan("Unesite PIN za digitalni token: ")
 	return saveSafeNetConfig(SafenetConfig)
 }
 
+// saveSafeNetConfig stores PIN in secrets.json and the rest of the config in
+// safenet.json
 func saveSafeNetConfig(cfg *safenet.Config) error {
-	buf, err := json.MarshalIndent(cfg, "", "\t")
+	if err := setSecret(secretSafeNetPIN, cfg.UnlockPin); err != nil {
+		return err
+	}
+	plain := *cfg
+	plain.UnlockPin = ""
+	buf, err := json.MarshalIndent(&plain, "", "\t")
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(currentWorkingDirectoryFilePath("safenet.json"), buf, 0644)
+	return ioutil.WriteFile(currentWorkingDirectoryFilePath("safenet.json"), buf, 0600)
 }
 
 func saveSepConfig() error {
 
-	buf, err := json.MarshalIndent(SepConfig, "", "\t")
+	// a TCR selected for the session does not replace the default one
+	cfg := *SepConfig
+	cfg.TCR = defaultTCR
+	buf, err := json.MarshalIndent(&cfg, "", "\t")
 	if err != nil {
 		return err
 	}
 	return ioutil.WriteFile(currentWorkingDirectoryFilePath("config.json"), buf, 0644)
 }
 
-func save(requestFilePath, responseFilePath, pdfFilePath string) (string, string, error) {
-
-	// generate output folder, ./records/<DATE>
-	workDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
-	if err != nil {
-		return "", "", err
-	}
+func save(requestFilePath, responseFilePath, pdfFilePath string, meta *ArchiveMeta) (string, string, error) {
 
-	recordsDir := filepath.Join(workDir, "records")
+	// generate output folder, records/<DATE> of the profile in use
+	recordsDir := currentWorkingDirectoryFilePath("records")
 	currentDayDir := filepath.Join(recordsDir, time.Now().Format("2006-01-02"))
 
 	if _, err := os.Stat(currentDayDir); os.IsNotExist(err) {
@@ -832,10 +524,11 @@ func save(requestFilePath, responseFilePath, pdfFilePath string) (string, string
 	if elem == nil {
 		return "", "", fmt.Errorf("invalid xml, RegisterInvoiceRequest")
 	}
+	// the signed request is kept as it is, reformatting it would break the
+	// signature checked by verify-archive
 	reqDoc := etree.NewDocument()
 	reqDoc.SetRoot(elem.Copy())
-	reqDoc.IndentTabs()
-	reqDoc.Root().SetTail("")
+	attachScope(reqDoc.Root(), elem)
 	if err := reqDoc.WriteToFile(reqFilePath); err != nil {
 		return "", "", err
 	}
@@ -873,10 +566,26 @@ func save(requestFilePath, responseFilePath, pdfFilePath string) (string, string
 	if err := ioutil.WriteFile(invoiceFilePath, buf, 0644); err != nil {
 		return "", "", err
 	}
+	archivedPDFFilePath := invoiceFilePath
 	invoiceFilePath = currentWorkingDirectoryFilePath(pdfFileName)
 	if err := ioutil.WriteFile(invoiceFilePath, buf, 0644); err != nil {
 		return "", "", err
 	}
+
+	if err := saveArchiveMeta(reqFilePath, meta); err != nil {
+		return "", "", err
+	}
+
+	// archived files are sealed in the ledger before anything else refers
+	// to them
+	if err := appendLedger(reqFilePath, respFilePath, archivedPDFFilePath); err != nil {
+		return "", "", err
+	}
+
+	// the invoice is archived even if the index can't be updated
+	if err := indexInvoice(filepath.Base(currentDayDir), reqFilePath, respFilePath, archivedPDFFilePath); err != nil {
+		fmt.Fprintf(os.Stderr, "indeks nije ažuriran, pokrenite fisc invoices reindex: %v\n", err)
+	}
 	return currentDayDir, invoiceFilePath, nil
 }
 
@@ -958,117 +667,102 @@ func responseFileName(doc *etree.Document) (string, error) {
 
 func clean(files ...string) error {
 	for _, it := range files {
-		if err := os.Remove(it); err != nil {
+		if err := os.Remove(it); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 	}
 	return nil
 }
 
-func printSummary(startDate, endDate time.Time) {
+// Summary holds totals of invoices issued in a period
+type Summary struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// TCRCode limits the report to one TCR, empty for all of them
+	TCRCode string  `json:"tcr_code,omitempty"`
+	Num     int     `json:"num"`
+	PBWoR   float64 `json:"price_before_rebate"`
+	R       float64 `json:"rebate"`
+	PBR     float64 `json:"price_after_rebate"`
+	VA      float64 `json:"vat"`
+	Total   float64 `json:"total"`
+	PDFile  string  `json:"pdf,omitempty"`
+}
 
-	// enumerate all folders from startDate to endDate
-	dates := []string{}
-	var it time.Time = startDate
-	for {
-		dates = append(dates, it.Format("2006-01-02"))
-		it = it.AddDate(0, 0, 1)
-		if it.After(endDate) {
-			break
-		}
+// computeSummary sums up all invoices archived from startDate to endDate,
+// issued on the given TCR unless tcrCode is empty
+func computeSummary(startDate, endDate time.Time, tcrCode string) (*Summary, error) {
+	entries, err := indexEntriesByDay(startDate, endDate)
+	if err != nil {
+		return nil, err
 	}
 
-	recordsDir := filepath.Join(WorkDir, "records")
-
-	Num := 0
-	PBWoR := sep.Amount(0)
-	PBR := sep.Amount(0)
-	R := sep.Amount(0)
-	VA := sep.Amount(0)
-	Total := sep.Amount(0)
-
-	// gather requests from all selected folders
-	requests := []sep.RegisterInvoiceRequest{}
-	for _, folder := range dates {
-		// check if folder exists
-		dateDir := filepath.Join(recordsDir, folder)
-		if _, err := os.Stat(dateDir); os.IsNotExist(err) {
-			continue
-		}
-
-		files, err := ioutil.ReadDir(dateDir)
-		if err != nil {
-			fmt.Println(err.Error())
+	summary := &Summary{
+		From:    startDate,
+		To:      endDate,
+		TCRCode: tcrCode,
+	}
+	for _, e := range entries {
+		if tcrCode != "" && e.TCRCode != tcrCode {
 			continue
 		}
+		summary.Num++
+		summary.PBWoR += e.PBWoR
+		summary.R += e.R
+		summary.PBR += e.PBR
+		summary.VA += e.VA
+		summary.Total += e.TotPrice
+	}
+	return summary, nil
+}
 
-		// read each _request.xml file and retrieve content
-		for _, fi := range files {
-
-			if strings.Contains(fi.Name(), "_request.xml") {
-				filePath := filepath.Join(dateDir, fi.Name())
-
-				request := sep.RegisterInvoiceRequest{}
-				buf, err := ioutil.ReadFile(filePath)
-				if err != nil {
-					fmt.Println(err.Error())
-				}
-				if err := xml.Unmarshal(buf, &request); err != nil {
-					fmt.Println(err.Error())
-				}
-				requests = append(requests, request)
-			}
-		}
-
-		Num += len(requests)
-
-		for _, req := range requests {
-			for _, i := range *req.Invoice.Items {
-				PBWoR += i.UPB * i.Q
-
-				upbr := i.UPB - i.UPB*(i.R/100)
-				PBR += upbr * i.Q
-
-				R += i.UPB*i.Q - upbr*i.Q
-
-				uva := upbr * (i.VR / 100)
-				VA += uva * i.Q
-			}
-			Total += req.Invoice.TotPrice
-		}
-
-		requests = []sep.RegisterInvoiceRequest{}
+// writeSummaryPDF generates the period report and stores its path in summary
+func writeSummaryPDF(summary *Summary) error {
+	fileName := strings.Join([]string{"izveštaj", summary.From.Format("2006-01-02"), summary.To.Format("2006-01-02")}, "_")
+	if summary.TCRCode != "" {
+		fileName = strings.Join([]string{fileName, summary.TCRCode}, "_")
 	}
-
-	fmt.Println("---------------------------------------------------------------")
-	fmt.Printf("Koliko ukupno faktura: %d\n", Num)
-	fmt.Printf("Koliko osnovica prije rabata: %.02f\n", float64(PBWoR))
-	fmt.Printf("Koliko rabat: %.02f\n", float64(R))
-	fmt.Printf("Koliko osnovica posle rabata: %.02f\n", float64(PBR))
-	fmt.Printf("Koliko PDV: %.02f\n", float64(VA))
-	fmt.Printf("Koliko ukupno sa PDV: %.02f\n", float64(Total))
-	fmt.Println("---------------------------------------------------------------")
-
-	fileName := strings.Join([]string{"izveštaj", startDate.Format("2006-01-02"), endDate.Format("2006-01-02")}, "_")
 	fileName = strings.Join([]string{fileName, "pdf"}, ".")
 	filePath := currentWorkingDirectoryFilePath(fileName)
 	if err := pdf.GenerateExempt(
 		SepConfig,
-		startDate,
-		endDate,
-		Num,
-		float64(PBWoR),
-		float64(R),
-		float64(PBR),
-		float64(VA),
-		float64(Total),
+		summary.From,
+		summary.To,
+		summary.Num,
+		summary.PBWoR,
+		summary.R,
+		summary.PBR,
+		summary.VA,
+		summary.Total,
 		filePath,
 	); err != nil {
+		return err
+	}
+	summary.PDFile = filePath
+	return nil
+}
+
+func printSummary(startDate, endDate time.Time, tcrCode string) {
+	summary, err := computeSummary(startDate, endDate, tcrCode)
+	if err != nil {
+		showErrorAndExit(err)
+	}
+
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Printf("Koliko ukupno faktura: %d\n", summary.Num)
+	fmt.Printf("Koliko osnovica prije rabata: %.02f\n", summary.PBWoR)
+	fmt.Printf("Koliko rabat: %.02f\n", summary.R)
+	fmt.Printf("Koliko osnovica posle rabata: %.02f\n", summary.PBR)
+	fmt.Printf("Koliko PDV: %.02f\n", summary.VA)
+	fmt.Printf("Koliko ukupno sa PDV: %.02f\n", summary.Total)
+	fmt.Println("---------------------------------------------------------------")
+
+	if err := writeSummaryPDF(summary); err != nil {
 		showErrorAndExit(err)
 	}
 
 	fmt.Println()
-	fmt.Printf("Izveštaj sačuvan: %s\n", filePath)
+	fmt.Printf("Izveštaj sačuvan: %s\n", summary.PDFile)
 
 	fmt.Println()
 	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli: ")
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+)
+
+// subseqDelivTypes are the reasons for subsequent delivery accepted by the
+// tax service
+var subseqDelivTypes = map[string]bool{
+	"NOINTERNET":     true,
+	"BOUNDBOOK":      true,
+	"SERVICE":        true,
+	"TECHNICALERROR": true,
+	"BUSINESSNEEDS":  true,
+}
+
+// DeliveryError means the document did not reach the tax service, so it is
+// safe to deliver it again later
+type DeliveryError struct {
+	Err error
+}
+
+func (e *DeliveryError) Error() string {
+	return fmt.Sprintf("poreska uprava nije dostupna: %v", e.Err)
+}
+
+// OutboxItem is an invoice with IIC waiting for subsequent delivery
+type OutboxItem struct {
+	IIC            string          `json:"iic"`
+	Pipeline       string          `json:"pipeline"`
+	QueuedAt       time.Time       `json:"queued_at"`
+	Attempts       int             `json:"attempts"`
+	LastAttempt    *time.Time      `json:"last_attempt,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	InternalInvNum json.RawMessage `json:"internal_inv_num,omitempty"`
+	// Host and PID identify the instance sending the item
+	Host string `json:"host,omitempty"`
+	PID  int    `json:"pid,omitempty"`
+	// Delivered is set once the tax service issued FIC, so the item is
+	// never sent again, even if fisc stops before removing it
+	Delivered *time.Time `json:"delivered,omitempty"`
+	FIC       string     `json:"fic,omitempty"`
+	// Rejected is set when the tax service refused the item for good; it is
+	// not sent again until the user resolves it
+	Rejected *time.Time `json:"rejected,omitempty"`
+
+	Dir string `json:"-"`
+}
+
+// Outbox file names inside the item folder
+const (
+	outboxItemFile    = "item.json"
+	outboxRequestFile = "request.xml"
+	outboxSignedFile  = "signed.xml"
+	outboxPDFFile     = "invoice.pdf"
+)
+
+func outboxDir() string {
+	return currentWorkingDirectoryFilePath("outbox")
+}
+
+// placeholderResponse stands in for the tax service response of a queued
+// invoice, so the PDF can be printed with IIC only
+const placeholderResponse = `<?xml version="1.0" encoding="UTF-8"?>
+<env:Envelope xmlns:env="http://schemas.xmlsoap.org/soap/envelope/">
+	<env:Body>
+		<RegisterInvoiceResponse xmlns="https://efi.tax.gov.me/fs/schema" Id="Response" Version="1">
+			<FIC></FIC>
+		</RegisterInvoiceResponse>
+	</env:Body>
+</env:Envelope>
+`
+
+// withOutbox makes the pipeline queue documents the tax service could not be
+// reached for, instead of failing
+func withOutbox(p *Pipeline) *Pipeline {
+	register := p.Stages[StageRegister]
+	archive := p.Stages[StageArchive]
+
+	p.Stages[StageRegister] = func(tx *Transaction) error {
+		err := register(tx)
+		if _, ok := err.(*DeliveryError); !ok {
+			return err
+		}
+		tx.Queued = true
+		tx.DeliveryErr = err
+		return ioutil.WriteFile(tx.RegFile, []byte(placeholderResponse), 0644)
+	}
+	p.Stages[StageArchive] = func(tx *Transaction) error {
+		if !tx.Queued {
+			return archive(tx)
+		}
+		return enqueue(p.Name, tx)
+	}
+	return p
+}
+
+// enqueue stores the transaction in the outbox
+func enqueue(pipeline string, tx *Transaction) error {
+	if tx.IIC == "" {
+		return fmt.Errorf("no IIC, cannot queue")
+	}
+	dir := filepath.Join(outboxDir(), tx.IIC)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	item := &OutboxItem{
+		IIC:      tx.IIC,
+		Pipeline: pipeline,
+		QueuedAt: time.Now(),
+		Dir:      dir,
+	}
+	if tx.DeliveryErr != nil {
+		item.LastError = tx.DeliveryErr.Error()
+	}
+	buf, err := json.Marshal(tx.PDF.InternalInvNum)
+	if err != nil {
+		return err
+	}
+	item.InternalInvNum = buf
+
+	if err := copyFile(tx.IICFile, filepath.Join(dir, outboxRequestFile)); err != nil {
+		return err
+	}
+	if err := copyFile(tx.SignedFile, filepath.Join(dir, outboxSignedFile)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(tx.PDFFile); tx.PDFFile != "" && err == nil {
+		if err := copyFile(tx.PDFFile, filepath.Join(dir, outboxPDFFile)); err != nil {
+			return err
+		}
+		tx.PDFFilePath = currentWorkingDirectoryFilePath(strings.Join([]string{tx.IIC, "pdf"}, "."))
+		if err := copyFile(tx.PDFFile, tx.PDFFilePath); err != nil {
+			return err
+		}
+	}
+	tx.Folder = dir
+	return saveOutboxItem(item)
+}
+
+func saveOutboxItem(item *OutboxItem) error {
+	buf, err := json.MarshalIndent(item, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(item.Dir, outboxItemFile), buf, 0644)
+}
+
+// loadOutbox returns all queued items, oldest first
+func loadOutbox() ([]*OutboxItem, error) {
+	files, err := ioutil.ReadDir(outboxDir())
+	if os.IsNotExist(err) {
+		return []*OutboxItem{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	items := []*OutboxItem{}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+		item, err := readOutboxItem(filepath.Join(outboxDir(), fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].QueuedAt.Before(items[j].QueuedAt)
+	})
+	return items, nil
+}
+
+func readOutboxItem(dir string) (*OutboxItem, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(dir, outboxItemFile))
+	if err != nil {
+		return nil, err
+	}
+	item := &OutboxItem{}
+	if err := json.Unmarshal(buf, item); err != nil {
+		return nil, err
+	}
+	item.Dir = dir
+	return item, nil
+}
+
+// claimOutboxItem makes this process the sender of the item, so instances
+// flushing the outbox at the same time don't send it twice. Rejected items
+// and items sent by another running instance are not claimed.
+func claimOutboxItem(item *OutboxItem) (bool, error) {
+	claimed := false
+	err := withDataLock(func() error {
+		current, err := readOutboxItem(item.Dir)
+		if os.IsNotExist(err) {
+			// sent by another instance
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if current.Rejected != nil || ownerRunning(current.Host, current.PID) {
+			return nil
+		}
+		*item = *current
+		item.Host, _ = os.Hostname()
+		item.PID = os.Getpid()
+		claimed = true
+		return saveOutboxItem(item)
+	})
+	return claimed, err
+}
+
+// newSubsequentDeliveryPipeline creates a pipeline re-sending a queued item
+func newSubsequentDeliveryPipeline(item *OutboxItem, subseqDelivType string) *Pipeline {
+	p := newInvoicePipeline(RegularInvoice)
+	delete(p.Stages, StageIIC)
+	p.Stages[StageRegister] = registerInvoiceStage
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		if len(item.InternalInvNum) > 0 {
+			if err := json.Unmarshal(item.InternalInvNum, &tx.PDF.InternalInvNum); err != nil {
+				return err
+			}
+		}
+		return writeSubsequentDelivery(filepath.Join(item.Dir, outboxRequestFile), tx, subseqDelivType)
+	}
+	// the item is marked as soon as it is registered; the journal takes
+	// care of the rest
+	p.After(StageRegister, func(tx *Transaction, res *StageResult) error {
+		if res.Err != nil {
+			return nil
+		}
+		now := time.Now()
+		item.Delivered = &now
+		item.FIC = tx.FIC
+		return saveOutboxItem(item)
+	})
+	return p
+}
+
+// writeSubsequentDelivery marks a queued request as subsequent delivery and
+// writes it as the IIC file of the transaction, keeping the original IIC
+func writeSubsequentDelivery(requestFilePath string, tx *Transaction, subseqDelivType string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(requestFilePath); err != nil {
+		return err
+	}
+	header := doc.FindElement("//Header")
+	if header == nil {
+		return fmt.Errorf("invalid xml, no Header")
+	}
+	header.CreateAttr("SendDateTime", time.Now().Format(dateTimeLayout))
+	header.CreateAttr("UUID", newUUID())
+	header.CreateAttr("SubseqDelivType", subseqDelivType)
+
+	invoice := doc.FindElement("//Invoice")
+	if invoice == nil {
+		return fmt.Errorf("invalid xml, no Invoice")
+	}
+	tx.IIC = invoice.SelectAttrValue("IIC", "")
+	tx.TCRCode = invoice.SelectAttrValue("TCRCode", "")
+	return doc.WriteToFile(tx.IICFile)
+}
+
+// OutboxResult is the outcome of re-sending a single item
+type OutboxResult struct {
+	IIC    string `json:"iic"`
+	OK     bool   `json:"ok"`
+	FIC    string `json:"fic,omitempty"`
+	Folder string `json:"folder,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// FICUnknown is set for an invoice archived without FIC, because the
+	// tax service had registered it before
+	FICUnknown bool `json:"fic_unknown,omitempty"`
+	Rejected   bool `json:"rejected,omitempty"`
+}
+
+// flushOutbox re-sends queued items as subsequent delivery. Items the tax
+// service already registered are archived without FIC; items it refuses for
+// other reasons are kept as rejected instead of being sent again.
+func flushOutbox(subseqDelivType string) ([]*OutboxResult, error) {
+	if !subseqDelivTypes[subseqDelivType] {
+		return nil, fmt.Errorf("unknown subsequent delivery type %s", subseqDelivType)
+	}
+	items, err := loadOutbox()
+	if err != nil {
+		return nil, err
+	}
+	results := []*OutboxResult{}
+	for _, item := range items {
+		claimed, err := claimOutboxItem(item)
+		if err != nil {
+			return results, err
+		}
+		if !claimed {
+			continue
+		}
+		if item.Delivered != nil {
+			// registered before fisc stopped, the journal archived it
+			results = append(results, &OutboxResult{IIC: item.IIC, OK: true, FIC: item.FIC})
+			if err := os.RemoveAll(item.Dir); err != nil {
+				return results, err
+			}
+			continue
+		}
+
+		p := newSubsequentDeliveryPipeline(item, subseqDelivType)
+		tx, err := p.NewTransaction()
+		if err != nil {
+			return results, err
+		}
+		err = p.Run(tx)
+
+		res := &OutboxResult{IIC: item.IIC, FIC: tx.FIC, Folder: tx.Folder}
+		results = append(results, res)
+		if fault, ok := err.(*SOAPFault); ok && fault.Code == faultDuplicateIIC {
+			discardTransaction(tx)
+			if res.Folder, err = archiveRegisteredItem(item, fault); err == nil {
+				res.OK, res.FICUnknown, res.Error = true, true, fault.Error()
+				if err := os.RemoveAll(item.Dir); err != nil {
+					return results, err
+				}
+				continue
+			}
+		}
+		if err != nil && item.Delivered == nil {
+			discardTransaction(tx)
+			now := time.Now()
+			item.Attempts++
+			item.LastAttempt = &now
+			item.LastError = err.Error()
+			item.Host, item.PID = "", 0
+			res.Error = err.Error()
+			if _, ok := err.(*SOAPFault); ok {
+				item.Rejected = &now
+				res.Rejected = true
+			}
+			if err := saveOutboxItem(item); err != nil {
+				return results, err
+			}
+			continue
+		}
+		if err != nil {
+			// registered, the journal finishes archiving
+			res.Error = err.Error()
+			continue
+		}
+		res.OK = true
+		if err := os.RemoveAll(item.Dir); err != nil {
+			return results, err
+		}
+	}
+	return results, nil
+}
+
+// archiveRegisteredItem archives the signed request of a queued invoice the
+// tax service registered before its response was lost. The FIC is not known,
+// the fault of the subsequent delivery is kept in the meta file instead.
+func archiveRegisteredItem(item *OutboxItem, fault *SOAPFault) (string, error) {
+	responseFilePath := filepath.Join(item.Dir, "response.xml")
+	if err := ioutil.WriteFile(responseFilePath, []byte(placeholderResponse), 0644); err != nil {
+		return "", err
+	}
+	var folder string
+	err := withDataLock(func() error {
+		var err error
+		folder, _, err = save(
+			filepath.Join(item.Dir, outboxSignedFile),
+			responseFilePath,
+			filepath.Join(item.Dir, outboxPDFFile),
+			&ArchiveMeta{InternalInvNum: item.InternalInvNum, Fault: fault.Error()},
+		)
+		return err
+	})
+	return folder, err
+}
+
+// discardOutboxItem removes a queued item the tax service rejected and the
+// user resolved with it. Other items may be registered already and are only
+// removed by sending them.
+func discardOutboxItem(iic string) error {
+	return withDataLock(func() error {
+		item, err := readOutboxItem(filepath.Join(outboxDir(), iic))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("račun sa IKOF %s nije u redu za slanje", iic)
+		}
+		if err != nil {
+			return err
+		}
+		if ownerRunning(item.Host, item.PID) {
+			return fmt.Errorf("račun sa IKOF %s šalje %s (pid %d)", iic, item.Host, item.PID)
+		}
+		if item.Rejected == nil || item.Delivered != nil {
+			return fmt.Errorf("račun sa IKOF %s je možda već registrovan, pošaljite ga sa fisc outbox flush", iic)
+		}
+		return os.RemoveAll(item.Dir)
+	})
+}
+
+// copyFile copies src to dst
+func copyFile(src, dst string) error {
+	buf, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, buf, 0644)
+}
+
+// printOutboxResults prints results of an outbox flush
+func printOutboxResults(results []*OutboxResult) {
+	for _, it := range results {
+		if it.FICUnknown {
+			fmt.Printf("IKOF %s: već registrovan, JIKR nije poznat, arhiviran u %s\n", it.IIC, it.Folder)
+		} else if it.OK {
+			fmt.Printf("IKOF %s: OK, JIKR %s\n", it.IIC, it.FIC)
+		} else if it.Rejected {
+			fmt.Printf("IKOF %s: ODBIJEN, %s\n", it.IIC, it.Error)
+		} else {
+			fmt.Printf("IKOF %s: NIJE USPEŠNO, %s\n", it.IIC, it.Error)
+		}
+	}
+}
+
+// flushOutboxOnStartup re-sends queued invoices when fisc starts
+func flushOutboxOnStartup() {
+	items, err := loadOutbox()
+	if err != nil {
+		return
+	}
+	pending := 0
+	for _, it := range items {
+		if it.Rejected == nil {
+			pending++
+		}
+	}
+	if pending == 0 {
+		return
+	}
+	fmt.Printf("Naknadna dostava %d neposlatih računa\n", pending)
+	if err := loadOrSetSigner(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	results, err := flushOutbox("NOINTERNET")
+	printOutboxResults(results)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+func manageOutbox() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("NEPOSLATI RAČUNI")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+
+	items, err := loadOutbox()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("Nema neposlatih računa")
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+		return nil
+	}
+	for _, it := range items {
+		fmt.Printf("IKOF %s, sačuvan %s, pokušaja %d", it.IIC, it.QueuedAt.Format("2006-01-02 15:04:05"), it.Attempts)
+		if it.Rejected != nil {
+			fmt.Print(", ODBIJEN")
+		}
+		if it.LastError != "" {
+			fmt.Printf(", greška: %s", it.LastError)
+		}
+		fmt.Println()
+	}
+
+	fmt.Println()
+	fmt.Println("Pošalji neposlate račune")
+	fmt.Println("[1] Da")
+	fmt.Println("[2] Ne")
+	if gen.Scan("Pošalji: ") != "1" {
+		return nil
+	}
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+	results, err := flushOutbox("NOINTERNET")
+	printOutboxResults(results)
+	if err != nil {
+		return err
+	}
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+func outboxListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return loadOutbox()
+}
+
+func outboxFlushCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("outbox flush")
+	subseqDelivType := fs.String("type", "NOINTERNET", "")
+	if err := fs.Parse(args); err != nil {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	results, err := flushOutbox(*subseqDelivType)
+	if err != nil {
+		return results, err
+	}
+	for _, it := range results {
+		if !it.OK {
+			return results, fmt.Errorf("nisu svi računi poslati")
+		}
+	}
+	return results, nil
+}
+
+func outboxDiscardCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := discardOutboxItem(args[0]); err != nil {
+		return nil, err
+	}
+	return map[string]string{"discarded": args[0]}, nil
+}
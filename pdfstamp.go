@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// copyMarkGlyphs are the letters of "KOPIJA" drawn as polylines in a 4x6 box,
+// so the mark needs no font in the document
+var copyMarkGlyphs = [][][][2]float64{
+	{{{0, 0}, {0, 6}}, {{4, 6}, {0, 2}}, {{1.3, 3.3}, {4, 0}}},
+	{{{0, 0}, {4, 0}, {4, 6}, {0, 6}, {0, 0}}},
+	{{{0, 0}, {0, 6}, {4, 6}, {4, 3}, {0, 3}}},
+	{{{2, 0}, {2, 6}}, {{1, 0}, {3, 0}}, {{1, 6}, {3, 6}}},
+	{{{0, 2}, {0, 0}, {3, 0}, {3, 6}}},
+	{{{0, 0}, {2, 6}, {4, 0}}, {{1, 3}, {3, 3}}},
+}
+
+var (
+	pdfObjectRegexp   = regexp.MustCompile(`(?s)(\d+)\s+(\d+)\s+obj\b(.*?)endobj`)
+	pdfPageRegexp     = regexp.MustCompile(`/Type\s*/Page\b`)
+	pdfContentsRegexp = regexp.MustCompile(`/Contents\s*(\[[^\]]*\]|\d+\s+\d+\s+R)`)
+	pdfMediaBoxRegexp = regexp.MustCompile(`/MediaBox\s*\[([^\]]*)\]`)
+	pdfRootRegexp     = regexp.MustCompile(`/Root\s+\d+\s+\d+\s+R`)
+	pdfSizeRegexp     = regexp.MustCompile(`/Size\s+(\d+)`)
+	pdfStartXRefRegex = regexp.MustCompile(`startxref\s+(\d+)\s+%%EOF\s*$`)
+)
+
+// copyMarkStream draws "KOPIJA" in a frame at the top right of a page of the
+// given size
+func copyMarkStream(width, height float64) []byte {
+	const scale, advance, margin = 4.0, 7.0, 36.0
+	textWidth := float64(len(copyMarkGlyphs))*advance*scale - 3*scale
+	x0 := width - margin - textWidth
+	y0 := height - margin - 6*scale
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("q 0.8 0 0 RG 2 w 1 J 1 j\n")
+	fmt.Fprintf(buf, "%.2f %.2f %.2f %.2f re S\n", x0-8, y0-8, textWidth+16, 6*scale+16)
+	for i, glyph := range copyMarkGlyphs {
+		x := x0 + float64(i)*advance*scale
+		for _, line := range glyph {
+			for j, p := range line {
+				op := "l"
+				if j == 0 {
+					op = "m"
+				}
+				fmt.Fprintf(buf, "%.2f %.2f %s\n", x+p[0]*scale, y0+p[1]*scale, op)
+			}
+			buf.WriteString("S\n")
+		}
+	}
+	buf.WriteString("Q\n")
+	return buf.Bytes()
+}
+
+// pdfMediaBox returns the page size declared in the document, A4 if there is
+// none
+func pdfMediaBox(doc []byte) (float64, float64) {
+	if m := pdfMediaBoxRegexp.FindSubmatch(doc); m != nil {
+		fields := strings.Fields(string(m[1]))
+		if len(fields) == 4 {
+			x0, err0 := strconv.ParseFloat(fields[0], 64)
+			y0, err1 := strconv.ParseFloat(fields[1], 64)
+			x1, err2 := strconv.ParseFloat(fields[2], 64)
+			y1, err3 := strconv.ParseFloat(fields[3], 64)
+			if err0 == nil && err1 == nil && err2 == nil && err3 == nil {
+				return x1 - x0, y1 - y0
+			}
+		}
+	}
+	return 595.28, 841.89
+}
+
+// stampCopyMark marks every page of a PDF as a copy. The mark is appended as
+// an incremental update, so the original content is left as it is. Only
+// documents with a classic cross-reference table are supported.
+func stampCopyMark(doc []byte) ([]byte, error) {
+	startXRef := pdfStartXRefRegex.FindSubmatch(doc)
+	if startXRef == nil {
+		return nil, fmt.Errorf("invalid pdf, no startxref")
+	}
+	trailerAt := bytes.LastIndex(doc, []byte("trailer"))
+	if trailerAt < 0 {
+		return nil, fmt.Errorf("pdf bez tabele referenci nije podržan")
+	}
+	trailer := doc[trailerAt:]
+	root := pdfRootRegexp.Find(trailer)
+	size := pdfSizeRegexp.FindSubmatch(trailer)
+	if root == nil || size == nil {
+		return nil, fmt.Errorf("invalid pdf, no Root or Size in trailer")
+	}
+	nextObject, err := strconv.Atoi(string(size[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	// the last definition of an object is the current one
+	pages := map[string][]byte{}
+	order := []string{}
+	for _, m := range pdfObjectRegexp.FindAllSubmatch(doc, -1) {
+		id := string(m[1]) + " " + string(m[2])
+		body := m[3]
+		if !pdfPageRegexp.Match(body) || !pdfContentsRegexp.Match(body) {
+			delete(pages, id)
+			continue
+		}
+		if _, ok := pages[id]; !ok {
+			order = append(order, id)
+		}
+		pages[id] = body
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("invalid pdf, no pages")
+	}
+
+	out := bytes.NewBuffer(append([]byte{}, doc...))
+	if !bytes.HasSuffix(doc, []byte("\n")) {
+		out.WriteString("\n")
+	}
+	type xrefEntry struct {
+		id, gen int
+		offset  int
+	}
+	xref := []xrefEntry{}
+	writeObject := func(id, gen int, body []byte) {
+		xref = append(xref, xrefEntry{id, gen, out.Len()})
+		fmt.Fprintf(out, "%d %d obj\n", id, gen)
+		out.Write(body)
+		out.WriteString("\nendobj\n")
+	}
+	writeStream := func(content []byte) int {
+		id := nextObject
+		nextObject++
+		writeObject(id, 0, []byte(fmt.Sprintf("<</Length %d>>\nstream\n%s\nendstream", len(content), content)))
+		return id
+	}
+
+	// the original content is wrapped in q/Q so the mark is drawn in the
+	// default graphics state
+	width, height := pdfMediaBox(doc)
+	save := writeStream([]byte("q"))
+	stamp := writeStream(append([]byte("Q\n"), copyMarkStream(width, height)...))
+	for _, id := range order {
+		body, ok := pages[id]
+		if !ok {
+			continue
+		}
+		m := pdfContentsRegexp.FindSubmatch(body)
+		contents := strings.Trim(string(m[1]), "[]")
+		newContents := fmt.Sprintf("/Contents [%d 0 R %s %d 0 R]", save, strings.TrimSpace(contents), stamp)
+		body = pdfContentsRegexp.ReplaceAllLiteral(body, []byte(newContents))
+
+		fields := strings.Fields(id)
+		objectID, _ := strconv.Atoi(fields[0])
+		gen, _ := strconv.Atoi(fields[1])
+		writeObject(objectID, gen, bytes.TrimSpace(body))
+	}
+
+	xrefAt := out.Len()
+	out.WriteString("xref\n")
+	for _, it := range xref {
+		fmt.Fprintf(out, "%d 1\n%010d %05d n \n", it.id, it.offset, it.gen)
+	}
+	fmt.Fprintf(out, "trailer\n<</Size %d %s /Prev %s>>\nstartxref\n%d\n%%%%EOF\n", nextObject, root, startXRef[1], xrefAt)
+	return out.Bytes(), nil
+}
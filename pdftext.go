@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Page layout of documents written by textPDF, A4 in points
+const (
+	pdfPageWidth  = 595.28
+	pdfPageHeight = 841.89
+	pdfMargin     = 50.0
+)
+
+// pdfWinAnsi maps letters outside Latin-1 to WinAnsiEncoding. Letters the
+// encoding has no glyph for are written without the diacritic.
+var pdfWinAnsi = map[rune]string{
+	'Š': "\x8a", 'š': "\x9a", 'Ž': "\x8e", 'ž': "\x9e",
+	'Č': "C", 'č': "c", 'Ć': "C", 'ć': "c", 'Đ': "Dj", 'đ': "dj",
+	'–': "\x96", '—': "\x97", '€': "\x80",
+}
+
+// pdfString encodes s as a PDF literal string for the standard fonts
+func pdfString(s string) string {
+	buf := &strings.Builder{}
+	buf.WriteByte('(')
+	for _, r := range s {
+		if it, ok := pdfWinAnsi[r]; ok {
+			buf.WriteString(it)
+			continue
+		}
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r < 0x20:
+			buf.WriteByte(' ')
+		case r < 0x100:
+			buf.WriteByte(byte(r))
+		default:
+			buf.WriteByte('?')
+		}
+	}
+	buf.WriteByte(')')
+	return buf.String()
+}
+
+// textPDF lays out lines of text on A4 pages. It uses the standard Helvetica
+// fonts every reader has, so no font is embedded.
+type textPDF struct {
+	pages []*bytes.Buffer
+	y     float64
+}
+
+func newTextPDF() *textPDF {
+	p := &textPDF{}
+	p.newPage()
+	return p
+}
+
+func (p *textPDF) newPage() {
+	p.pages = append(p.pages, &bytes.Buffer{})
+	p.y = pdfPageHeight - pdfMargin
+}
+
+func (p *textPDF) page() *bytes.Buffer {
+	return p.pages[len(p.pages)-1]
+}
+
+// advance moves down by height, starting a new page when there is no room
+func (p *textPDF) advance(height float64) {
+	if p.y-height < pdfMargin {
+		p.newPage()
+	}
+	p.y -= height
+}
+
+// columns writes a line with values starting at the given x offsets from the
+// left margin
+func (p *textPDF) columns(size float64, bold bool, xs []float64, values ...string) {
+	p.advance(size * 1.4)
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	for i, it := range values {
+		if it == "" || i >= len(xs) {
+			continue
+		}
+		fmt.Fprintf(p.page(), "BT /%s %.1f Tf %.2f %.2f Td %s Tj ET\n", font, size, pdfMargin+xs[i], p.y, pdfString(it))
+	}
+}
+
+// line writes a line of text at the left margin
+func (p *textPDF) line(size float64, bold bool, text string) {
+	p.columns(size, bold, []float64{0}, text)
+}
+
+// rule draws a horizontal line across the page
+func (p *textPDF) rule() {
+	p.advance(6)
+	fmt.Fprintf(p.page(), "0.5 w %.2f %.2f m %.2f %.2f l S\n", pdfMargin, p.y+3, pdfPageWidth-pdfMargin, p.y+3)
+}
+
+// space leaves an empty gap
+func (p *textPDF) space(height float64) {
+	p.advance(height)
+}
+
+// bytes returns the complete document
+func (p *textPDF) bytes() []byte {
+	out := &bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	offsets := []int{}
+	writeObject := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	// objects 1-4 are fixed, every page is followed by its content stream
+	kids := []string{}
+	for i := range p.pages {
+		kids = append(kids, fmt.Sprintf("%d 0 R", 5+2*i))
+	}
+	writeObject("<</Type /Catalog /Pages 2 0 R>>")
+	writeObject(fmt.Sprintf("<</Type /Pages /Kids [%s] /Count %d>>", strings.Join(kids, " "), len(p.pages)))
+	writeObject("<</Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding>>")
+	writeObject("<</Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding>>")
+	for i, content := range p.pages {
+		writeObject(fmt.Sprintf("<</Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources <</Font <</F1 3 0 R /F2 4 0 R>>>> /Contents %d 0 R>>",
+			pdfPageWidth, pdfPageHeight, 6+2*i))
+		writeObject(fmt.Sprintf("<</Length %d>>\nstream\n%s\nendstream", content.Len(), content.Bytes()))
+	}
+
+	xrefAt := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, it := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", it)
+	}
+	fmt.Fprintf(out, "trailer\n<</Size %d /Root 1 0 R>>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xrefAt)
+	return out.Bytes()
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/pdf"
+	"github.com/noshto/reg"
+	"github.com/noshto/sep"
+)
+
+// Stage is a named step of the fiscalization pipeline
+type Stage string
+
+// Pipeline stages
+const (
+	StageGenerate Stage = "generate"
+	StageIIC      Stage = "iic"
+	StageSign     Stage = "sign"
+	StageRegister Stage = "register"
+	StageRender   Stage = "render"
+	StageArchive  Stage = "archive"
+	StageCleanup  Stage = "cleanup"
+)
+
+// Stages lists all pipeline stages in execution order
+var Stages = []Stage{
+	StageGenerate,
+	StageIIC,
+	StageSign,
+	StageRegister,
+	StageRender,
+	StageArchive,
+	StageCleanup,
+}
+
+// StageFunc implements a single stage for a document kind
+type StageFunc func(tx *Transaction) error
+
+// StageResult is the outcome of a single stage
+type StageResult struct {
+	Stage    Stage
+	Err      error
+	Duration time.Duration
+}
+
+// Hook observes a stage. Before hooks get a result without error, after
+// hooks get the actual outcome. A hook returning an error aborts the pipeline.
+type Hook func(tx *Transaction, res *StageResult) error
+
+// Files holds names of the intermediate files produced by the pipeline
+type Files struct {
+	Gen    string
+	IIC    string
+	Signed string
+	Reg    string
+	PDF    string
+}
+
+// Transaction is a single document passing through the pipeline
+type Transaction struct {
+	Dir        string
+	Simplified bool
+
+	GenFile    string
+	IICFile    string
+	SignedFile string
+	RegFile    string
+	PDFFile    string
+
+	// PDF is populated by the generate stage and completed by the render stage
+	PDF pdf.Params
+
+	IIC         string
+	FIC         string
+	FCDC        string
+	WTNIC       string
+	FWTNIC      string
+	Queued      bool
+	DeliveryErr error
+	TCRCode     string
+	Folder      string
+	PDFFilePath string
+
+	Journal *JournalEntry
+	Results []StageResult
+}
+
+// Result returns the recorded result of the given stage, if the stage ran
+func (tx *Transaction) Result(stage Stage) *StageResult {
+	for i := range tx.Results {
+		if tx.Results[i].Stage == stage {
+			return &tx.Results[i]
+		}
+	}
+	return nil
+}
+
+// Pipeline runs a document kind through the fiscalization stages.
+// Stages without implementation are skipped.
+type Pipeline struct {
+	Name   string
+	Files  Files
+	Stages map[Stage]StageFunc
+
+	before map[Stage][]Hook
+	after  map[Stage][]Hook
+}
+
+// NewPipeline creates an empty pipeline
+func NewPipeline(name string, files Files) *Pipeline {
+	return &Pipeline{
+		Name:   name,
+		Files:  files,
+		Stages: map[Stage]StageFunc{},
+		before: map[Stage][]Hook{},
+		after:  map[Stage][]Hook{},
+	}
+}
+
+// Before registers a hook called before the stage runs
+func (p *Pipeline) Before(stage Stage, hook Hook) *Pipeline {
+	p.before[stage] = append(p.before[stage], hook)
+	return p
+}
+
+// After registers a hook called after the stage ran, successfully or not
+func (p *Pipeline) After(stage Stage, hook Hook) *Pipeline {
+	p.after[stage] = append(p.after[stage], hook)
+	return p
+}
+
+// NewTransaction creates a transaction with its own workspace
+func (p *Pipeline) NewTransaction() (*Transaction, error) {
+	dir, err := newWorkspace()
+	if err != nil {
+		return nil, err
+	}
+	path := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Join(dir, name)
+	}
+	return &Transaction{
+		Dir:        dir,
+		GenFile:    path(p.Files.Gen),
+		IICFile:    path(p.Files.IIC),
+		SignedFile: path(p.Files.Signed),
+		RegFile:    path(p.Files.Reg),
+		PDFFile:    path(p.Files.PDF),
+	}, nil
+}
+
+// Run executes all implemented stages in order. Failure of the cleanup stage
+// is recorded but does not fail the transaction.
+func (p *Pipeline) Run(tx *Transaction) error {
+	return p.RunFrom(tx, Stages[0])
+}
+
+// RunFrom executes implemented stages in order, starting with the given one
+func (p *Pipeline) RunFrom(tx *Transaction, from Stage) error {
+	started := false
+	for _, stage := range Stages {
+		if stage == from {
+			started = true
+		}
+		if !started {
+			continue
+		}
+		fn, ok := p.Stages[stage]
+		if !ok || fn == nil {
+			continue
+		}
+		if lockedStages[stage] {
+			fn = lockedStage(fn)
+		}
+		if err := p.runStage(tx, stage, fn); err != nil {
+			if stage == StageCleanup {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// lockedStages write shared data and run under the data directory lock
+var lockedStages = map[Stage]bool{
+	StageArchive: true,
+}
+
+func lockedStage(fn StageFunc) StageFunc {
+	return func(tx *Transaction) error {
+		return withDataLock(func() error {
+			return fn(tx)
+		})
+	}
+}
+
+func (p *Pipeline) runStage(tx *Transaction, stage Stage, fn StageFunc) error {
+	for _, hook := range p.before[stage] {
+		if err := hook(tx, &StageResult{Stage: stage}); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	err := fn(tx)
+	tx.Results = append(tx.Results, StageResult{
+		Stage:    stage,
+		Err:      err,
+		Duration: time.Since(start),
+	})
+	res := &tx.Results[len(tx.Results)-1]
+
+	for _, hook := range p.after[stage] {
+		if hookErr := hook(tx, res); hookErr != nil && err == nil {
+			return hookErr
+		}
+	}
+	return err
+}
+
+// stageLabels are printed by the progress hook
+var stageLabels = map[Stage]string{
+	StageIIC:      "Generisanje JIKR",
+	StageSign:     "Generisanje DSIG",
+	StageRegister: "Registrovanje",
+	StageRender:   "Generisanje PDF",
+	StageArchive:  "Čuvanje rezultata",
+	StageCleanup:  "Čišćenje",
+}
+
+// withProgress attaches hooks printing the progress of every labeled stage
+func withProgress(p *Pipeline) *Pipeline {
+	for stage, label := range stageLabels {
+		label := label
+		p.Before(stage, func(tx *Transaction, res *StageResult) error {
+			fmt.Printf("%s: ", label)
+			return nil
+		})
+		p.After(stage, func(tx *Transaction, res *StageResult) error {
+			if res.Err != nil {
+				fmt.Println("NIJE USPEŠNO")
+				return nil
+			}
+			if res.Stage == StageRegister && tx.Queued {
+				fmt.Println("NAKNADNA DOSTAVA")
+				return nil
+			}
+			fmt.Println("OK")
+			return nil
+		})
+	}
+	return p
+}
+
+// writeIICStage computes the IIC of the generated request
+func writeIICStage(tx *Transaction) error {
+	signer, err := currentSigner()
+	if err != nil {
+		return err
+	}
+	if err := signer.WriteIIC(tx.GenFile, tx.IICFile); err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.IICFile); err != nil {
+		return err
+	}
+	invoice := doc.FindElement("//Invoice")
+	if invoice == nil {
+		return fmt.Errorf("invalid xml, no Invoice")
+	}
+	tx.IIC = invoice.SelectAttrValue("IIC", "")
+	tx.TCRCode = invoice.SelectAttrValue("TCRCode", "")
+	return nil
+}
+
+// signStage signs the document; invoices are signed after IIC, others right
+// after generation
+func signStage(tx *Transaction) error {
+	inFile := tx.IICFile
+	if inFile == "" {
+		inFile = tx.GenFile
+	}
+	signer, err := currentSigner()
+	if err != nil {
+		return err
+	}
+	return signer.Sign(inFile, tx.SignedFile)
+}
+
+// registerStage sends the signed document to the tax service, or to the
+// endpoint configured in settings.json. Documents signed with the SafeNet
+// token are sent by reg, others directly.
+func registerStage(tx *Transaction) error {
+	if AppSettings.Endpoint != "" || !isSafeNetSigner() {
+		if err := postSOAP(serviceEndpoint(), tx.SignedFile, tx.RegFile); err != nil {
+			return &DeliveryError{Err: err}
+		}
+		return nil
+	}
+	if err := reg.Register(&reg.Params{
+		SafenetConfig: SafenetConfig,
+		SepConfig:     SepConfig,
+		InFile:        tx.SignedFile,
+		OutFile:       tx.RegFile,
+	}); err != nil {
+		return &DeliveryError{Err: err}
+	}
+	return nil
+}
+
+// registerInvoiceStage registers an invoice and checks that a FIC was issued
+func registerInvoiceStage(tx *Transaction) error {
+	if err := registerStage(tx); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(tx.RegFile)
+	if err != nil {
+		return err
+	}
+	RegisterInvoiceResponse := sep.RegisterInvoiceResponse{}
+	if err := xml.Unmarshal(buf, &RegisterInvoiceResponse); err != nil {
+		return &DeliveryError{Err: fmt.Errorf("invalid response, %v", err)}
+	}
+	if RegisterInvoiceResponse.Body.RegisterInvoiceResponse.FIC == "" {
+		return responseError(buf)
+	}
+	tx.FIC = string(RegisterInvoiceResponse.Body.RegisterInvoiceResponse.FIC)
+	return nil
+}
+
+// renderInvoiceStage generates the invoice PDF
+func renderInvoiceStage(tx *Transaction) error {
+	params := tx.PDF
+	params.SepConfig = SepConfig
+	params.Clients = Clients
+	params.ReqFile = tx.SignedFile
+	params.RespFile = tx.RegFile
+	params.OutFile = tx.PDFFile
+	return pdf.GeneratePDF(&params)
+}
+
+// archiveInvoiceStage copies the results into the records folder
+func archiveInvoiceStage(tx *Transaction) error {
+	internalInvNum, err := json.Marshal(tx.PDF.InternalInvNum)
+	if err != nil {
+		return err
+	}
+	folder, pdfFilePath, err := save(tx.SignedFile, tx.RegFile, tx.PDFFile, &ArchiveMeta{InternalInvNum: internalInvNum})
+	if err != nil {
+		return err
+	}
+	tx.Folder = folder
+	tx.PDFFilePath = pdfFilePath
+	return nil
+}
+
+// cleanupStage removes all intermediate files and the transaction workspace
+func cleanupStage(tx *Transaction) error {
+	files := []string{}
+	for _, it := range []string{tx.GenFile, tx.IICFile, tx.SignedFile, tx.RegFile, tx.PDFFile} {
+		if it != "" {
+			files = append(files, it)
+		}
+	}
+	if err := clean(files...); err != nil {
+		return err
+	}
+	return removeWorkspace(tx.Dir)
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+	"github.com/noshto/gen"
+)
+
+// sha256DigestInfo is the DER prefix of a SHA-256 digest signed with
+// CKM_RSA_PKCS, which all tokens support unlike CKM_SHA256_RSA_PKCS
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// PKCS11Config is the content of pkcs11.json
+type PKCS11Config struct {
+	// Module is the path of the vendor PKCS#11 library
+	Module string `json:"module"`
+	// Slot is used when TokenLabel is empty; without both, the first token
+	// found is used
+	Slot       *uint  `json:"slot,omitempty"`
+	TokenLabel string `json:"token_label,omitempty"`
+	// KeyID selects the private key by its CKA_ID in hex, which unlike the
+	// label is unique on a token; KeyLabel is used without it, and without
+	// both the first key is used
+	KeyID    string `json:"key_id,omitempty"`
+	KeyLabel string `json:"key_label,omitempty"`
+	// Certificate selects the private key by its certificate in DER, e.g.
+	// the one another library signs with
+	Certificate []byte `json:"-"`
+	// PIN is kept in secrets.json
+	PIN string `json:"pin,omitempty"`
+}
+
+// PKCS11Signer signs with a key kept on any PKCS#11 token
+type PKCS11Signer struct {
+	xmlSigner
+
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	key     pkcs11.ObjectHandle
+}
+
+// TokenInfo describes a token found in a PKCS#11 module
+type TokenInfo struct {
+	Slot         uint              `json:"slot"`
+	Label        string            `json:"label"`
+	Manufacturer string            `json:"manufacturer"`
+	Model        string            `json:"model"`
+	Serial       string            `json:"serial"`
+	Certificates []CertificateInfo `json:"certificates"`
+}
+
+// CertificateInfo describes a certificate stored on a token
+type CertificateInfo struct {
+	Label    string `json:"label"`
+	ID       string `json:"id"`
+	Subject  string `json:"subject"`
+	Issuer   string `json:"issuer"`
+	NotAfter string `json:"not_after"`
+}
+
+// openPKCS11 loads and initializes a PKCS#11 module
+func openPKCS11(module string) (*pkcs11.Ctx, error) {
+	if module == "" {
+		return nil, fmt.Errorf("PKCS#11 module is not configured")
+	}
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("cannot load PKCS#11 module %s", module)
+	}
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func closePKCS11(ctx *pkcs11.Ctx) {
+	ctx.Finalize()
+	ctx.Destroy()
+}
+
+// findObjects returns handles of all objects matching template
+func findObjects(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	defer ctx.FindObjectsFinal(session)
+	handles := []pkcs11.ObjectHandle{}
+	for {
+		found, _, err := ctx.FindObjects(session, 16)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			return handles, nil
+		}
+		handles = append(handles, found...)
+	}
+}
+
+// objectAttributes returns the requested attributes of an object
+func objectAttributes(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, object pkcs11.ObjectHandle, types ...uint) (map[uint][]byte, error) {
+	template := []*pkcs11.Attribute{}
+	for _, it := range types {
+		template = append(template, pkcs11.NewAttribute(it, nil))
+	}
+	attrs, err := ctx.GetAttributeValue(session, object, template)
+	if err != nil {
+		return nil, err
+	}
+	values := map[uint][]byte{}
+	for _, it := range attrs {
+		values[it.Type] = it.Value
+	}
+	return values, nil
+}
+
+// listCertificates returns certificates visible in the session
+func listCertificates(ctx *pkcs11.Ctx, session pkcs11.SessionHandle) ([]CertificateInfo, error) {
+	handles, err := findObjects(ctx, session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+	})
+	if err != nil {
+		return nil, err
+	}
+	certificates := []CertificateInfo{}
+	for _, handle := range handles {
+		attrs, err := objectAttributes(ctx, session, handle, pkcs11.CKA_LABEL, pkcs11.CKA_ID, pkcs11.CKA_VALUE)
+		if err != nil {
+			return nil, err
+		}
+		info := CertificateInfo{
+			Label: string(attrs[pkcs11.CKA_LABEL]),
+			ID:    hex.EncodeToString(attrs[pkcs11.CKA_ID]),
+		}
+		if cert, err := x509.ParseCertificate(attrs[pkcs11.CKA_VALUE]); err == nil {
+			info.Subject = cert.Subject.String()
+			info.Issuer = cert.Issuer.String()
+			info.NotAfter = cert.NotAfter.Format("2006-01-02")
+		}
+		certificates = append(certificates, info)
+	}
+	return certificates, nil
+}
+
+// listTokens returns tokens present in a PKCS#11 module with their public
+// certificates
+func listTokens(module string) ([]TokenInfo, error) {
+	ctx, err := openPKCS11(module)
+	if err != nil {
+		return nil, err
+	}
+	defer closePKCS11(ctx)
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return nil, err
+	}
+	tokens := []TokenInfo{}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			return nil, err
+		}
+		token := TokenInfo{
+			Slot:         slot,
+			Label:        strings.TrimSpace(info.Label),
+			Manufacturer: strings.TrimSpace(info.ManufacturerID),
+			Model:        strings.TrimSpace(info.Model),
+			Serial:       strings.TrimSpace(info.SerialNumber),
+			Certificates: []CertificateInfo{},
+		}
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+		if err != nil {
+			return nil, err
+		}
+		token.Certificates, err = listCertificates(ctx, session)
+		ctx.CloseSession(session)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// findSlot returns the slot of the configured token
+func findSlot(ctx *pkcs11.Ctx, cfg *PKCS11Config) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		if cfg.TokenLabel != "" {
+			info, err := ctx.GetTokenInfo(slot)
+			if err != nil {
+				return 0, err
+			}
+			if strings.TrimSpace(info.Label) == cfg.TokenLabel {
+				return slot, nil
+			}
+			continue
+		}
+		if cfg.Slot == nil || *cfg.Slot == slot {
+			return slot, nil
+		}
+	}
+	if cfg.TokenLabel != "" {
+		return 0, fmt.Errorf("token %s not found", cfg.TokenLabel)
+	}
+	return 0, fmt.Errorf("token not found")
+}
+
+// NewPKCS11Signer logs into the configured token and finds the signing key
+// and its certificate
+func NewPKCS11Signer(cfg *PKCS11Config) (*PKCS11Signer, error) {
+	ctx, err := openPKCS11(cfg.Module)
+	if err != nil {
+		return nil, err
+	}
+	s := &PKCS11Signer{ctx: ctx}
+	if err := s.open(cfg); err != nil {
+		closePKCS11(ctx)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *PKCS11Signer) open(cfg *PKCS11Config) error {
+	slot, err := findSlot(s.ctx, cfg)
+	if err != nil {
+		return err
+	}
+	s.session, err = s.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return err
+	}
+	if err := s.ctx.Login(s.session, pkcs11.CKU_USER, cfg.PIN); err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+		return fmt.Errorf("login to token failed: %v", err)
+	}
+
+	template := []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY)}
+	key := cfg.KeyLabel
+	if cfg.Certificate != nil {
+		id, err := certificateID(s.ctx, s.session, cfg.Certificate)
+		if err != nil {
+			return err
+		}
+		key = hex.EncodeToString(id)
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	} else if cfg.KeyID != "" {
+		id, err := hex.DecodeString(cfg.KeyID)
+		if err != nil {
+			return fmt.Errorf("invalid key id %s", cfg.KeyID)
+		}
+		key = cfg.KeyID
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, id))
+	} else if cfg.KeyLabel != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, cfg.KeyLabel))
+	}
+	keys, err := findObjects(s.ctx, s.session, template)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("private key %s not found", key)
+	}
+	s.key = keys[0]
+
+	// the certificate shares ID of the key
+	attrs, err := objectAttributes(s.ctx, s.session, s.key, pkcs11.CKA_ID, pkcs11.CKA_LABEL)
+	if err != nil {
+		return err
+	}
+	template = []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE)}
+	if len(attrs[pkcs11.CKA_ID]) > 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[pkcs11.CKA_ID]))
+	} else {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, attrs[pkcs11.CKA_LABEL]))
+	}
+	certificates, err := findObjects(s.ctx, s.session, template)
+	if err != nil {
+		return err
+	}
+	if len(certificates) == 0 {
+		return fmt.Errorf("certificate of key %s not found", string(attrs[pkcs11.CKA_LABEL]))
+	}
+	attrs, err = objectAttributes(s.ctx, s.session, certificates[0], pkcs11.CKA_VALUE)
+	if err != nil {
+		return err
+	}
+	s.certificate, err = x509.ParseCertificate(attrs[pkcs11.CKA_VALUE])
+	if err != nil {
+		return err
+	}
+	s.sign = s.signOnToken
+	return nil
+}
+
+// certificateID returns the CKA_ID of a certificate stored on the token,
+// which its private key shares
+func certificateID(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, der []byte) ([]byte, error) {
+	certificates, err := findObjects(ctx, session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, der),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("certificate not found on token")
+	}
+	attrs, err := objectAttributes(ctx, session, certificates[0], pkcs11.CKA_ID)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs[pkcs11.CKA_ID]) == 0 {
+		return nil, fmt.Errorf("certificate has no id")
+	}
+	return attrs[pkcs11.CKA_ID], nil
+}
+
+// Close logs out of the token and unloads the module
+func (s *PKCS11Signer) Close() {
+	s.ctx.Logout(s.session)
+	s.ctx.CloseSession(s.session)
+	closePKCS11(s.ctx)
+}
+
+// signOnToken returns the RSA-SHA256 signature of data made by the token
+func (s *PKCS11Signer) signOnToken(data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
+	if err := s.ctx.SignInit(s.session, mechanism, s.key); err != nil {
+		return nil, err
+	}
+	return s.ctx.Sign(s.session, append(append([]byte{}, sha256DigestInfo...), sum[:]...))
+}
+
+func loadPKCS11Config() (*PKCS11Config, error) {
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("pkcs11.json"))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &PKCS11Config{}
+	if err := json.Unmarshal(buf, cfg); err != nil {
+		return nil, err
+	}
+	if pin := os.Getenv("FISC_PKCS11_PIN"); pin != "" {
+		cfg.PIN = pin
+		return cfg, nil
+	}
+
+	// PIN kept in clear text is moved to secrets.json
+	if cfg.PIN != "" {
+		if err := savePKCS11Config(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "PIN za token nije šifrovan: %v\n", err)
+		}
+		return cfg, nil
+	}
+	if cfg.PIN, err = getSecret(secretPKCS11PIN); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// savePKCS11Config stores PIN, if any, in secrets.json and the rest of the
+// config in pkcs11.json
+func savePKCS11Config(cfg *PKCS11Config) error {
+	if cfg.PIN != "" {
+		if err := setSecret(secretPKCS11PIN, cfg.PIN); err != nil {
+			return err
+		}
+	}
+	plain := *cfg
+	plain.PIN = ""
+	buf, err := json.MarshalIndent(&plain, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(currentWorkingDirectoryFilePath("pkcs11.json"), buf, 0600)
+}
+
+// setPKCS11Signer asks user for the module, token and key to sign with
+func setPKCS11Signer() error {
+	// listing tokens finalizes the module, ending the session of a loaded
+	// signer
+	setAppSigner(nil)
+	cfg := &PKCS11Config{
+		Module: gen.Scan("Unesite putanju do PKCS#11 biblioteke tokena: "),
+	}
+	tokens, err := listTokens(cfg.Module)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("nije pronađen nijedan token")
+	}
+
+	fmt.Println()
+	for i, it := range tokens {
+		fmt.Printf("[%d] %s (%s %s, %s)\n", i+1, it.Label, it.Manufacturer, it.Model, it.Serial)
+	}
+	token := tokens[0]
+	if len(tokens) > 1 {
+		n, err := strconv.Atoi(gen.Scan("Izaberite token: "))
+		if err != nil || n < 1 || n > len(tokens) {
+			return fmt.Errorf("pogrešan izbor")
+		}
+		token = tokens[n-1]
+	}
+	cfg.TokenLabel = token.Label
+
+	fmt.Println()
+	for i, it := range token.Certificates {
+		fmt.Printf("[%d] %s: %s, važi do %s\n", i+1, it.Label, it.Subject, it.NotAfter)
+	}
+	if len(token.Certificates) > 0 {
+		certificate := token.Certificates[0]
+		if len(token.Certificates) > 1 {
+			n, err := strconv.Atoi(gen.Scan("Izaberite sertifikat: "))
+			if err != nil || n < 1 || n > len(token.Certificates) {
+				return fmt.Errorf("pogrešan izbor")
+			}
+			certificate = token.Certificates[n-1]
+		}
+		cfg.KeyID, cfg.KeyLabel = certificate.ID, certificate.Label
+	}
+	cfg.PIN = gen.Scan("Unesite PIN za digitalni token: ")
+
+	signer, err := NewPKCS11Signer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := savePKCS11Config(cfg); err != nil {
+		return err
+	}
+	setAppSigner(signer)
+	return nil
+}
+
+func tokenListCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("token list")
+	module := fs.String("module", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	if *module == "" {
+		if cfg, err := loadPKCS11Config(); err == nil {
+			*module = cfg.Module
+		}
+	}
+	if *module == "" {
+		return nil, errUsage
+	}
+	return listTokens(*module)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/miekg/pkcs11"
+)
+
+// softHSMModules are where distributions install the SoftHSM library
+var softHSMModules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+const (
+	softHSMToken = "fisc"
+	softHSMPIN   = "1234"
+)
+
+// newSoftHSMToken initializes an empty SoftHSM token in a temporary folder
+// and returns the module, skipping the test when SoftHSM is not installed.
+// SOFTHSM2_MODULE overrides the library path.
+func newSoftHSMToken(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("softhsm2-util"); err != nil {
+		t.Skip("softhsm2-util is not installed")
+	}
+	module := os.Getenv("SOFTHSM2_MODULE")
+	for _, it := range softHSMModules {
+		if _, err := os.Stat(it); module == "" && err == nil {
+			module = it
+		}
+	}
+	if module == "" {
+		t.Skip("SoftHSM library is not installed")
+	}
+
+	dir := t.TempDir()
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0700); err != nil {
+		t.Fatal(err)
+	}
+	conf := filepath.Join(dir, "softhsm2.conf")
+	if err := ioutil.WriteFile(conf, []byte(fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\n", tokens)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	previous, set := os.LookupEnv("SOFTHSM2_CONF")
+	os.Setenv("SOFTHSM2_CONF", conf)
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("SOFTHSM2_CONF", previous)
+		} else {
+			os.Unsetenv("SOFTHSM2_CONF")
+		}
+	})
+	softHSMUtil(t, "--init-token", "--free", "--label", softHSMToken, "--pin", softHSMPIN, "--so-pin", "5678")
+	return module
+}
+
+func softHSMUtil(t *testing.T, args ...string) {
+	t.Helper()
+	if out, err := exec.Command("softhsm2-util", args...).CombinedOutput(); err != nil {
+		t.Fatalf("softhsm2-util %v: %v\n%s", args, err, out)
+	}
+}
+
+// importSoftHSMKey puts a new key with its certificate on the token under
+// label and id
+func importSoftHSMKey(t *testing.T, module, label string, id byte) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id)),
+		Subject:      pkix.Name{CommonName: fmt.Sprintf("Test %d", id)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	softHSMUtil(t, "--import", keyFile, "--token", softHSMToken, "--label", label, "--id", fmt.Sprintf("%02x", id), "--pin", softHSMPIN)
+
+	// softhsm2-util imports keys only, the certificate is created through
+	// the module
+	ctx, err := openPKCS11(module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closePKCS11(ctx)
+	slot, err := findSlot(ctx, &PKCS11Config{TokenLabel: softHSMToken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, softHSMPIN); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ctx.CreateObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte{id}),
+		pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, der),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPKCS11SignerSelectsKeyByID(t *testing.T) {
+	module := newSoftHSMToken(t)
+	// tokens issued for renewals keep the label of the old key
+	importSoftHSMKey(t, module, softHSMToken, 1)
+	cert := importSoftHSMKey(t, module, softHSMToken, 2)
+
+	signer, err := NewPKCS11Signer(&PKCS11Config{
+		Module:     module,
+		TokenLabel: softHSMToken,
+		KeyID:      "02",
+		KeyLabel:   softHSMToken,
+		PIN:        softHSMPIN,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.Close()
+	if !signer.certificate.Equal(cert) {
+		t.Fatalf("certificate %s, want %s", signer.certificate.Subject, cert.Subject)
+	}
+
+	data := []byte("12345678|2021-01-01T12:00:00+01:00|1|ab123ab123|cd123cd123|ef123ef123|12.10")
+	signature, err := signer.sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], signature); err != nil {
+		t.Fatalf("signature is not made by key 02: %v", err)
+	}
+}
+
+func TestPKCS11SignerSelectsKeyByCertificate(t *testing.T) {
+	module := newSoftHSMToken(t)
+	cert := importSoftHSMKey(t, module, softHSMToken, 1)
+	importSoftHSMKey(t, module, softHSMToken, 2)
+
+	// SafeNetSigner finds the key of the certificate dsig signs with
+	signer, err := NewPKCS11Signer(&PKCS11Config{
+		Module:      module,
+		TokenLabel:  softHSMToken,
+		PIN:         softHSMPIN,
+		Certificate: cert.Raw,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer signer.Close()
+	if !signer.certificate.Equal(cert) {
+		t.Fatalf("certificate %s, want %s", signer.certificate.Subject, cert.Subject)
+	}
+}
+
+func TestLoadSignerKeepsTokenSession(t *testing.T) {
+	module := newSoftHSMToken(t)
+	importSoftHSMKey(t, module, softHSMToken, 1)
+
+	WorkDir = t.TempDir()
+	resetProfileState()
+	defer resetProfileState()
+	AppSettings = &Settings{Signer: signerPKCS11}
+	if err := savePKCS11Config(&PKCS11Config{Module: module, TokenLabel: softHSMToken, KeyID: "01"}); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FISC_PKCS11_PIN", softHSMPIN)
+	defer os.Unsetenv("FISC_PKCS11_PIN")
+
+	if err := loadSigner(); err != nil {
+		t.Fatal(err)
+	}
+	first := AppSigner
+	if err := loadSigner(); err != nil {
+		t.Fatal(err)
+	}
+	if AppSigner != first {
+		t.Fatal("token was opened again for the second document")
+	}
+	if _, err := first.(*PKCS11Signer).sign([]byte("data")); err != nil {
+		t.Fatalf("session of the loaded signer was closed: %v", err)
+	}
+}
+
+func TestInvoicePipelineOnToken(t *testing.T) {
+	module := newSoftHSMToken(t)
+	cert := importSoftHSMKey(t, module, softHSMToken, 1)
+	newTestCompany(t)
+	AppSettings.Signer = signerPKCS11
+	signer, err := NewPKCS11Signer(&PKCS11Config{
+		Module:     module,
+		TokenLabel: softHSMToken,
+		KeyID:      "01",
+		PIN:        softHSMPIN,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAppSigner(signer)
+
+	tx, err := runTestPipeline(t, newTestInvoicePipeline(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := lookupInvoice(tx.IIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(absolutePath(entry.Request)); err != nil {
+		t.Fatal(err)
+	}
+	request := doc.Root()
+	signedBy, err := verifySignature(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signedBy.Equal(cert) {
+		t.Fatalf("request is signed by %s, want the token certificate %s", signedBy.Subject, cert.Subject)
+	}
+	if err := verifyIIC(findChild(request, "Invoice"), cert); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "syscall"
+
+// stillActive is the exit code of a process that has not exited
+const stillActive = 259
+
+// processAlive reports whether a process with the pid runs on this host
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err == syscall.ERROR_ACCESS_DENIED {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	defer syscall.CloseHandle(h)
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
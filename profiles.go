@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/noshto/dsig/pkg/safenet"
+	"github.com/noshto/gen"
+	"github.com/noshto/sep"
+)
+
+// profilesDir holds a folder per company profile. A profile folder has its
+// own config.json, clients, signer settings, secrets, TCRs and records,
+// the same files fisc keeps next to the executable without profiles.
+const profilesDir = "profiles"
+
+// BaseDir is the folder of the executable, WorkDir is the folder of the
+// profile in use
+var BaseDir = ""
+
+// ProfileName is the profile in use, empty for the company in BaseDir
+var ProfileName = ""
+
+// profileNamePattern keeps profile names usable as folder names
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+
+// Profile is a company fisc issues invoices for
+type Profile struct {
+	Name    string `json:"name"`
+	Dir     string `json:"dir"`
+	Company string `json:"company,omitempty"`
+	TIN     string `json:"tin,omitempty"`
+	Current bool   `json:"current"`
+}
+
+func profileDir(name string) string {
+	if name == "" {
+		return BaseDir
+	}
+	return filepath.Join(BaseDir, profilesDir, name)
+}
+
+func checkProfileName(name string) error {
+	if !profileNamePattern.MatchString(name) {
+		return fmt.Errorf("naziv profila %q nije dozvoljen, koristite slova, brojeve, - i _", name)
+	}
+	return nil
+}
+
+// readProfile describes the profile in the given folder
+func readProfile(name string) *Profile {
+	it := &Profile{
+		Name:    name,
+		Dir:     profileDir(name),
+		Current: name == ProfileName,
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(it.Dir, "config.json"))
+	if err != nil {
+		return it
+	}
+	cfg := &sep.Config{}
+	if err := json.Unmarshal(buf, cfg); err == nil {
+		it.Company, it.TIN = cfg.Name, cfg.TIN
+	}
+	return it
+}
+
+// listProfiles returns all profiles. The company in BaseDir is listed first
+// when it is configured.
+func listProfiles() ([]*Profile, error) {
+	profiles := []*Profile{}
+	if _, err := os.Stat(filepath.Join(BaseDir, "config.json")); err == nil {
+		profiles = append(profiles, readProfile(""))
+	}
+	dirs, err := ioutil.ReadDir(filepath.Join(BaseDir, profilesDir))
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range dirs {
+		if it.IsDir() && checkProfileName(it.Name()) == nil {
+			profiles = append(profiles, readProfile(it.Name()))
+		}
+	}
+	return profiles, nil
+}
+
+// addProfile creates the folder of a new profile; the company is registered
+// when the profile is used for the first time
+func addProfile(name string) (*Profile, error) {
+	if err := checkProfileName(name); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(BaseDir, profilesDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(profileDir(name), 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("profil %s već postoji", name)
+		}
+		return nil, err
+	}
+	return readProfile(name), nil
+}
+
+// useProfile makes the folder of the profile the working directory, so
+// nothing read or written afterwards belongs to another company
+func useProfile(name string) error {
+	if name != "" {
+		if err := checkProfileName(name); err != nil {
+			return err
+		}
+		if fi, err := os.Stat(profileDir(name)); err != nil || !fi.IsDir() {
+			return fmt.Errorf("profil %s ne postoji, dodajte ga sa fisc profile add %s", name, name)
+		}
+	}
+	resetProfileState()
+	ProfileName = name
+	WorkDir = profileDir(name)
+	if err := os.Chdir(WorkDir); err != nil {
+		return err
+	}
+	return loadSettings()
+}
+
+// resetProfileState forgets everything loaded for the previous profile
+func resetProfileState() {
+	setAppSigner(nil)
+	SepConfig = &sep.Config{}
+	SafenetConfig = &safenet.Config{}
+	Clients = &[]sep.Client{}
+	defaultTCR = nil
+	vault, vaultKey, vaultSecrets = nil, nil, nil
+}
+
+// printProfiles prints profiles as a numbered table
+func printProfiles(profiles []*Profile) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tPROFIL\tFIRMA\tPIB\t")
+	for i, it := range profiles {
+		name := it.Name
+		if name == "" {
+			name = "(osnovni)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t\n", i+1, name, it.Company, it.TIN)
+	}
+	w.Flush()
+}
+
+// chooseProfile asks which company to work for. Without profiles there is
+// nothing to choose unless always is set, which lets the user add the first
+// one.
+func chooseProfile(always bool) error {
+	profiles, err := listProfiles()
+	if err != nil {
+		return err
+	}
+	if !always && (len(profiles) == 0 || len(profiles) == 1 && profiles[0].Name == "") {
+		return nil
+	}
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("IZBOR PROFILA")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	printProfiles(profiles)
+	for {
+		stringValue := gen.Scan("Izaberite broj profila, n za novi profil: ")
+		if stringValue == "n" || stringValue == "N" {
+			it, err := addProfile(gen.Scan("Naziv profila: "))
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			return useProfile(it.Name)
+		}
+		index, err := strconv.Atoi(stringValue)
+		if err != nil || index < 1 || index > len(profiles) {
+			fmt.Println("Pogrešan broj")
+			continue
+		}
+		return useProfile(profiles[index-1].Name)
+	}
+}
+
+func profileListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	return listProfiles()
+}
+
+func profileAddCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	return addProfile(args[0])
+}
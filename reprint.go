@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/noshto/pdf"
+)
+
+// ArchiveMeta is kept next to an archived invoice as <name>_meta.json, with
+// what is needed to print the invoice again
+type ArchiveMeta struct {
+	InternalInvNum json.RawMessage `json:"internal_inv_num,omitempty"`
+	Copies         int             `json:"copies"`
+	PrintedAt      []time.Time     `json:"printed_at,omitempty"`
+	// Fault answered the subsequent delivery of an invoice registered
+	// before, whose FIC was lost with the first response
+	Fault string `json:"fault,omitempty"`
+}
+
+// archiveBase returns the path of an archived request without the
+// _request.xml suffix
+func archiveBase(requestFilePath string) string {
+	return strings.TrimSuffix(requestFilePath, "_request.xml")
+}
+
+func metaFilePath(requestFilePath string) string {
+	return archiveBase(requestFilePath) + "_meta.json"
+}
+
+// loadArchiveMeta reads the meta file of an archived invoice, an empty one
+// if the invoice was archived without it
+func loadArchiveMeta(requestFilePath string) (*ArchiveMeta, error) {
+	meta := &ArchiveMeta{}
+	buf, err := ioutil.ReadFile(metaFilePath(requestFilePath))
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func saveArchiveMeta(requestFilePath string, meta *ArchiveMeta) error {
+	buf, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(metaFilePath(requestFilePath), buf, 0644)
+}
+
+// ReprintOutput describes a reprinted invoice
+type ReprintOutput struct {
+	IIC    string `json:"iic"`
+	PDF    string `json:"pdf"`
+	Copy   bool   `json:"copy"`
+	Copies int    `json:"copies"`
+}
+
+// reprintInvoice generates the PDF of an archived invoice again. A copy is
+// marked "KOPIJA" and saved under its own name.
+func reprintInvoice(key string, markCopy bool) (*ReprintOutput, error) {
+	e, err := lookupInvoice(key)
+	if err != nil {
+		return nil, err
+	}
+	requestFilePath := absolutePath(e.Request)
+	meta, err := loadArchiveMeta(requestFilePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// the invoice shows company details as they were when it was issued
+	cfg, err := companyConfigAt(e.IssueDateTime)
+	if err != nil {
+		return nil, err
+	}
+	params := pdf.Params{
+		SepConfig: cfg,
+		Clients:   Clients,
+		ReqFile:   requestFilePath,
+		RespFile:  absolutePath(e.Response),
+	}
+	if len(meta.InternalInvNum) > 0 {
+		if err := json.Unmarshal(meta.InternalInvNum, &params.InternalInvNum); err != nil {
+			return nil, err
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "interni broj računa %s nije sačuvan u arhivi\n", e.IIC)
+	}
+
+	// archived files are sealed in the ledger, so the invoice is generated
+	// into a temporary file and copied next to fisc
+	tmp, err := ioutil.TempFile(WorkDir, "reprint-*.pdf")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	params.OutFile = tmp.Name()
+	if err := pdf.GeneratePDF(&params); err != nil {
+		return nil, err
+	}
+	if markCopy {
+		buf, err := ioutil.ReadFile(tmp.Name())
+		if err != nil {
+			return nil, err
+		}
+		if buf, err = stampCopyMark(buf); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(tmp.Name(), buf, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	// concurrent reprints of the same invoice must not get the same copy
+	// number, so the count is read again under the lock
+	var out *ReprintOutput
+	err = withDataLock(func() error {
+		meta, err := loadArchiveMeta(requestFilePath)
+		if err != nil {
+			return err
+		}
+		meta.Copies++
+		meta.PrintedAt = append(meta.PrintedAt, time.Now())
+		if err := saveArchiveMeta(requestFilePath, meta); err != nil {
+			return err
+		}
+
+		// like save, the printed invoice is put next to fisc
+		name := filepath.Base(archiveBase(requestFilePath)) + "_request"
+		if markCopy {
+			name = strings.Join([]string{filepath.Base(archiveBase(requestFilePath)), "kopija", strconv.Itoa(meta.Copies)}, "_")
+		}
+		out = &ReprintOutput{
+			IIC:    e.IIC,
+			PDF:    currentWorkingDirectoryFilePath(name + ".pdf"),
+			Copy:   markCopy,
+			Copies: meta.Copies,
+		}
+		if err := copyFile(tmp.Name(), out.PDF); err != nil {
+			return err
+		}
+
+		if err := indexInvoice(e.Day, requestFilePath, absolutePath(e.Response), absolutePath(e.PDF)); err != nil {
+			fmt.Fprintf(os.Stderr, "indeks nije ažuriran, pokrenite fisc invoices reindex: %v\n", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func invoicesReprintCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("invoices reprint")
+	markCopy := fs.Bool("copy", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return reprintInvoice(fs.Arg(0), *markCopy)
+}
@@ -0,0 +1,659 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/sep"
+)
+
+// schemaNamespace is the namespace of efi.tax.gov.me requests
+const schemaNamespace = "https://efi.tax.gov.me/fs/schema"
+
+// dateTimeLayout is the date time format expected by the tax service
+const dateTimeLayout = "2006-01-02T15:04:05-07:00"
+
+// cashPayMethods are payment methods making an invoice a cash invoice
+var cashPayMethods = map[string]bool{
+	"BANKNOTE": true,
+	"CARD":     true,
+	"CHECK":    true,
+	"SVOUCHER": true,
+	"COMPANY":  true,
+	"ORDER":    true,
+}
+
+// nonCashPayMethods are payment methods of non-cash invoices
+var nonCashPayMethods = map[string]bool{
+	"ADVANCE":   true,
+	"ACCOUNT":   true,
+	"FACTORING": true,
+	"OTHER":     true,
+}
+
+// InvoiceInput describes an invoice supplied without interactive prompts
+type InvoiceInput struct {
+	Kind       string `json:"kind,omitempty"`
+	Simplified bool   `json:"simplified,omitempty"`
+	// TCR is the code or label of the TCR issuing the invoice, the TCR of
+	// the session if empty
+	TCR           string      `json:"tcr,omitempty"`
+	OrdNum        uint64      `json:"ord_num"`
+	IssueDateTime string      `json:"issue_date_time,omitempty"`
+	ClientTIN     string      `json:"client_tin,omitempty"`
+	PayMethod     string      `json:"pay_method"`
+	PayDeadline   string      `json:"pay_deadline,omitempty"`
+	RefIIC        string      `json:"ref_iic,omitempty"`
+	RefIssueDate  string      `json:"ref_issue_date_time,omitempty"`
+	RefIICs       []IICRef    `json:"ref_iics,omitempty"`
+	Items         []ItemInput `json:"items"`
+}
+
+// IICRef references a previously fiscalized invoice
+type IICRef struct {
+	IIC           string `json:"iic"`
+	IssueDateTime string `json:"issue_date_time"`
+}
+
+// ItemInput is a single invoice line
+type ItemInput struct {
+	Name      string  `json:"name"`
+	Code      string  `json:"code,omitempty"`
+	Unit      string  `json:"unit,omitempty"`
+	Quantity  float64 `json:"quantity"`
+	UnitPrice float64 `json:"unit_price"`
+	Rebate    float64 `json:"rebate,omitempty"`
+	VATRate   float64 `json:"vat_rate"`
+}
+
+// loadInvoiceInput reads an InvoiceInput from a JSON file
+func loadInvoiceInput(filePath string) (*InvoiceInput, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	in := &InvoiceInput{}
+	if err := json.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// InvoiceKind returns the kind of invoice described by the input
+func (in *InvoiceInput) InvoiceKind() (InvoiceKind, error) {
+	switch strings.ToLower(in.Kind) {
+	case "", "regular":
+		return RegularInvoice, nil
+	case "corrective":
+		return CorrectiveInvoice, nil
+	case "summary":
+		return SummaryInvoice, nil
+	}
+	return 0, fmt.Errorf("unknown invoice kind %q", in.Kind)
+}
+
+// Validate checks the input against the configuration and client list
+func (in *InvoiceInput) Validate() error {
+	kind, err := in.InvoiceKind()
+	if err != nil {
+		return err
+	}
+	if in.OrdNum == 0 {
+		return fmt.Errorf("ord_num is required")
+	}
+	method := strings.ToUpper(in.PayMethod)
+	if !cashPayMethods[method] && !nonCashPayMethods[method] {
+		return fmt.Errorf("unknown pay_method %q", in.PayMethod)
+	}
+	if len(in.Items) == 0 {
+		return fmt.Errorf("invoice has no items")
+	}
+	for i, it := range in.Items {
+		if it.Name == "" {
+			return fmt.Errorf("item %d: name is required", i+1)
+		}
+		if it.Quantity == 0 {
+			return fmt.Errorf("item %d: quantity is required", i+1)
+		}
+	}
+	if in.ClientTIN != "" && findClient(in.ClientTIN) == nil {
+		return fmt.Errorf("unknown client %s", in.ClientTIN)
+	}
+	if !in.Simplified && in.ClientTIN == "" && !cashPayMethods[method] {
+		return fmt.Errorf("client_tin is required for non-cash invoices")
+	}
+	if kind == CorrectiveInvoice && (in.RefIIC == "" || in.RefIssueDate == "") {
+		return fmt.Errorf("corrective invoice requires ref_iic and ref_issue_date_time")
+	}
+	if kind == SummaryInvoice && len(in.RefIICs) == 0 {
+		return fmt.Errorf("summary invoice requires ref_iics")
+	}
+	return nil
+}
+
+// issueTime returns the issue date and time of the invoice, now if not given
+func (in *InvoiceInput) issueTime() (time.Time, error) {
+	if in.IssueDateTime == "" {
+		return time.Now(), nil
+	}
+	return time.Parse(time.RFC3339, in.IssueDateTime)
+}
+
+// invNum returns the number of an invoice issued on the TCR; ordinal numbers
+// start over every year
+func invNum(tcr *sep.TCR, ordNum uint64, issueDateTime time.Time) string {
+	return strings.Join([]string{
+		tcr.BusinUnitCode,
+		strconv.FormatUint(ordNum, 10),
+		strconv.Itoa(issueDateTime.Year()),
+		tcr.TCRCode,
+	}, "/")
+}
+
+// findClient returns the client with the given TIN, however it is spaced or
+// punctuated
+func findClient(TIN string) *sep.Client {
+	if Clients == nil {
+		return nil
+	}
+	for i := range *Clients {
+		if normalizeClientID((*Clients)[i].TIN) == normalizeClientID(TIN) {
+			return &(*Clients)[i]
+		}
+	}
+	return nil
+}
+
+// writeInvoiceRequest writes RegisterInvoiceRequest described by input
+func writeInvoiceRequest(in *InvoiceInput, outFile string) error {
+	if err := in.Validate(); err != nil {
+		return err
+	}
+	if SepConfig.TCR == nil {
+		return fmt.Errorf("TCR is not registered")
+	}
+	kind, _ := in.InvoiceKind()
+
+	issueDateTime, err := in.issueTime()
+	if err != nil {
+		return err
+	}
+	if err := checkTCR(SepConfig.TCR, issueDateTime); err != nil {
+		return err
+	}
+
+	doc, root := newRequestDocument("RegisterInvoiceRequest")
+	invoice := root.CreateElement("Invoice")
+
+	invType := "INVOICE"
+	if kind == CorrectiveInvoice {
+		invType = "CORRECTIVE"
+	} else if kind == SummaryInvoice {
+		invType = "SUMMARY"
+	}
+	method := strings.ToUpper(in.PayMethod)
+	typeOfInv := "NONCASH"
+	if cashPayMethods[method] {
+		typeOfInv = "CASH"
+	}
+
+	invoice.CreateAttr("InvType", invType)
+	invoice.CreateAttr("TypeOfInv", typeOfInv)
+	invoice.CreateAttr("IsSimplifiedInv", strconv.FormatBool(in.Simplified))
+	invoice.CreateAttr("IssueDateTime", issueDateTime.Format(dateTimeLayout))
+	invoice.CreateAttr("InvNum", invNum(SepConfig.TCR, in.OrdNum, issueDateTime))
+	invoice.CreateAttr("InvOrdNum", strconv.FormatUint(in.OrdNum, 10))
+	invoice.CreateAttr("TCRCode", SepConfig.TCR.TCRCode)
+	invoice.CreateAttr("IsIssuerInVAT", strconv.FormatBool(SepConfig.VAT != ""))
+	invoice.CreateAttr("IsReverseCharge", "false")
+	invoice.CreateAttr("OperatorCode", SepConfig.OperatorCode)
+	invoice.CreateAttr("BusinUnitCode", SepConfig.TCR.BusinUnitCode)
+	invoice.CreateAttr("SoftCode", SepConfig.TCR.SoftCode)
+	invoice.CreateAttr("IIC", "")
+	invoice.CreateAttr("IICSignature", "")
+	if in.PayDeadline != "" {
+		invoice.CreateAttr("PayDeadline", in.PayDeadline)
+	}
+
+	switch kind {
+	case CorrectiveInvoice:
+		corrective := invoice.CreateElement("CorrectiveInv")
+		corrective.CreateAttr("IICRef", in.RefIIC)
+		corrective.CreateAttr("IssueDateTime", in.RefIssueDate)
+		corrective.CreateAttr("Type", "CORRECTIVE")
+	case SummaryInvoice:
+		refs := invoice.CreateElement("SumInvIICRefs")
+		for _, it := range in.RefIICs {
+			ref := refs.CreateElement("SumInvIICRef")
+			ref.CreateAttr("IIC", it.IIC)
+			ref.CreateAttr("IssueDateTime", it.IssueDateTime)
+		}
+	}
+
+	payMethods := invoice.CreateElement("PayMethods")
+	payMethod := payMethods.CreateElement("PayMethod")
+
+	seller := invoice.CreateElement("Seller")
+	seller.CreateAttr("IDType", "TIN")
+	seller.CreateAttr("IDNum", SepConfig.TIN)
+	seller.CreateAttr("Name", SepConfig.Name)
+	seller.CreateAttr("Address", SepConfig.Address)
+	seller.CreateAttr("Town", SepConfig.Town)
+	seller.CreateAttr("Country", SepConfig.Country)
+
+	if client := findClient(in.ClientTIN); client != nil {
+		buyer := invoice.CreateElement("Buyer")
+		buyer.CreateAttr("IDType", "TIN")
+		buyer.CreateAttr("IDNum", client.TIN)
+		buyer.CreateAttr("Name", client.Name)
+		buyer.CreateAttr("Address", client.Address)
+		buyer.CreateAttr("Town", client.Town)
+		buyer.CreateAttr("Country", client.Country)
+	}
+
+	type sameTax struct {
+		num      int
+		priceBef float64
+		vatAmt   float64
+	}
+	sameTaxes := map[float64]*sameTax{}
+	vatRates := []float64{}
+
+	totPriceWoVAT, totVATAmt, totPrice := 0.0, 0.0, 0.0
+	items := invoice.CreateElement("Items")
+	for _, it := range in.Items {
+		unit := it.Unit
+		if unit == "" {
+			unit = "kom"
+		}
+		// the schema takes quantities with up to 3 decimals, and PB must be
+		// computed from the quantity sent
+		quantity := round3(it.Quantity)
+		pb := round2(it.UnitPrice * quantity * (1 - it.Rebate/100))
+		va := round2(pb * it.VATRate / 100)
+		pa := round2(pb + va)
+
+		item := items.CreateElement("I")
+		item.CreateAttr("N", it.Name)
+		if it.Code != "" {
+			item.CreateAttr("C", it.Code)
+		}
+		item.CreateAttr("U", unit)
+		item.CreateAttr("Q", formatQuantity(quantity))
+		item.CreateAttr("UPB", formatAmount(it.UnitPrice))
+		item.CreateAttr("UPA", formatAmount(round2(it.UnitPrice*(1+it.VATRate/100))))
+		item.CreateAttr("R", formatAmount(it.Rebate))
+		item.CreateAttr("RR", "true")
+		item.CreateAttr("PB", formatAmount(pb))
+		item.CreateAttr("VR", formatAmount(it.VATRate))
+		item.CreateAttr("VA", formatAmount(va))
+		item.CreateAttr("PA", formatAmount(pa))
+
+		tax, ok := sameTaxes[it.VATRate]
+		if !ok {
+			tax = &sameTax{}
+			sameTaxes[it.VATRate] = tax
+			vatRates = append(vatRates, it.VATRate)
+		}
+		tax.num++
+		tax.priceBef += pb
+		tax.vatAmt += va
+
+		totPriceWoVAT += pb
+		totVATAmt += va
+		totPrice += pa
+	}
+
+	if SepConfig.VAT != "" {
+		taxes := invoice.CreateElement("SameTaxes")
+		for _, rate := range vatRates {
+			tax := sameTaxes[rate]
+			elem := taxes.CreateElement("SameTax")
+			elem.CreateAttr("NumOfItems", strconv.Itoa(tax.num))
+			elem.CreateAttr("PriceBefVAT", formatAmount(round2(tax.priceBef)))
+			elem.CreateAttr("VATRate", formatAmount(rate))
+			elem.CreateAttr("VATAmt", formatAmount(round2(tax.vatAmt)))
+		}
+	}
+
+	payMethod.CreateAttr("Type", method)
+	payMethod.CreateAttr("Amt", formatAmount(round2(totPrice)))
+	invoice.CreateAttr("TotPriceWoVAT", formatAmount(round2(totPriceWoVAT)))
+	invoice.CreateAttr("TotVATAmt", formatAmount(round2(totVATAmt)))
+	invoice.CreateAttr("TotPrice", formatAmount(round2(totPrice)))
+
+	doc.Indent(2)
+	return doc.WriteToFile(outFile)
+}
+
+// TCRInput describes a TCR to register without interactive prompts
+type TCRInput struct {
+	BusinUnitCode  string
+	InternalID     string
+	SoftCode       string
+	MaintainerCode string
+	Type           string
+	ValidFrom      string
+	ValidTo        string
+}
+
+// writeTCRRequest writes RegisterTCRRequest described by input
+func writeTCRRequest(in *TCRInput, outFile string) error {
+	if in.BusinUnitCode == "" || in.SoftCode == "" || in.MaintainerCode == "" {
+		return fmt.Errorf("business unit, software and maintainer codes are required")
+	}
+	tcrType := in.Type
+	if tcrType == "" {
+		tcrType = "REGULAR"
+	}
+
+	doc, root := newRequestDocument("RegisterTCRRequest")
+	tcr := root.CreateElement("TCR")
+	tcr.CreateAttr("BusinUnitCode", in.BusinUnitCode)
+	tcr.CreateAttr("IssuerTIN", SepConfig.TIN)
+	tcr.CreateAttr("MaintainerCode", in.MaintainerCode)
+	tcr.CreateAttr("SoftCode", in.SoftCode)
+	if in.InternalID != "" {
+		tcr.CreateAttr("TCRIntID", in.InternalID)
+	}
+	tcr.CreateAttr("Type", tcrType)
+	if in.ValidFrom != "" {
+		tcr.CreateAttr("ValidFrom", in.ValidFrom)
+	}
+	if in.ValidTo != "" {
+		tcr.CreateAttr("ValidTo", in.ValidTo)
+	}
+
+	doc.Indent(2)
+	return doc.WriteToFile(outFile)
+}
+
+// Cash deposit operations
+const (
+	depositInitial  = "INITIAL"
+	depositWithdraw = "WITHDRAW"
+)
+
+// CashDepositInput describes a cash deposit or withdrawal on the TCR
+type CashDepositInput struct {
+	Operation      string
+	Amount         float64
+	ChangeDateTime string
+}
+
+// writeCashDepositRequest writes RegisterCashDepositRequest described by input
+func writeCashDepositRequest(in *CashDepositInput, outFile string) error {
+	operation := strings.ToUpper(in.Operation)
+	if operation != depositInitial && operation != depositWithdraw {
+		return fmt.Errorf("unknown operation %q", in.Operation)
+	}
+	if in.Amount < 0 {
+		return fmt.Errorf("amount must not be negative")
+	}
+	if SepConfig.TCR == nil {
+		return fmt.Errorf("TCR is not registered")
+	}
+	changeDateTime := time.Now()
+	if in.ChangeDateTime != "" {
+		t, err := time.Parse(time.RFC3339, in.ChangeDateTime)
+		if err != nil {
+			return err
+		}
+		changeDateTime = t
+	}
+	if err := checkTCR(SepConfig.TCR, changeDateTime); err != nil {
+		return err
+	}
+
+	doc, root := newRequestDocument("RegisterCashDepositRequest")
+	deposit := root.CreateElement("CashDeposit")
+	deposit.CreateAttr("ChangeDateTime", changeDateTime.Format(dateTimeLayout))
+	deposit.CreateAttr("Operation", operation)
+	deposit.CreateAttr("CashAmt", formatAmount(round2(in.Amount)))
+	deposit.CreateAttr("TCRCode", SepConfig.TCR.TCRCode)
+	deposit.CreateAttr("IssuerTIN", SepConfig.TIN)
+
+	doc.Indent(2)
+	return doc.WriteToFile(outFile)
+}
+
+// wtnPoints are the kinds of premises goods are transferred from or to
+var wtnPoints = map[string]bool{
+	"WAREHOUSE":               true,
+	"EXHIBITION":              true,
+	"STORE":                   true,
+	"SALE":                    true,
+	"ANOTHERPERSONSWAREHOUSE": true,
+	"CUSTOMSWAREHOUSE":        true,
+	"OTHER":                   true,
+}
+
+// WTNInput describes a warehouse transfer note
+type WTNInput struct {
+	OrdNum          uint64         `json:"ord_num"`
+	DateTimeCreated string         `json:"date_time_created,omitempty"`
+	Type            string         `json:"type,omitempty"`
+	GroupType       string         `json:"group_type,omitempty"`
+	TransDate       string         `json:"trans_date,omitempty"`
+	VehOwnership    string         `json:"veh_ownership,omitempty"`
+	VehPlates       string         `json:"veh_plates"`
+	StartAddr       string         `json:"start_addr"`
+	StartCity       string         `json:"start_city"`
+	StartPoint      string         `json:"start_point,omitempty"`
+	DestinAddr      string         `json:"destin_addr"`
+	DestinCity      string         `json:"destin_city"`
+	DestinPoint     string         `json:"destin_point,omitempty"`
+	Items           []WTNItemInput `json:"items"`
+}
+
+// WTNItemInput is a single line of a transfer note
+type WTNItemInput struct {
+	Name     string  `json:"name"`
+	Code     string  `json:"code,omitempty"`
+	Unit     string  `json:"unit,omitempty"`
+	Quantity float64 `json:"quantity"`
+}
+
+// loadWTNInput reads a WTNInput from a JSON file
+func loadWTNInput(filePath string) (*WTNInput, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	in := &WTNInput{}
+	if err := json.Unmarshal(buf, in); err != nil {
+		return nil, err
+	}
+	return in, nil
+}
+
+// Validate checks the input and fills in defaults
+func (in *WTNInput) Validate() error {
+	if in.OrdNum == 0 {
+		return fmt.Errorf("ord_num is required")
+	}
+	if in.Type == "" {
+		in.Type = "WTN"
+	}
+	if in.GroupType == "" {
+		in.GroupType = "OTHER"
+	}
+	if in.VehOwnership == "" {
+		in.VehOwnership = "OWNER"
+	}
+	if in.StartPoint == "" {
+		in.StartPoint = "WAREHOUSE"
+	}
+	if in.DestinPoint == "" {
+		in.DestinPoint = "STORE"
+	}
+	in.Type = strings.ToUpper(in.Type)
+	in.GroupType = strings.ToUpper(in.GroupType)
+	in.VehOwnership = strings.ToUpper(in.VehOwnership)
+	in.StartPoint = strings.ToUpper(in.StartPoint)
+	in.DestinPoint = strings.ToUpper(in.DestinPoint)
+	if in.Type != "WTN" && in.Type != "SALE" {
+		return fmt.Errorf("unknown type %q", in.Type)
+	}
+	if in.GroupType != "FUEL" && in.GroupType != "OTHER" {
+		return fmt.Errorf("unknown group_type %q", in.GroupType)
+	}
+	if in.VehOwnership != "OWNER" && in.VehOwnership != "THIRDPARTY" {
+		return fmt.Errorf("unknown veh_ownership %q", in.VehOwnership)
+	}
+	if !wtnPoints[in.StartPoint] {
+		return fmt.Errorf("unknown start_point %q", in.StartPoint)
+	}
+	if !wtnPoints[in.DestinPoint] {
+		return fmt.Errorf("unknown destin_point %q", in.DestinPoint)
+	}
+	if in.VehPlates == "" {
+		return fmt.Errorf("veh_plates is required")
+	}
+	if in.StartAddr == "" || in.StartCity == "" {
+		return fmt.Errorf("start_addr and start_city are required")
+	}
+	if in.DestinAddr == "" || in.DestinCity == "" {
+		return fmt.Errorf("destin_addr and destin_city are required")
+	}
+	if len(in.Items) == 0 {
+		return fmt.Errorf("transfer note has no items")
+	}
+	for i, it := range in.Items {
+		if it.Name == "" {
+			return fmt.Errorf("item %d: name is required", i+1)
+		}
+		if it.Quantity <= 0 {
+			return fmt.Errorf("item %d: quantity is required", i+1)
+		}
+	}
+	return nil
+}
+
+// writeWTNRequest writes RegisterWTNRequest described by input
+func writeWTNRequest(in *WTNInput, outFile string) error {
+	if err := in.Validate(); err != nil {
+		return err
+	}
+	if SepConfig.TCR == nil {
+		return fmt.Errorf("TCR is not registered")
+	}
+
+	dateTimeCreated := time.Now()
+	if in.DateTimeCreated != "" {
+		t, err := time.Parse(time.RFC3339, in.DateTimeCreated)
+		if err != nil {
+			return err
+		}
+		dateTimeCreated = t
+	}
+	transDate := dateTimeCreated
+	if in.TransDate != "" {
+		t, err := time.Parse("2006-01-02", in.TransDate)
+		if err != nil {
+			return err
+		}
+		transDate = t
+	}
+
+	doc, root := newRequestDocument("RegisterWTNRequest")
+	wtn := root.CreateElement("WTN")
+	wtn.CreateAttr("WTNType", in.Type)
+	wtn.CreateAttr("GroupType", in.GroupType)
+	wtn.CreateAttr("TransDate", transDate.Format("2006-01-02"))
+	wtn.CreateAttr("DateTimeCreated", dateTimeCreated.Format(dateTimeLayout))
+	wtn.CreateAttr("WTNNum", strings.Join([]string{
+		SepConfig.TCR.BusinUnitCode,
+		strconv.FormatUint(in.OrdNum, 10),
+		strconv.Itoa(dateTimeCreated.Year()),
+	}, "/"))
+	wtn.CreateAttr("WTNOrdNum", strconv.FormatUint(in.OrdNum, 10))
+	wtn.CreateAttr("BusinUnitCode", SepConfig.TCR.BusinUnitCode)
+	wtn.CreateAttr("SoftCode", SepConfig.TCR.SoftCode)
+	wtn.CreateAttr("OperatorCode", SepConfig.OperatorCode)
+	wtn.CreateAttr("VehOwnership", in.VehOwnership)
+	wtn.CreateAttr("VehPlates", in.VehPlates)
+	wtn.CreateAttr("StartAddr", in.StartAddr)
+	wtn.CreateAttr("StartCity", in.StartCity)
+	wtn.CreateAttr("StartPoint", in.StartPoint)
+	wtn.CreateAttr("DestinAddr", in.DestinAddr)
+	wtn.CreateAttr("DestinCity", in.DestinCity)
+	wtn.CreateAttr("DestinPoint", in.DestinPoint)
+	wtn.CreateAttr("ItemsNum", strconv.Itoa(len(in.Items)))
+	wtn.CreateAttr("IsAfterDel", "false")
+
+	issuer := wtn.CreateElement("Issuer")
+	issuer.CreateAttr("IDType", "TIN")
+	issuer.CreateAttr("IDNum", SepConfig.TIN)
+	issuer.CreateAttr("Name", SepConfig.Name)
+	issuer.CreateAttr("Address", SepConfig.Address)
+	issuer.CreateAttr("Town", SepConfig.Town)
+	issuer.CreateAttr("Country", SepConfig.Country)
+
+	items := wtn.CreateElement("Items")
+	for _, it := range in.Items {
+		unit := it.Unit
+		if unit == "" {
+			unit = "kom"
+		}
+		item := items.CreateElement("I")
+		item.CreateAttr("N", it.Name)
+		if it.Code != "" {
+			item.CreateAttr("C", it.Code)
+		}
+		item.CreateAttr("U", unit)
+		item.CreateAttr("Q", formatQuantity(round3(it.Quantity)))
+	}
+
+	doc.Indent(2)
+	return doc.WriteToFile(outFile)
+}
+
+// newRequestDocument creates a request document with a filled in Header
+func newRequestDocument(name string) (*etree.Document, *etree.Element) {
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := doc.CreateElement(name)
+	root.CreateAttr("xmlns", schemaNamespace)
+	root.CreateAttr("Id", "Request")
+	root.CreateAttr("Version", "1")
+	header := root.CreateElement("Header")
+	header.CreateAttr("SendDateTime", time.Now().Format(dateTimeLayout))
+	header.CreateAttr("UUID", newUUID())
+	return doc, root
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func round2(value float64) float64 {
+	return math.Round(value*100) / 100
+}
+
+func formatAmount(value float64) string {
+	return strconv.FormatFloat(value, 'f', 2, 64)
+}
+
+func round3(value float64) float64 {
+	return math.Round(value*1000) / 1000
+}
+
+// formatQuantity formats a quantity with 2 decimals, or 3 if it has them
+func formatQuantity(value float64) string {
+	return strings.TrimSuffix(strconv.FormatFloat(value, 'f', 3, 64), "0")
+}
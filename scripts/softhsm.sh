@@ -0,0 +1,68 @@
+#!/bin/sh
+# Runs the fisc pipeline against a SoftHSM token and simulate-server: a key
+# and certificate are put on a fresh token, then a TCR and an invoice are
+# registered with the pkcs11 signer.
+#
+# usage: scripts/softhsm.sh <folder with config.json and clients.json>
+#
+# Requires softhsm2, opensc (pkcs11-tool) and openssl. SOFTHSM_MODULE sets the
+# SoftHSM library path.
+set -eu
+
+if [ $# -ne 1 ]; then
+	echo "usage: $0 <folder with config.json and clients.json>" >&2
+	exit 2
+fi
+
+MODULE=${SOFTHSM_MODULE:-/usr/lib/softhsm/libsofthsm2.so}
+PIN=123456
+LISTEN=127.0.0.1:18080
+SRC=$(cd "$(dirname "$0")/.." && pwd)
+WORK=$(mktemp -d)
+SERVER=
+trap '[ -n "$SERVER" ] && kill $SERVER; rm -rf "$WORK"' EXIT
+
+# token with a self-signed certificate
+mkdir "$WORK/tokens"
+cat > "$WORK/softhsm2.conf" <<EOF
+directories.tokendir = $WORK/tokens
+objectstore.backend = file
+EOF
+export SOFTHSM2_CONF="$WORK/softhsm2.conf"
+softhsm2-util --init-token --free --label fisc --pin $PIN --so-pin $PIN
+openssl req -x509 -newkey rsa:2048 -nodes -days 30 -subj "/CN=fisc softhsm" \
+	-keyout "$WORK/key.pem" -out "$WORK/cert.pem" 2>/dev/null
+openssl pkcs8 -topk8 -nocrypt -in "$WORK/key.pem" -out "$WORK/key.p8"
+openssl x509 -in "$WORK/cert.pem" -outform der -out "$WORK/cert.der"
+softhsm2-util --import "$WORK/key.p8" --token fisc --label fisc --id 01 --pin $PIN
+pkcs11-tool --module "$MODULE" --token-label fisc --login --pin $PIN \
+	--write-object "$WORK/cert.der" --type cert --id 01 --label fisc
+
+# fisc keeps its data next to the binary
+mkdir "$WORK/fisc"
+FISC="$WORK/fisc/fisc"
+(cd "$SRC" && go build -o "$FISC" .)
+cp "$1/config.json" "$1/clients.json" "$WORK/fisc/"
+
+"$FISC" simulate-server --listen $LISTEN 2>"$WORK/server.log" &
+SERVER=$!
+sleep 1
+
+export FISC_PKCS11_PIN=$PIN
+"$FISC" token list --module "$MODULE"
+"$FISC" settings set --endpoint http://$LISTEN/ --signer pkcs11 \
+	--pkcs11-module "$MODULE" --pkcs11-token fisc --pkcs11-key fisc
+"$FISC" tcr register --busin-unit ab123ab123 --soft-code cd123cd123 --maintainer-code ef123ef123
+
+cat > "$WORK/invoice.json" <<EOF
+{
+	"ord_num": 1,
+	"pay_method": "BANKNOTE",
+	"items": [
+		{"name": "Test", "quantity": 1, "unit_price": 10, "vat_rate": 21}
+	]
+}
+EOF
+"$FISC" invoice register --input "$WORK/invoice.json"
+
+cat "$WORK/server.log"
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/noshto/gen"
+	bolt "go.etcd.io/bbolt"
+)
+
+// InvoiceFilter selects archived invoices, empty fields match any invoice
+type InvoiceFilter struct {
+	From time.Time
+	To   time.Time
+	// Client is the buyer TIN or a part of the buyer name
+	Client string
+	// IIC and FIC match by prefix
+	IIC string
+	FIC string
+	// MinAmount and MaxAmount bound the total price, ignored if negative
+	MinAmount float64
+	MaxAmount float64
+	// TCR is the code of the TCR that issued the invoice
+	TCR string
+	// InvType matches INVOICE, CORRECTIVE, SUMMARY, CASH or NONCASH
+	InvType   string
+	PayMethod string
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+func (f *InvoiceFilter) match(e *IndexEntry) bool {
+	issueDate := e.IssueDateTime.Format("2006-01-02")
+	if !f.From.IsZero() && issueDate < f.From.Format("2006-01-02") {
+		return false
+	}
+	if !f.To.IsZero() && issueDate > f.To.Format("2006-01-02") {
+		return false
+	}
+	if f.Client != "" && e.BuyerTIN != f.Client && !strings.Contains(strings.ToLower(e.BuyerName), strings.ToLower(f.Client)) {
+		return false
+	}
+	if f.TCR != "" && e.TCRCode != f.TCR {
+		return false
+	}
+	if !hasPrefixFold(e.IIC, f.IIC) || !hasPrefixFold(e.FIC, f.FIC) {
+		return false
+	}
+	if f.MinAmount >= 0 && e.TotPrice < f.MinAmount {
+		return false
+	}
+	if f.MaxAmount >= 0 && e.TotPrice > f.MaxAmount {
+		return false
+	}
+	if f.InvType != "" && !strings.EqualFold(e.InvType, f.InvType) && !strings.EqualFold(e.TypeOfInv, f.InvType) {
+		return false
+	}
+	if f.PayMethod != "" {
+		for _, it := range e.PayMethods {
+			if strings.EqualFold(it, f.PayMethod) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// searchInvoices returns the archived invoices matching f, oldest first
+func searchInvoices(f *InvoiceFilter) ([]*IndexEntry, error) {
+	entries := []*IndexEntry{}
+	err := withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(invoicesBucket).ForEach(func(k, v []byte) error {
+				e, err := getIndexEntry(tx, string(k))
+				if err != nil {
+					return err
+				}
+				if f.match(e) {
+					entries = append(entries, e.withAbsolutePaths())
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].IssueDateTime.Before(entries[j].IssueDateTime)
+	})
+	return entries, nil
+}
+
+// withAbsolutePaths returns a copy of e with paths that can be opened from
+// anywhere
+func (e *IndexEntry) withAbsolutePaths() *IndexEntry {
+	it := *e
+	it.Request = absolutePath(e.Request)
+	it.Response = absolutePath(e.Response)
+	it.PDF = absolutePath(e.PDF)
+	return &it
+}
+
+// printInvoices prints invoices as a numbered table
+func printInvoices(entries []*IndexEntry) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tDATUM\tBROJ\tKLIJENT\tIZNOS\tVRSTA\tPLAĆANJE\tIKOF")
+	for i, e := range entries {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%.02f\t%s\t%s\t%s\n",
+			i+1,
+			e.IssueDateTime.Format("2006-01-02 15:04"),
+			e.InvNum,
+			e.BuyerName,
+			e.TotPrice,
+			e.InvType,
+			strings.Join(e.PayMethods, ","),
+			e.IIC,
+		)
+	}
+	w.Flush()
+}
+
+// openFile opens path in the default application of the system
+func openFile(path string) error {
+	if path == "" {
+		return fmt.Errorf("fajl ne postoji")
+	}
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("cmd", "/c", "start", "", path)
+	case "darwin":
+		cmd = exec.Command("open", path)
+	default:
+		cmd = exec.Command("xdg-open", path)
+	}
+	return cmd.Start()
+}
+
+// scanDate reads an optional date in yyyy-MM-dd format
+func scanDate(prompt string) (time.Time, error) {
+	stringValue := gen.Scan(prompt)
+	if stringValue == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", stringValue)
+}
+
+// scanAmount reads an optional amount, -1 if none is given
+func scanAmount(prompt string) (float64, error) {
+	stringValue := gen.Scan(prompt)
+	if stringValue == "" {
+		return -1, nil
+	}
+	return strconv.ParseFloat(stringValue, 64)
+}
+
+func searchInvoicesMenu() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("PRETRAGA RAČUNA")
+	fmt.Println()
+	fmt.Println("Ostavite prazno polje da biste ga preskočili")
+	fmt.Println("---------------------------------------------------------------")
+
+	f := &InvoiceFilter{}
+	var err error
+	if f.From, err = scanDate("Datum od (u formati yyyy-MM-dd): "); err != nil {
+		return err
+	}
+	if f.To, err = scanDate("Datum do (u formati yyyy-MM-dd): "); err != nil {
+		return err
+	}
+	f.Client = gen.Scan("PIB ili naziv klijenta: ")
+	f.IIC = gen.Scan("IKOF: ")
+	f.FIC = gen.Scan("JIKR: ")
+	if f.MinAmount, err = scanAmount("Iznos od: "); err != nil {
+		return err
+	}
+	if f.MaxAmount, err = scanAmount("Iznos do: "); err != nil {
+		return err
+	}
+	f.InvType = gen.Scan("Vrsta računa (INVOICE, CORRECTIVE, SUMMARY, CASH, NONCASH): ")
+	f.PayMethod = gen.Scan("Način plaćanja (BANKNOTE, CARD, ACCOUNT, ...): ")
+	f.TCR = tcrCode(gen.Scan("ENU (kôd ili naziv): "))
+
+	entries, err := searchInvoices(f)
+	if err != nil {
+		return err
+	}
+	fmt.Println("---------------------------------------------------------------")
+	if len(entries) == 0 {
+		fmt.Println("Nema računa")
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+		return nil
+	}
+	printInvoices(entries)
+
+	for {
+		fmt.Println()
+		stringValue := gen.Scan("Izaberite broj računa da biste ga otvorili, prazno za izlaz: ")
+		if stringValue == "" {
+			return nil
+		}
+		index, err := strconv.Atoi(stringValue)
+		if err != nil || index < 1 || index > len(entries) {
+			fmt.Println("Pogrešan broj")
+			continue
+		}
+		e := entries[index-1]
+		fmt.Println("[1] PDF")
+		fmt.Println("[2] XML zahtjeva")
+		fmt.Println("[3] XML odgovora")
+		fmt.Println("[4] Ponovna štampa")
+		path := e.PDF
+		switch gen.Scan("Otvori: ") {
+		case "2":
+			path = e.Request
+		case "3":
+			path = e.Response
+		case "4":
+			fmt.Println("Označi kao KOPIJA")
+			fmt.Println("[1] Da")
+			fmt.Println("[2] Ne")
+			out, err := reprintInvoice(e.IIC, gen.Scan("Kopija: ") == "1")
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			fmt.Printf("PDF fajl sačuvan u %s, štampano kopija: %d\n", out.PDF, out.Copies)
+			path = out.PDF
+		}
+		if err := openFile(path); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// parseInvoiceFilter parses the filter flags of invoices list and search
+func parseInvoiceFilter(fs *flag.FlagSet, args []string) (*InvoiceFilter, error) {
+	from := fs.String("from", "", "")
+	to := fs.String("to", "", "")
+	f := &InvoiceFilter{}
+	fs.StringVar(&f.Client, "client", "", "")
+	fs.StringVar(&f.IIC, "iic", "", "")
+	fs.StringVar(&f.FIC, "fic", "", "")
+	fs.Float64Var(&f.MinAmount, "min", -1, "")
+	fs.Float64Var(&f.MaxAmount, "max", -1, "")
+	fs.StringVar(&f.InvType, "type", "", "")
+	fs.StringVar(&f.PayMethod, "pay-method", "", "")
+	tcr := fs.String("tcr", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	f.TCR = tcrCode(*tcr)
+	var err error
+	if *from != "" {
+		if f.From, err = time.Parse("2006-01-02", *from); err != nil {
+			return nil, err
+		}
+	}
+	if *to != "" {
+		if f.To, err = time.Parse("2006-01-02", *to); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func invoicesListCommand(args []string) (interface{}, error) {
+	f, err := parseInvoiceFilter(newFlagSet("invoices list"), args)
+	if err != nil {
+		return nil, err
+	}
+	return searchInvoices(f)
+}
+
+// invoicesSearchCommand is invoices list that requires at least one filter
+func invoicesSearchCommand(args []string) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	return invoicesListCommand(args)
+}
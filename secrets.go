@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/noshto/gen"
+	"golang.org/x/crypto/scrypt"
+)
+
+// secretsFileName is the encrypted secrets store
+const secretsFileName = "secrets.json"
+
+// Names of stored secrets
+const (
+	secretSafeNetPIN     = "safenet_pin"
+	secretPKCS11PIN      = "pkcs11_pin"
+	secretPKCS12Password = "pkcs12_password"
+)
+
+// Sources of the vault master key
+const (
+	vaultPassphrase = "passphrase"
+	vaultKeyFile    = "keyfile"
+)
+
+// scrypt parameters of new vaults
+const (
+	scryptN = 32768
+	scryptR = 8
+	scryptP = 1
+)
+
+// Interactive is set when fisc runs the menu, so the master passphrase can
+// be asked for
+var Interactive = false
+
+// Vault is the content of secrets.json: secrets encrypted with AES-256-GCM
+// under a key derived by scrypt from a passphrase or the content of a key
+// file
+type Vault struct {
+	Key        string `json:"key"`
+	KeyFile    string `json:"key_file,omitempty"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// the vault is unlocked once per session
+var (
+	vault        *Vault
+	vaultKey     []byte
+	vaultSecrets map[string]string
+)
+
+func loadVault() (*Vault, error) {
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath(secretsFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	v := &Vault{}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// masterSecret returns the passphrase or key file content the vault key is
+// derived from. FISC_KEY_FILE and FISC_PASSPHRASE are used without
+// prompting.
+func masterSecret(v *Vault, isNew bool) ([]byte, error) {
+	if v.Key == vaultKeyFile {
+		keyFile := v.KeyFile
+		if it := os.Getenv("FISC_KEY_FILE"); it != "" {
+			keyFile = it
+		}
+		return ioutil.ReadFile(keyFile)
+	}
+	if it := os.Getenv("FISC_PASSPHRASE"); it != "" {
+		return []byte(it), nil
+	}
+	if !Interactive {
+		return nil, fmt.Errorf("%s je šifrovan, zadajte FISC_PASSPHRASE ili FISC_KEY_FILE", secretsFileName)
+	}
+	passphrase := gen.Scan("Unesite lozinku za šifrovane podatke: ")
+	if passphrase == "" {
+		return nil, fmt.Errorf("lozinka nije zadata")
+	}
+	if isNew && gen.Scan("Ponovite lozinku: ") != passphrase {
+		return nil, fmt.Errorf("lozinke se ne poklapaju")
+	}
+	return []byte(passphrase), nil
+}
+
+func deriveVaultKey(v *Vault, secret []byte) ([]byte, error) {
+	return scrypt.Key(secret, v.Salt, v.N, v.R, v.P, 32)
+}
+
+// newVault creates an empty vault header with a fresh salt
+func newVault(key, keyFile string) (*Vault, error) {
+	v := &Vault{Key: key, KeyFile: keyFile, Salt: make([]byte, 16), N: scryptN, R: scryptR, P: scryptP}
+	if _, err := rand.Read(v.Salt); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// openVault decrypts secrets.json, asking for the passphrase if needed; a
+// missing file is an empty vault
+func openVault() error {
+	if vaultSecrets != nil {
+		return nil
+	}
+	v, err := loadVault()
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		vaultSecrets = map[string]string{}
+		return nil
+	}
+	secret, err := masterSecret(v, false)
+	if err != nil {
+		return err
+	}
+	key, err := deriveVaultKey(v, secret)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	buf, err := gcm.Open(nil, v.Nonce, v.Ciphertext, nil)
+	if err != nil {
+		return fmt.Errorf("pogrešna lozinka za %s", secretsFileName)
+	}
+	secrets := map[string]string{}
+	if err := json.Unmarshal(buf, &secrets); err != nil {
+		return err
+	}
+	vault, vaultKey, vaultSecrets = v, key, secrets
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// saveVault encrypts the secrets into secrets.json. A new vault uses
+// FISC_KEY_FILE if it is set, a passphrase otherwise.
+func saveVault() error {
+	if vault == nil {
+		var err error
+		if keyFile := os.Getenv("FISC_KEY_FILE"); keyFile != "" {
+			vault, err = newVault(vaultKeyFile, keyFile)
+		} else {
+			vault, err = newVault(vaultPassphrase, "")
+		}
+		if err != nil {
+			return err
+		}
+		secret, err := masterSecret(vault, true)
+		if err == nil {
+			vaultKey, err = deriveVaultKey(vault, secret)
+		}
+		if err != nil {
+			vault = nil
+			return err
+		}
+	}
+
+	buf, err := json.Marshal(vaultSecrets)
+	if err != nil {
+		return err
+	}
+	gcm, err := newGCM(vaultKey)
+	if err != nil {
+		return err
+	}
+	vault.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(vault.Nonce); err != nil {
+		return err
+	}
+	vault.Ciphertext = gcm.Seal(nil, vault.Nonce, buf, nil)
+
+	buf, err = json.MarshalIndent(vault, "", "\t")
+	if err != nil {
+		return err
+	}
+	return withDataLock(func() error {
+		return ioutil.WriteFile(currentWorkingDirectoryFilePath(secretsFileName), buf, 0600)
+	})
+}
+
+// getSecret returns a stored secret, empty if there is none
+func getSecret(name string) (string, error) {
+	if err := openVault(); err != nil {
+		return "", err
+	}
+	return vaultSecrets[name], nil
+}
+
+// setSecret stores a secret
+func setSecret(name, value string) error {
+	if err := openVault(); err != nil {
+		return err
+	}
+	vaultSecrets[name] = value
+	return saveVault()
+}
+
+// rotateVault re-encrypts the secrets with a new passphrase, or with a key
+// file that is generated if it does not exist
+func rotateVault(keyFile, passphrase string) error {
+	if err := openVault(); err != nil {
+		return err
+	}
+	v, err := newVault(vaultPassphrase, "")
+	if keyFile != "" {
+		v, err = newVault(vaultKeyFile, keyFile)
+	}
+	if err != nil {
+		return err
+	}
+
+	secret := []byte(passphrase)
+	if keyFile != "" {
+		if _, err := os.Stat(keyFile); os.IsNotExist(err) {
+			buf := make([]byte, 32)
+			if _, err := rand.Read(buf); err != nil {
+				return err
+			}
+			if err := ioutil.WriteFile(keyFile, buf, 0600); err != nil {
+				return err
+			}
+		}
+		if secret, err = ioutil.ReadFile(keyFile); err != nil {
+			return err
+		}
+	}
+	if len(secret) == 0 {
+		return fmt.Errorf("lozinka nije zadata")
+	}
+	key, err := deriveVaultKey(v, secret)
+	if err != nil {
+		return err
+	}
+	vault, vaultKey = v, key
+	return saveVault()
+}
+
+// wipeSecrets removes a stored secret, or all of them with secrets.json when
+// name is empty
+func wipeSecrets(name string) error {
+	if name == "" {
+		vault, vaultKey, vaultSecrets = nil, nil, nil
+		return withDataLock(func() error {
+			err := os.Remove(currentWorkingDirectoryFilePath(secretsFileName))
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		})
+	}
+	if err := openVault(); err != nil {
+		return err
+	}
+	if _, ok := vaultSecrets[name]; !ok {
+		return fmt.Errorf("unknown secret %s", name)
+	}
+	delete(vaultSecrets, name)
+	return saveVault()
+}
+
+// SecretsOutput describes the vault without revealing secrets
+type SecretsOutput struct {
+	Key     string   `json:"key,omitempty"`
+	KeyFile string   `json:"key_file,omitempty"`
+	Secrets []string `json:"secrets"`
+}
+
+func secretsOutput() *SecretsOutput {
+	out := &SecretsOutput{Secrets: []string{}}
+	if vault != nil {
+		out.Key = vault.Key
+		out.KeyFile = vault.KeyFile
+	}
+	for name := range vaultSecrets {
+		out.Secrets = append(out.Secrets, name)
+	}
+	sort.Strings(out.Secrets)
+	return out
+}
+
+func secretsListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := openVault(); err != nil {
+		return nil, err
+	}
+	return secretsOutput(), nil
+}
+
+// secretsSetCommand stores a secret read from the first line of stdin, so it
+// does not end up in shell history
+func secretsSetCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("secrets set")
+	name := fs.String("name", "", "")
+	if err := fs.Parse(args); err != nil || *name == "" || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	value = strings.TrimRight(value, "\r\n")
+	if value == "" {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty secret")
+	}
+	if err := setSecret(*name, value); err != nil {
+		return nil, err
+	}
+	return secretsOutput(), nil
+}
+
+func secretsRotateCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("secrets rotate")
+	keyFile := fs.String("key-file", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	passphrase := os.Getenv("FISC_NEW_PASSPHRASE")
+	if *keyFile == "" && passphrase == "" {
+		return nil, fmt.Errorf("zadajte --key-file ili FISC_NEW_PASSPHRASE")
+	}
+	if err := rotateVault(argPath(*keyFile), passphrase); err != nil {
+		return nil, err
+	}
+	return secretsOutput(), nil
+}
+
+func secretsWipeCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("secrets wipe")
+	name := fs.String("name", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	if err := wipeSecrets(*name); err != nil {
+		return nil, err
+	}
+	return secretsOutput(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Settings are fisc options that are not part of sep.Config
+type Settings struct {
+	// Endpoint overrides the tax service URL, e.g. to use simulate-server
+	Endpoint string `json:"endpoint,omitempty"`
+	// Timeout of a request to the tax service in seconds
+	Timeout int `json:"timeout,omitempty"`
+	// Signer is safenet, the default, pkcs11 for a token configured in
+	// pkcs11.json, or pkcs12 for a software certificate configured in
+	// pkcs12.json
+	Signer string `json:"signer,omitempty"`
+}
+
+// AppSettings are loaded from settings.json
+var AppSettings = &Settings{}
+
+// loadSettings reads settings.json; a missing file means default settings.
+// FISC_ENDPOINT environment variable overrides the configured endpoint.
+func loadSettings() error {
+	AppSettings = &Settings{}
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("settings.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, AppSettings); err != nil {
+			return err
+		}
+	}
+	if endpoint := os.Getenv("FISC_ENDPOINT"); endpoint != "" {
+		AppSettings.Endpoint = endpoint
+	}
+	return nil
+}
+
+func saveSettings() error {
+	buf, err := json.MarshalIndent(AppSettings, "", "\t")
+	if err != nil {
+		return err
+	}
+	return withDataLock(func() error {
+		return ioutil.WriteFile(currentWorkingDirectoryFilePath("settings.json"), buf, 0644)
+	})
+}
+
+func settingsShowCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := loadSettings(); err != nil {
+		return nil, err
+	}
+	return AppSettings, nil
+}
+
+func settingsSetCommand(args []string) (interface{}, error) {
+	if err := loadSettings(); err != nil {
+		return nil, err
+	}
+	fs := newFlagSet("settings set")
+	endpoint := fs.String("endpoint", AppSettings.Endpoint, "")
+	timeout := fs.Int("timeout", AppSettings.Timeout, "")
+	signer := fs.String("signer", AppSettings.Signer, "")
+	pkcs12File := fs.String("pkcs12-file", "", "")
+	pkcs11 := &PKCS11Config{}
+	fs.StringVar(&pkcs11.Module, "pkcs11-module", "", "")
+	fs.StringVar(&pkcs11.TokenLabel, "pkcs11-token", "", "")
+	fs.StringVar(&pkcs11.KeyLabel, "pkcs11-key", "", "")
+	fs.StringVar(&pkcs11.KeyID, "pkcs11-key-id", "", "")
+	pkcs11Slot := fs.Int("pkcs11-slot", -1, "")
+	if err := fs.Parse(args); err != nil || fs.NFlag() == 0 || *timeout < 0 {
+		return nil, errUsage
+	}
+	if _, ok := signerConfigFiles[*signer]; *signer != "" && !ok {
+		return nil, fmt.Errorf("unknown signer %s", *signer)
+	}
+	AppSettings.Endpoint = *endpoint
+	AppSettings.Timeout = *timeout
+	AppSettings.Signer = *signer
+
+	// the certificate is checked before it is saved, its password comes
+	// from FISC_PKCS12_PASSWORD so it does not end up in shell history, and
+	// can be stored with fisc secrets set
+	if *pkcs12File != "" {
+		cfg := &PKCS12Config{File: argPath(*pkcs12File), Password: os.Getenv("FISC_PKCS12_PASSWORD")}
+		if _, err := NewPKCS12Signer(cfg); err != nil {
+			return nil, err
+		}
+		cfg.Password = ""
+		if err := savePKCS12Config(cfg); err != nil {
+			return nil, err
+		}
+	}
+	// the PIN comes from FISC_PKCS11_PIN, like the password above
+	if pkcs11.Module != "" {
+		if *pkcs11Slot >= 0 {
+			slot := uint(*pkcs11Slot)
+			pkcs11.Slot = &slot
+		}
+		pkcs11.PIN = os.Getenv("FISC_PKCS11_PIN")
+		// a loaded signer would lose its session when the module is closed
+		setAppSigner(nil)
+		signer, err := NewPKCS11Signer(pkcs11)
+		if err != nil {
+			return nil, err
+		}
+		signer.Close()
+		pkcs11.PIN = ""
+		if err := savePKCS11Config(pkcs11); err != nil {
+			return nil, err
+		}
+	}
+	if err := saveSettings(); err != nil {
+		return nil, err
+	}
+	return AppSettings, nil
+}
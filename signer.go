@@ -0,0 +1,453 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/dsig"
+	"github.com/noshto/dsig/pkg/safenet"
+	"github.com/noshto/gen"
+	"github.com/noshto/iic"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Signer kinds selected in settings.json
+const (
+	signerSafeNet = "safenet"
+	signerPKCS11  = "pkcs11"
+	signerPKCS12  = "pkcs12"
+)
+
+// Signer computes IICs and signs requests for the tax service
+type Signer interface {
+	// WriteIIC fills in IIC and IICSignature of the invoice in inFile
+	WriteIIC(inFile, outFile string) error
+	// WriteWTNIC fills in WTNIC and WTNICSignature of the transfer note in
+	// inFile
+	WriteWTNIC(inFile, outFile string) error
+	// Sign writes inFile with an enveloped XML signature to outFile
+	Sign(inFile, outFile string) error
+}
+
+// AppSigner is the signer selected in settings.json
+var AppSigner Signer
+
+// setAppSigner replaces AppSigner, closing the token of the previous one
+func setAppSigner(signer Signer) {
+	if it, ok := AppSigner.(*PKCS11Signer); ok && Signer(it) != signer {
+		it.Close()
+	}
+	AppSigner = signer
+}
+
+// currentSigner returns the loaded signer
+func currentSigner() (Signer, error) {
+	if AppSigner == nil {
+		return nil, fmt.Errorf("potpis nije podešen")
+	}
+	return AppSigner, nil
+}
+
+// SafeNetSigner signs with the SafeNet token
+type SafeNetSigner struct {
+	Config *safenet.Config
+}
+
+// WriteIIC implements Signer
+func (s *SafeNetSigner) WriteIIC(inFile, outFile string) error {
+	return iic.WriteIIC(&iic.Params{
+		SafenetConfig: s.Config,
+		InFile:        inFile,
+		OutFile:       outFile,
+	})
+}
+
+// safenetModules are where SafeNet Authentication Client installs its
+// PKCS#11 library, by GOOS
+var safenetModules = map[string][]string{
+	"windows": {`C:\Windows\System32\eTPKCS11.dll`},
+	"darwin":  {"/usr/local/lib/libeTPkcs11.dylib", "/Library/Frameworks/eToken.framework/Versions/Current/libeToken.dylib"},
+	"linux":   {"/usr/lib/libeTPkcs11.so", "/usr/lib64/libeTPkcs11.so", "/usr/lib/libeToken.so"},
+}
+
+// safenetModule returns the PKCS#11 library configured in safenet.json or,
+// like dsig does without one, the library installed by SafeNet
+func safenetModule(cfg *safenet.Config) (string, error) {
+	if cfg.LibPath != "" {
+		return cfg.LibPath, nil
+	}
+	for _, it := range safenetModules[runtime.GOOS] {
+		if _, err := os.Stat(it); err == nil {
+			return it, nil
+		}
+	}
+	return "", fmt.Errorf("biblioteka SafeNet tokena nije pronađena u %s, upišite putanju do nje u safenet.json", strings.Join(safenetModules[runtime.GOOS], ", "))
+}
+
+// WriteWTNIC implements Signer. iic computes IICs of invoices only, so
+// transfer notes are signed through the PKCS#11 library of the token, with
+// the key of the certificate dsig signs requests with.
+func (s *SafeNetSigner) WriteWTNIC(inFile, outFile string) error {
+	module, err := safenetModule(s.Config)
+	if err != nil {
+		return err
+	}
+	// dsig embeds its certificate in the signature, the note is signed
+	// once to learn it
+	if err := s.Sign(inFile, outFile); err != nil {
+		return err
+	}
+	certificate, err := signedCertificate(outFile)
+	if err != nil {
+		return err
+	}
+	signer, err := NewPKCS11Signer(&PKCS11Config{
+		Module:      module,
+		PIN:         s.Config.UnlockPin,
+		Certificate: certificate.Raw,
+	})
+	if err != nil {
+		return err
+	}
+	defer signer.Close()
+	return signer.WriteWTNIC(inFile, outFile)
+}
+
+// signedCertificate returns the certificate of the signature in a signed
+// document
+func signedCertificate(filePath string) (*x509.Certificate, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(filePath); err != nil {
+		return nil, err
+	}
+	signature := findDescendant(doc.Root(), "Signature")
+	if signature == nil {
+		return nil, fmt.Errorf("invalid signature, no Signature")
+	}
+	return signatureCertificate(signature)
+}
+
+// Sign implements Signer
+func (s *SafeNetSigner) Sign(inFile, outFile string) error {
+	return dsig.Sign(&dsig.Params{
+		SepConfig:     SepConfig,
+		SafenetConfig: s.Config,
+		InFile:        inFile,
+		OutFile:       outFile,
+	})
+}
+
+// PKCS12Config is the content of pkcs12.json
+type PKCS12Config struct {
+	File string `json:"file"`
+	// Password is kept in secrets.json
+	Password string `json:"password,omitempty"`
+}
+
+// xmlSigner computes IICs and XML signatures in fisc, using a key that is
+// reachable through sign
+type xmlSigner struct {
+	// sign returns the RSA-SHA256 signature of data
+	sign        func(data []byte) ([]byte, error)
+	certificate *x509.Certificate
+}
+
+// WriteIIC implements Signer
+func (s *xmlSigner) WriteIIC(inFile, outFile string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(inFile); err != nil {
+		return err
+	}
+	invoice := doc.FindElement("//Invoice")
+	if invoice == nil {
+		return fmt.Errorf("invalid xml, no Invoice")
+	}
+	if findChild(invoice, "Seller") == nil {
+		return fmt.Errorf("invalid xml, no Seller")
+	}
+	signature, err := s.sign([]byte(plainIIC(invoice)))
+	if err != nil {
+		return err
+	}
+	invoice.CreateAttr("IIC", iicFromSignature(signature))
+	invoice.CreateAttr("IICSignature", strings.ToUpper(hex.EncodeToString(signature)))
+	return doc.WriteToFile(outFile)
+}
+
+// WriteWTNIC implements Signer
+func (s *xmlSigner) WriteWTNIC(inFile, outFile string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(inFile); err != nil {
+		return err
+	}
+	wtn := doc.FindElement("//WTN")
+	if wtn == nil {
+		return fmt.Errorf("invalid xml, no WTN")
+	}
+	if findChild(wtn, "Issuer") == nil {
+		return fmt.Errorf("invalid xml, no Issuer")
+	}
+	signature, err := s.sign([]byte(plainWTNIC(wtn)))
+	if err != nil {
+		return err
+	}
+	wtn.CreateAttr("WTNIC", iicFromSignature(signature))
+	wtn.CreateAttr("WTNICSignature", strings.ToUpper(hex.EncodeToString(signature)))
+	return doc.WriteToFile(outFile)
+}
+
+// Sign implements Signer
+func (s *xmlSigner) Sign(inFile, outFile string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(inFile); err != nil {
+		return err
+	}
+	root := doc.Root()
+	if root == nil {
+		return fmt.Errorf("invalid xml, no root in %s", inFile)
+	}
+	if it := findChild(root, "Signature"); it != nil {
+		root.RemoveChild(it)
+	}
+	uri := ""
+	if id := root.SelectAttrValue("Id", ""); id != "" {
+		uri = "#" + id
+	}
+	digest := sha256.Sum256(canonicalize(root))
+
+	signature := root.CreateElement("Signature")
+	signature.CreateAttr("xmlns", dsigNamespace)
+	signedInfo := signature.CreateElement("SignedInfo")
+	signedInfo.CreateElement("CanonicalizationMethod").CreateAttr("Algorithm", algExcC14N)
+	signedInfo.CreateElement("SignatureMethod").CreateAttr("Algorithm", algRSASHA256)
+	reference := signedInfo.CreateElement("Reference")
+	reference.CreateAttr("URI", uri)
+	transforms := reference.CreateElement("Transforms")
+	transforms.CreateElement("Transform").CreateAttr("Algorithm", algEnveloped)
+	transforms.CreateElement("Transform").CreateAttr("Algorithm", algExcC14N)
+	reference.CreateElement("DigestMethod").CreateAttr("Algorithm", algSHA256)
+	reference.CreateElement("DigestValue").SetText(base64.StdEncoding.EncodeToString(digest[:]))
+
+	signatureValue, err := s.sign(canonicalize(signedInfo))
+	if err != nil {
+		return err
+	}
+	signature.CreateElement("SignatureValue").SetText(base64.StdEncoding.EncodeToString(signatureValue))
+	signature.CreateElement("KeyInfo").CreateElement("X509Data").CreateElement("X509Certificate").SetText(base64.StdEncoding.EncodeToString(s.certificate.Raw))
+	return doc.WriteToFile(outFile)
+}
+
+// PKCS12Signer signs with a software certificate from a .pfx/.p12 file
+type PKCS12Signer struct {
+	xmlSigner
+}
+
+// NewPKCS12Signer opens a PKCS#12 file
+func NewPKCS12Signer(cfg *PKCS12Config) (*PKCS12Signer, error) {
+	buf, err := ioutil.ReadFile(cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	key, cert, _, err := pkcs12.DecodeChain(buf, cfg.Password)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", cfg.File, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: key is not RSA", cfg.File)
+	}
+	return &PKCS12Signer{xmlSigner{
+		sign: func(data []byte) ([]byte, error) {
+			sum := sha256.Sum256(data)
+			return rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		},
+		certificate: cert,
+	}}, nil
+}
+
+func loadPKCS12Config() (*PKCS12Config, error) {
+	cfg := &PKCS12Config{}
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath("pkcs12.json"))
+	if err != nil && !(os.IsNotExist(err) && os.Getenv("FISC_PKCS12_FILE") != "") {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, cfg); err != nil {
+			return nil, err
+		}
+	}
+	if file := os.Getenv("FISC_PKCS12_FILE"); file != "" {
+		cfg.File = file
+	}
+	if password := os.Getenv("FISC_PKCS12_PASSWORD"); password != "" {
+		cfg.Password = password
+		return cfg, nil
+	}
+
+	// password kept in clear text is moved to secrets.json
+	if cfg.Password != "" {
+		if err := savePKCS12Config(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "lozinka za sertifikat nije šifrovana: %v\n", err)
+		}
+		return cfg, nil
+	}
+	if cfg.Password, err = getSecret(secretPKCS12Password); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// savePKCS12Config stores the password, if any, in secrets.json and the
+// rest of the config in pkcs12.json
+func savePKCS12Config(cfg *PKCS12Config) error {
+	if cfg.Password != "" {
+		if err := setSecret(secretPKCS12Password, cfg.Password); err != nil {
+			return err
+		}
+	}
+	plain := *cfg
+	plain.Password = ""
+	buf, err := json.MarshalIndent(&plain, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(currentWorkingDirectoryFilePath("pkcs12.json"), buf, 0600)
+}
+
+// signerConfigFiles are the configuration files of signers
+var signerConfigFiles = map[string]string{
+	signerSafeNet: "safenet.json",
+	signerPKCS11:  "pkcs11.json",
+	signerPKCS12:  "pkcs12.json",
+}
+
+// isSafeNetSigner reports whether documents are signed by the SafeNet token
+// through dsig
+func isSafeNetSigner() bool {
+	return AppSettings.Signer == "" || AppSettings.Signer == signerSafeNet
+}
+
+// loadSigner loads the signer selected in settings.json without prompting.
+// FISC_PKCS12_FILE and FISC_PKCS12_PASSWORD override pkcs12.json,
+// FISC_PKCS11_PIN overrides PIN in pkcs11.json.
+func loadSigner() error {
+	switch AppSettings.Signer {
+	case "", signerSafeNet:
+		if err := loadSafenetConfig(); err != nil {
+			return err
+		}
+		setAppSigner(&SafeNetSigner{Config: SafenetConfig})
+	case signerPKCS11:
+		// the token stays logged in until the profile changes, instead of
+		// a session for every document
+		if _, ok := AppSigner.(*PKCS11Signer); ok {
+			return nil
+		}
+		cfg, err := loadPKCS11Config()
+		if err != nil {
+			return err
+		}
+		signer, err := NewPKCS11Signer(cfg)
+		if err != nil {
+			return err
+		}
+		setAppSigner(signer)
+	case signerPKCS12:
+		cfg, err := loadPKCS12Config()
+		if err != nil {
+			return err
+		}
+		signer, err := NewPKCS12Signer(cfg)
+		if err != nil {
+			return err
+		}
+		setAppSigner(signer)
+	default:
+		return fmt.Errorf("unknown signer %s", AppSettings.Signer)
+	}
+	return nil
+}
+
+// setSigner asks user for the missing signer configuration
+func setSigner() error {
+	if AppSettings.Signer == "" {
+		fmt.Println()
+		fmt.Println("---------------------------------------------------------------")
+		fmt.Println("DIGITALNI POTPIS")
+		fmt.Println()
+		fmt.Println("[1] SafeNet token")
+		fmt.Println("[2] Drugi PKCS#11 token")
+		fmt.Println("[3] Sertifikat iz fajla (.pfx, .p12)")
+		switch gen.Scan("Izaberite: ") {
+		case "2":
+			AppSettings.Signer = signerPKCS11
+		case "3":
+			AppSettings.Signer = signerPKCS12
+		default:
+			AppSettings.Signer = signerSafeNet
+		}
+		if err := saveSettings(); err != nil {
+			return err
+		}
+	}
+
+	switch AppSettings.Signer {
+	case signerPKCS11:
+		return setPKCS11Signer()
+	case signerPKCS12:
+		return setPKCS12Signer()
+	}
+	if err := setSafenetConfig(); err != nil {
+		return err
+	}
+	return loadSigner()
+}
+
+func setPKCS12Signer() error {
+	cfg := &PKCS12Config{
+		File:     gen.Scan("Unesite putanju do sertifikata (.pfx, .p12): "),
+		Password: gen.Scan("Unesite lozinku za sertifikat: "),
+	}
+	signer, err := NewPKCS12Signer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := savePKCS12Config(cfg); err != nil {
+		return err
+	}
+	setAppSigner(signer)
+	return nil
+}
+
+// loadOrSetSigner loads the signer, asking user for its configuration if
+// needed
+func loadOrSetSigner() error {
+	if err := loadSigner(); err != nil {
+		return setSigner()
+	}
+	return nil
+}
+
+// requireSigner loads the signer without prompting
+func requireSigner() error {
+	if err := loadSigner(); err != nil {
+		configFile, ok := signerConfigFiles[AppSettings.Signer]
+		if !ok {
+			configFile = signerConfigFiles[signerSafeNet]
+		}
+		return fmt.Errorf("%s nije učitan, pokrenite fisc bez argumenata: %v", configFile, err)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/noshto/dsig/pkg/safenet"
+)
+
+func TestSafenetModule(t *testing.T) {
+	defer func(modules map[string][]string) { safenetModules = modules }(safenetModules)
+	installed := filepath.Join(t.TempDir(), "libeTPkcs11.so")
+	if err := ioutil.WriteFile(installed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	safenetModules = map[string][]string{runtime.GOOS: {filepath.Join(t.TempDir(), "missing.so"), installed}}
+
+	if module, err := safenetModule(&safenet.Config{LibPath: "/opt/safenet/lib.so"}); err != nil || module != "/opt/safenet/lib.so" {
+		t.Errorf("configured library: %q, %v", module, err)
+	}
+	if module, err := safenetModule(&safenet.Config{}); err != nil || module != installed {
+		t.Errorf("installed library: %q, %v, want %s", module, err, installed)
+	}
+	safenetModules = map[string][]string{}
+	if _, err := safenetModule(&safenet.Config{}); err == nil {
+		t.Error("no error without a library")
+	}
+}
+
+func TestSignedCertificate(t *testing.T) {
+	newTestCompany(t)
+	dir := t.TempDir()
+	inFile, outFile := filepath.Join(dir, "wtn.xml"), filepath.Join(dir, "wtn.dsig.xml")
+	if err := ioutil.WriteFile(inFile, []byte(`<RegisterWTNRequest xmlns="https://efi.tax.gov.me/fs/schema" Id="Request" Version="1"><Header UUID="1"/></RegisterWTNRequest>`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppSigner.Sign(inFile, outFile); err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := signedCertificate(outFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !certificate.Equal(AppSigner.(*PKCS12Signer).certificate) {
+		t.Errorf("certificate %s is not the signing one", certificate.Subject)
+	}
+}
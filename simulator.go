@@ -0,0 +1,548 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beevik/etree"
+)
+
+// Fault codes returned by the simulator, modelled on efi.tax.gov.me faults
+const (
+	faultInvalidMessage   = "11"
+	faultInvalidSignature = "12"
+	faultInvalidIIC       = "13"
+	faultUnknownRequest   = "14"
+)
+
+// FaultKind is a failure the simulator can inject
+type FaultKind string
+
+// Injected failures
+const (
+	// FaultTimeout keeps the client waiting, then drops the connection
+	FaultTimeout FaultKind = "timeout"
+	// FaultHTTP500 responds with HTTP 500 without SOAP envelope
+	FaultHTTP500 FaultKind = "http500"
+	// FaultMalformed responds with truncated XML
+	FaultMalformed FaultKind = "malformed"
+	// FaultSOAP responds with a SOAP fault
+	FaultSOAP FaultKind = "soap"
+	// FaultNoFIC responds without FIC or TCRCode
+	FaultNoFIC FaultKind = "nofic"
+)
+
+var faultKinds = map[FaultKind]bool{
+	FaultTimeout:   true,
+	FaultHTTP500:   true,
+	FaultMalformed: true,
+	FaultSOAP:      true,
+	FaultNoFIC:     true,
+}
+
+// FaultRule injects a failure into matching requests
+type FaultRule struct {
+	Kind FaultKind `json:"kind"`
+	// Request limits the rule to one request type, e.g. RegisterInvoiceRequest
+	Request string `json:"request,omitempty"`
+	// Code and Message of a SOAP fault
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	// Skip lets the first matching requests through, Times limits the number
+	// of failures; 0 fails all following requests
+	Skip  int `json:"skip,omitempty"`
+	Times int `json:"times,omitempty"`
+	// Registered fails after the document is registered, as if the response
+	// was lost on its way back
+	Registered bool `json:"registered,omitempty"`
+	// Delay of a timeout in seconds
+	Delay int `json:"delay,omitempty"`
+
+	seen int
+}
+
+// Validate checks the rule
+func (r *FaultRule) Validate() error {
+	if !faultKinds[r.Kind] {
+		return fmt.Errorf("unknown fault %s", r.Kind)
+	}
+	if r.Skip < 0 || r.Times < 0 || r.Delay < 0 {
+		return fmt.Errorf("invalid fault %s, negative count", r.Kind)
+	}
+	return nil
+}
+
+// match counts a request against the rule and reports whether it fails
+func (r *FaultRule) match(request string) bool {
+	if r.Request != "" && r.Request != request {
+		return false
+	}
+	r.seen++
+	return r.seen > r.Skip && (r.Times == 0 || r.seen <= r.Skip+r.Times)
+}
+
+// loadFaultRules reads a scenario file, a JSON array of fault rules
+func loadFaultRules(filePath string) ([]*FaultRule, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	rules := []*FaultRule{}
+	if err := json.Unmarshal(buf, &rules); err != nil {
+		return nil, err
+	}
+	for _, it := range rules {
+		if err := it.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// Simulator is a local stand-in of the efi.tax.gov.me SOAP service. It
+// validates signatures and IICs and remembers registered documents, so a
+// resubmitted invoice gets the FIC it was registered with.
+type Simulator struct {
+	Log io.Writer
+	// Faults are tried in order, the first matching one is injected
+	Faults []*FaultRule
+	// DuplicateFault rejects a resubmitted invoice with the fault of the tax
+	// service instead of answering with its FIC
+	DuplicateFault bool
+
+	mu            sync.Mutex
+	invoices      map[string]string
+	registrations map[string]int
+	tcrs          map[string]string
+	wtns          map[string]string
+}
+
+// NewSimulator creates a simulator logging requests to log
+func NewSimulator(log io.Writer, faults []*FaultRule) *Simulator {
+	return &Simulator{
+		Log:           log,
+		Faults:        faults,
+		invoices:      map[string]string{},
+		registrations: map[string]int{},
+		tcrs:          map[string]string{},
+		wtns:          map[string]string{},
+	}
+}
+
+// Registrations returns how many requests registered the invoice with the
+// IIC, resubmissions answered with its FIC included
+func (s *Simulator) Registrations(iic string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.registrations[strings.ToUpper(iic)]
+}
+
+// fault returns the fault rule to inject into a request, if any
+func (s *Simulator) fault(request string) *FaultRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, it := range s.Faults {
+		if it.match(request) {
+			return it
+		}
+	}
+	return nil
+}
+
+// injectFault writes the failure described by rule instead of the response
+func (s *Simulator) injectFault(w http.ResponseWriter, rule *FaultRule, request, requestUUID string) {
+	s.logf("%s %s: injected %s", request, requestUUID, rule.Kind)
+	switch rule.Kind {
+	case FaultTimeout:
+		delay := 2 * soapTimeout
+		if rule.Delay > 0 {
+			delay = time.Duration(rule.Delay) * time.Second
+		}
+		time.Sleep(delay)
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+	case FaultHTTP500:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	case FaultMalformed:
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><env:Envelope xmlns:env="%s"><env:Body><%s xmlns="%s"><FIC>`,
+			soapNamespace, responseName(request), schemaNamespace)
+	case FaultSOAP:
+		fault := &SOAPFault{Code: rule.Code, String: rule.Message}
+		if fault.Code == "" {
+			fault.Code = faultInternal
+		}
+		if fault.String == "" {
+			fault.String = "simulated fault"
+		}
+		s.writeFault(w, requestUUID, fault)
+	case FaultNoFIC:
+		s.writeResponse(w, http.StatusOK, requestUUID, newResponseElement(responseName(request)))
+	}
+}
+
+// responseName returns the response element name of a request
+func responseName(request string) string {
+	return strings.TrimSuffix(request, "Request") + "Response"
+}
+
+func (s *Simulator) logf(format string, args ...interface{}) {
+	if s.Log != nil {
+		fmt.Fprintf(s.Log, "%s %s\n", time.Now().Format("2006-01-02 15:04:05"), fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		s.writeFault(w, "", &SOAPFault{Code: faultInternal, String: err.Error()})
+		return
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(body); err != nil {
+		s.writeFault(w, "", &SOAPFault{Code: faultInvalidMessage, String: err.Error()})
+		return
+	}
+	requestBody := findChild(doc.Root(), "Body")
+	if doc.Root() == nil || doc.Root().Tag != "Envelope" || requestBody == nil || len(requestBody.ChildElements()) == 0 {
+		s.writeFault(w, "", &SOAPFault{Code: faultInvalidMessage, String: "no SOAP envelope"})
+		return
+	}
+	request := requestBody.ChildElements()[0]
+	requestUUID := ""
+	if header := findChild(request, "Header"); header != nil {
+		requestUUID = header.SelectAttrValue("UUID", "")
+	}
+
+	rule := s.fault(request.Tag)
+	if rule != nil && !rule.Registered {
+		s.injectFault(w, rule, request.Tag, requestUUID)
+		return
+	}
+
+	var response *etree.Element
+	switch request.Tag {
+	case "RegisterInvoiceRequest":
+		response, err = s.registerInvoice(request)
+	case "RegisterTCRRequest":
+		response, err = s.registerTCR(request)
+	case "RegisterCashDepositRequest":
+		response, err = s.registerCashDeposit(request)
+	case "RegisterWTNRequest":
+		response, err = s.registerWTN(request)
+	default:
+		err = &SOAPFault{Code: faultUnknownRequest, String: fmt.Sprintf("unknown request %s", request.Tag)}
+	}
+	if err != nil {
+		if fault, ok := err.(*SOAPFault); ok {
+			s.logf("%s %s: fault %s, %s", request.Tag, requestUUID, fault.Code, fault.String)
+		} else {
+			s.logf("%s %s: %v", request.Tag, requestUUID, err)
+		}
+		s.writeFault(w, requestUUID, err)
+		return
+	}
+	s.logf("%s %s: OK", request.Tag, requestUUID)
+	if rule != nil {
+		s.injectFault(w, rule, request.Tag, requestUUID)
+		return
+	}
+	s.writeResponse(w, http.StatusOK, requestUUID, response)
+}
+
+// checkRequest validates the header and signature common to all requests
+func (s *Simulator) checkRequest(request *etree.Element) error {
+	header := findChild(request, "Header")
+	if header == nil || header.SelectAttrValue("UUID", "") == "" || header.SelectAttrValue("SendDateTime", "") == "" {
+		return &SOAPFault{Code: faultInvalidMessage, String: "invalid Header"}
+	}
+	if _, err := time.Parse(time.RFC3339, header.SelectAttrValue("SendDateTime", "")); err != nil {
+		return &SOAPFault{Code: faultInvalidMessage, String: "invalid SendDateTime"}
+	}
+	if it := header.SelectAttrValue("SubseqDelivType", ""); it != "" && !subseqDelivTypes[it] {
+		return &SOAPFault{Code: faultInvalidMessage, String: "invalid SubseqDelivType"}
+	}
+	return nil
+}
+
+func (s *Simulator) registerInvoice(request *etree.Element) (*etree.Element, error) {
+	if err := s.checkRequest(request); err != nil {
+		return nil, err
+	}
+	invoice := findChild(request, "Invoice")
+	if invoice == nil {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "no Invoice"}
+	}
+	for _, attr := range []string{"IssueDateTime", "InvOrdNum", "BusinUnitCode", "TCRCode", "SoftCode", "TotPrice", "IIC", "IICSignature"} {
+		if invoice.SelectAttrValue(attr, "") == "" {
+			return nil, &SOAPFault{Code: faultInvalidMessage, String: fmt.Sprintf("no %s", attr)}
+		}
+	}
+	cert, err := verifySignature(request)
+	if err != nil {
+		return nil, &SOAPFault{Code: faultInvalidSignature, String: err.Error()}
+	}
+	if err := verifyIIC(invoice, cert); err != nil {
+		return nil, &SOAPFault{Code: faultInvalidIIC, String: err.Error()}
+	}
+
+	iic := strings.ToUpper(invoice.SelectAttrValue("IIC", ""))
+	s.mu.Lock()
+	fic, ok := s.invoices[iic]
+	if ok && s.DuplicateFault {
+		s.mu.Unlock()
+		return nil, &SOAPFault{Code: faultDuplicateIIC, String: fmt.Sprintf("invoice with IIC %s is already registered", iic)}
+	}
+	if !ok {
+		fic = newUUID()
+		s.invoices[iic] = fic
+	}
+	s.registrations[iic]++
+	s.mu.Unlock()
+	if ok {
+		s.logf("IIC %s already registered, FIC %s", iic, fic)
+	}
+
+	response := newResponseElement("RegisterInvoiceResponse")
+	response.CreateElement("FIC").SetText(fic)
+	return response, nil
+}
+
+func (s *Simulator) registerTCR(request *etree.Element) (*etree.Element, error) {
+	if err := s.checkRequest(request); err != nil {
+		return nil, err
+	}
+	tcr := findChild(request, "TCR")
+	if tcr == nil {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "no TCR"}
+	}
+	for _, attr := range []string{"BusinUnitCode", "IssuerTIN", "MaintainerCode", "SoftCode"} {
+		if tcr.SelectAttrValue(attr, "") == "" {
+			return nil, &SOAPFault{Code: faultInvalidMessage, String: fmt.Sprintf("no %s", attr)}
+		}
+	}
+	validFrom, validTo := tcr.SelectAttrValue("ValidFrom", ""), tcr.SelectAttrValue("ValidTo", "")
+	if validFrom != "" && validTo != "" && validTo < validFrom {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "ValidTo is before ValidFrom"}
+	}
+	if _, err := verifySignature(request); err != nil {
+		return nil, &SOAPFault{Code: faultInvalidSignature, String: err.Error()}
+	}
+
+	key := strings.Join([]string{
+		tcr.SelectAttrValue("IssuerTIN", ""),
+		tcr.SelectAttrValue("BusinUnitCode", ""),
+		tcr.SelectAttrValue("TCRIntID", ""),
+	}, "|")
+	s.mu.Lock()
+	code, ok := s.tcrs[key]
+	if !ok {
+		code = newTCRCode()
+		s.tcrs[key] = code
+	}
+	s.mu.Unlock()
+	if ok {
+		s.logf("TCR %s already registered, TCRCode %s", key, code)
+	}
+
+	response := newResponseElement("RegisterTCRResponse")
+	response.CreateElement("TCRCode").SetText(code)
+	return response, nil
+}
+
+func (s *Simulator) registerCashDeposit(request *etree.Element) (*etree.Element, error) {
+	if err := s.checkRequest(request); err != nil {
+		return nil, err
+	}
+	deposit := findChild(request, "CashDeposit")
+	if deposit == nil {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "no CashDeposit"}
+	}
+	for _, attr := range []string{"ChangeDateTime", "Operation", "CashAmt", "TCRCode", "IssuerTIN"} {
+		if deposit.SelectAttrValue(attr, "") == "" {
+			return nil, &SOAPFault{Code: faultInvalidMessage, String: fmt.Sprintf("no %s", attr)}
+		}
+	}
+	if it := deposit.SelectAttrValue("Operation", ""); it != depositInitial && it != depositWithdraw {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "invalid Operation"}
+	}
+	if _, err := verifySignature(request); err != nil {
+		return nil, &SOAPFault{Code: faultInvalidSignature, String: err.Error()}
+	}
+
+	response := newResponseElement("RegisterCashDepositResponse")
+	response.CreateElement("FCDC").SetText(newUUID())
+	return response, nil
+}
+
+func (s *Simulator) registerWTN(request *etree.Element) (*etree.Element, error) {
+	if err := s.checkRequest(request); err != nil {
+		return nil, err
+	}
+	wtn := findChild(request, "WTN")
+	if wtn == nil {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "no WTN"}
+	}
+	for _, attr := range []string{"DateTimeCreated", "WTNOrdNum", "BusinUnitCode", "SoftCode", "VehPlates", "WTNIC", "WTNICSignature"} {
+		if wtn.SelectAttrValue(attr, "") == "" {
+			return nil, &SOAPFault{Code: faultInvalidMessage, String: fmt.Sprintf("no %s", attr)}
+		}
+	}
+	if items := findChild(wtn, "Items"); items == nil || len(items.ChildElements()) == 0 {
+		return nil, &SOAPFault{Code: faultInvalidMessage, String: "no Items"}
+	}
+	cert, err := verifySignature(request)
+	if err != nil {
+		return nil, &SOAPFault{Code: faultInvalidSignature, String: err.Error()}
+	}
+	if err := verifyWTNIC(wtn, cert); err != nil {
+		return nil, &SOAPFault{Code: faultInvalidIIC, String: err.Error()}
+	}
+
+	wtnic := strings.ToUpper(wtn.SelectAttrValue("WTNIC", ""))
+	s.mu.Lock()
+	fwtnic, ok := s.wtns[wtnic]
+	if !ok {
+		fwtnic = newUUID()
+		s.wtns[wtnic] = fwtnic
+	}
+	s.mu.Unlock()
+	if ok {
+		s.logf("WTNIC %s already registered, FWTNIC %s", wtnic, fwtnic)
+	}
+
+	response := newResponseElement("RegisterWTNResponse")
+	response.CreateElement("FWTNIC").SetText(fwtnic)
+	return response, nil
+}
+
+// newResponseElement creates a response root with its Header
+func newResponseElement(name string) *etree.Element {
+	response := etree.NewElement(name)
+	response.CreateAttr("xmlns", schemaNamespace)
+	response.CreateAttr("Id", "Response")
+	response.CreateAttr("Version", "1")
+	header := response.CreateElement("Header")
+	header.CreateAttr("UUID", newUUID())
+	header.CreateAttr("SendDateTime", time.Now().Format(dateTimeLayout))
+	return response
+}
+
+func (s *Simulator) writeResponse(w http.ResponseWriter, status int, requestUUID string, body *etree.Element) {
+	if header := findChild(body, "Header"); header != nil && requestUUID != "" {
+		header.CreateAttr("RequestUUID", requestUUID)
+	}
+	doc := etree.NewDocument()
+	doc.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	envelope := doc.CreateElement("env:Envelope")
+	envelope.CreateAttr("xmlns:env", soapNamespace)
+	envelope.CreateElement("env:Header")
+	envelope.CreateElement("env:Body").AddChild(body)
+	buf, err := doc.WriteToBytes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf)
+}
+
+func (s *Simulator) writeFault(w http.ResponseWriter, requestUUID string, err error) {
+	fault, ok := err.(*SOAPFault)
+	if !ok {
+		fault = &SOAPFault{Code: faultInternal, String: err.Error()}
+	}
+	elem := etree.NewElement("env:Fault")
+	elem.CreateElement("faultcode").SetText("env:Server")
+	elem.CreateElement("faultstring").SetText(fault.String)
+	detail := elem.CreateElement("detail")
+	detail.CreateElement("code").SetText(fault.Code)
+	if requestUUID != "" {
+		detail.CreateElement("requestUUID").SetText(requestUUID)
+	}
+	s.writeResponse(w, http.StatusInternalServerError, "", elem)
+}
+
+// newTCRCode returns a random code in the format issued by the tax service,
+// e.g. ab123ab123
+func newTCRCode() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz"
+	const digits = "0123456789"
+	pick := func(alphabet string) byte {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			panic(err)
+		}
+		return alphabet[n.Int64()]
+	}
+	b := []byte{}
+	for _, alphabet := range []string{letters, letters, digits, digits, digits, letters, letters, digits, digits, digits} {
+		b = append(b, pick(alphabet))
+	}
+	return string(b)
+}
+
+func simulateServerCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("simulate-server")
+	listen := fs.String("listen", "127.0.0.1:8080", "")
+	scenario := fs.String("scenario", "", "")
+	rule := &FaultRule{}
+	fs.StringVar((*string)(&rule.Kind), "fault", "", "")
+	fs.StringVar(&rule.Request, "request", "", "")
+	fs.StringVar(&rule.Code, "code", "", "")
+	fs.StringVar(&rule.Message, "message", "", "")
+	fs.IntVar(&rule.Skip, "skip", 0, "")
+	fs.IntVar(&rule.Times, "times", 0, "")
+	fs.BoolVar(&rule.Registered, "registered", false, "")
+	fs.IntVar(&rule.Delay, "delay", 0, "")
+	duplicateFault := fs.Bool("duplicate-fault", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+
+	faults := []*FaultRule{}
+	if *scenario != "" {
+		rules, err := loadFaultRules(argPath(*scenario))
+		if err != nil {
+			return nil, err
+		}
+		faults = append(faults, rules...)
+	}
+	if rule.Kind != "" {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		faults = append(faults, rule)
+	}
+
+	fmt.Fprintf(os.Stderr, "simulate-server: http://%s/\n", *listen)
+	for _, it := range faults {
+		fmt.Fprintf(os.Stderr, "fault: %s\n", it.Kind)
+	}
+	if *duplicateFault {
+		fmt.Fprintf(os.Stderr, "fault: %s for resubmitted invoices\n", faultDuplicateIIC)
+	}
+	fmt.Fprintf(os.Stderr, "fisc settings set --endpoint http://%s/\n", *listen)
+	sim := NewSimulator(os.Stderr, faults)
+	sim.DuplicateFault = *duplicateFault
+	return nil, http.ListenAndServe(*listen, sim)
+}
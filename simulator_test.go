@@ -0,0 +1,301 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/noshto/sep"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// testTCR is the TCR of the company set up by newTestCompany
+var testTCR = sep.TCR{
+	BusinUnitCode:  "ab123ab123",
+	TCRCode:        "cd123cd123",
+	SoftCode:       "ef123ef123",
+	MaintainerCode: "gh123gh123",
+}
+
+// newTestCompany sets up a company in a temporary folder, signing with a
+// fresh software certificate and registering with a simulator
+func newTestCompany(t *testing.T, faults ...*FaultRule) *Simulator {
+	t.Helper()
+	WorkDir = t.TempDir()
+	InvocationDir = WorkDir
+	resetProfileState()
+	t.Cleanup(resetProfileState)
+	SessionTCR = ""
+
+	tcr := testTCR
+	SepConfig = &sep.Config{
+		Name:    "Test",
+		TIN:     "12345678",
+		Country: "MNE",
+		TCR:     &tcr,
+	}
+	defaultTCR = SepConfig.TCR
+	if err := saveSepConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	sim := NewSimulator(nil, faults)
+	server := httptest.NewServer(sim)
+	t.Cleanup(server.Close)
+	AppSettings = &Settings{Endpoint: server.URL + "/", Timeout: 2, Signer: signerPKCS12}
+
+	cfg := &PKCS12Config{File: filepath.Join(WorkDir, "cert.p12"), Password: "test"}
+	writeTestCertificate(t, cfg)
+	signer, err := NewPKCS12Signer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AppSigner = signer
+	return sim
+}
+
+// writeTestCertificate writes a self-signed certificate with its key
+func writeTestCertificate(t *testing.T, cfg *PKCS12Config) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test", SerialNumber: "12345678"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := pkcs12.Modern.Encode(key, cert, nil, cfg.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cfg.File, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testInvoiceInput is a cash invoice with one item
+func testInvoiceInput(ordNum uint64) *InvoiceInput {
+	return &InvoiceInput{
+		OrdNum:    ordNum,
+		PayMethod: "BANKNOTE",
+		Items: []ItemInput{
+			{Name: "Usluga", Unit: "kom", Quantity: 1, UnitPrice: 12.10, VATRate: 21},
+		},
+	}
+}
+
+// testRenderStage stands in for the PDF rendered by pdf, whose layout is not
+// what these tests are about
+func testRenderStage(tx *Transaction) error {
+	return ioutil.WriteFile(tx.PDFFile, []byte("%PDF-1.4\n"), 0644)
+}
+
+// newTestInvoicePipeline is the invoice pipeline issuing testInvoiceInput
+func newTestInvoicePipeline(ordNum uint64) *Pipeline {
+	p := newInvoicePipeline(RegularInvoice)
+	p.Stages[StageGenerate] = buildInvoiceStage(testInvoiceInput(ordNum))
+	p.Stages[StageRender] = testRenderStage
+	return p
+}
+
+// runTestPipeline runs p in a new transaction
+func runTestPipeline(t *testing.T, p *Pipeline) (*Transaction, error) {
+	t.Helper()
+	tx, err := p.NewTransaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx, p.Run(tx)
+}
+
+func TestInvoicePipeline(t *testing.T) {
+	newTestCompany(t)
+
+	tx, err := runTestPipeline(t, newTestInvoicePipeline(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.IIC == "" || tx.FIC == "" {
+		t.Fatalf("IIC %q, FIC %q", tx.IIC, tx.FIC)
+	}
+	entry, err := lookupInvoice(tx.IIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.FIC != tx.FIC {
+		t.Errorf("archived FIC %s, want %s", entry.FIC, tx.FIC)
+	}
+	if _, err := os.Stat(tx.PDFFilePath); err != nil {
+		t.Errorf("archived PDF: %v", err)
+	}
+	if _, err := os.Stat(tx.Dir); !os.IsNotExist(err) {
+		t.Errorf("workspace %s is left behind", tx.Dir)
+	}
+	entries, err := loadJournal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("%d journal entries left", len(entries))
+	}
+}
+
+func TestTCRPipeline(t *testing.T) {
+	newTestCompany(t)
+	in := &TCRInput{
+		BusinUnitCode:  testTCR.BusinUnitCode,
+		InternalID:     "2",
+		SoftCode:       testTCR.SoftCode,
+		MaintainerCode: testTCR.MaintainerCode,
+	}
+	register := func() *Transaction {
+		t.Helper()
+		p := newTCRPipeline()
+		p.Stages[StageGenerate] = func(tx *Transaction) error {
+			return writeTCRRequest(in, tx.GenFile)
+		}
+		tx, err := runTestPipeline(t, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+
+	tx := register()
+	if tx.TCRCode == "" || tx.TCRCode == testTCR.TCRCode {
+		t.Fatalf("TCR code %q", tx.TCRCode)
+	}
+	if err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if SepConfig.TCR.TCRCode != tx.TCRCode {
+		t.Errorf("default TCR %s, want the registered %s", SepConfig.TCR.TCRCode, tx.TCRCode)
+	}
+
+	// registering the same TCR again keeps its code and record
+	again := register()
+	if again.TCRCode != tx.TCRCode {
+		t.Errorf("TCR registered again got code %s, want %s", again.TCRCode, tx.TCRCode)
+	}
+	records, err := loadTCRs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := 0
+	for _, it := range records {
+		if it.TCR.TCRCode == tx.TCRCode {
+			found++
+		}
+	}
+	if found != 1 {
+		t.Errorf("%d records of TCR %s in tcrs.json, want 1", found, tx.TCRCode)
+	}
+}
+
+func TestInvoiceDeliveryFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault FaultRule
+		// duplicate makes the simulator reject the resubmission of an
+		// invoice registered before its response was lost, which is then
+		// archived without FIC
+		duplicate bool
+	}{
+		{name: "timeout", fault: FaultRule{Kind: FaultTimeout, Delay: 2}},
+		{name: "http500", fault: FaultRule{Kind: FaultHTTP500}},
+		{name: "malformed", fault: FaultRule{Kind: FaultMalformed}},
+		{name: "soap", fault: FaultRule{Kind: FaultSOAP, Code: faultInternal}},
+		{name: "nofic", fault: FaultRule{Kind: FaultNoFIC}},
+		{name: "timeout after registration", fault: FaultRule{Kind: FaultTimeout, Delay: 2, Registered: true}, duplicate: true},
+		{name: "malformed after registration", fault: FaultRule{Kind: FaultMalformed, Registered: true}, duplicate: true},
+		{name: "nofic after registration", fault: FaultRule{Kind: FaultNoFIC, Registered: true}, duplicate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fault := tt.fault
+			fault.Request = "RegisterInvoiceRequest"
+			fault.Times = 1
+			sim := newTestCompany(t, &fault)
+			sim.DuplicateFault = tt.duplicate
+			AppSettings.Timeout = 1
+
+			tx, err := runTestPipeline(t, newTestInvoicePipeline(1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tx.Queued {
+				t.Fatal("invoice is not queued for subsequent delivery")
+			}
+			items, err := loadOutbox()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0].IIC != tx.IIC {
+				t.Fatalf("outbox holds %d items, want invoice %s", len(items), tx.IIC)
+			}
+
+			results, err := flushOutbox("NOINTERNET")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 {
+				t.Fatalf("%d outbox results, want 1", len(results))
+			}
+			if n := sim.Registrations(tx.IIC); n != 1 {
+				t.Errorf("invoice %s registered %d times, want once", tx.IIC, n)
+			}
+
+			if !results[0].OK {
+				t.Fatalf("subsequent delivery failed: %s", results[0].Error)
+			}
+			wantFIC := results[0].FIC
+			if tt.duplicate {
+				if !results[0].FICUnknown || wantFIC != "" {
+					t.Errorf("invoice registered before is archived with FIC %q", wantFIC)
+				}
+			} else if wantFIC == "" {
+				t.Error("invoice is archived without FIC")
+			}
+			items, err = loadOutbox()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 0 {
+				t.Errorf("%d items left in the outbox", len(items))
+			}
+			entry, err := lookupInvoice(tx.IIC)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.FIC != wantFIC {
+				t.Errorf("archived FIC %q, want %q", entry.FIC, wantFIC)
+			}
+			report, err := verifyArchive()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, it := range report.Problems {
+				t.Errorf("archive: %s %s", it.File, it.Message)
+			}
+		})
+	}
+}
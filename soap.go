@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/sep"
+)
+
+// soapNamespace is the namespace of SOAP 1.1 envelopes
+const soapNamespace = "http://schemas.xmlsoap.org/soap/envelope/"
+
+// soapTimeout limits a single request to the tax service, unless set in
+// settings.json
+const soapTimeout = 30 * time.Second
+
+// Tax service endpoints
+const (
+	testEndpoint       = "https://efitest.tax.gov.me/fs-v1"
+	productionEndpoint = "https://efi.tax.gov.me/fs-v1"
+)
+
+// serviceEndpoint returns the endpoint configured in settings.json, or the
+// tax service endpoint of the configured environment
+func serviceEndpoint() string {
+	if AppSettings.Endpoint != "" {
+		return AppSettings.Endpoint
+	}
+	if SepConfig.Environment == sep.TEST {
+		return testEndpoint
+	}
+	return productionEndpoint
+}
+
+// Fault codes of the tax service
+const (
+	// faultInternal is an internal error of the tax service
+	faultInternal = "0"
+	// faultDuplicateIIC rejects an invoice whose IIC is already registered
+	faultDuplicateIIC = "58"
+)
+
+// SOAPFault is a fault returned by the tax service
+type SOAPFault struct {
+	Code   string
+	String string
+}
+
+func (f *SOAPFault) Error() string {
+	return fmt.Sprintf("poreska uprava je odbila zahtjev, greška %s: %s", f.Code, f.String)
+}
+
+// Temporary reports whether the request may succeed if sent again
+func (f *SOAPFault) Temporary() bool {
+	return f.Code == faultInternal
+}
+
+// readSOAPFault returns the fault in a response envelope, if any
+func readSOAPFault(buf []byte) *SOAPFault {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return nil
+	}
+	elem := findDescendant(doc.Root(), "Fault")
+	if elem == nil {
+		return nil
+	}
+	fault := &SOAPFault{}
+	if it := findChild(elem, "faultstring"); it != nil {
+		fault.String = strings.TrimSpace(it.Text())
+	}
+	if it := findChild(findChild(elem, "detail"), "code"); it != nil {
+		fault.Code = strings.TrimSpace(it.Text())
+	} else if it := findChild(elem, "faultcode"); it != nil {
+		fault.Code = strings.TrimSpace(it.Text())
+	}
+	return fault
+}
+
+// responseError explains a response without the expected result. A fault
+// rejects the request; a response that cannot be understood leaves the
+// outcome unknown, so the document has to be delivered again.
+func responseError(buf []byte) error {
+	fault := readSOAPFault(buf)
+	if fault == nil {
+		return &DeliveryError{Err: fmt.Errorf("invalid response, no result and no fault")}
+	}
+	if fault.Temporary() {
+		return &DeliveryError{Err: fault}
+	}
+	return fault
+}
+
+// postSOAP sends the signed request in inFile to endpoint and writes the
+// response envelope to outFile. SOAP faults are written like any response;
+// an error means the response could not be obtained.
+func postSOAP(endpoint, inFile, outFile string) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(inFile); err != nil {
+		return err
+	}
+	if doc.Root() == nil {
+		return fmt.Errorf("invalid xml, no root in %s", inFile)
+	}
+	request := doc.Root()
+	if request.Tag == "Envelope" {
+		body := findChild(doc.Root(), "Body")
+		if body == nil || len(body.ChildElements()) == 0 {
+			return fmt.Errorf("invalid xml, empty Body in %s", inFile)
+		}
+		request = body.ChildElements()[0]
+	}
+
+	envelope := etree.NewDocument()
+	envelope.CreateProcInst("xml", `version="1.0" encoding="UTF-8"`)
+	root := envelope.CreateElement("soapenv:Envelope")
+	root.CreateAttr("xmlns:soapenv", soapNamespace)
+	root.CreateElement("soapenv:Header")
+	root.CreateElement("soapenv:Body").AddChild(request.Copy())
+	buf, err := envelope.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	timeout := soapTimeout
+	if AppSettings.Timeout > 0 {
+		timeout = time.Duration(AppSettings.Timeout) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(endpoint, "text/xml; charset=utf-8", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	// faults come with status 500, anything else without an envelope is a
+	// transport problem
+	responseDoc := etree.NewDocument()
+	if err := responseDoc.ReadFromBytes(body); err != nil || responseDoc.Root() == nil || responseDoc.Root().Tag != "Envelope" {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK && findDescendant(responseDoc.Root(), "Fault") == nil {
+		return fmt.Errorf("%s: %s", endpoint, resp.Status)
+	}
+	return ioutil.WriteFile(outFile, body, 0644)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+	"github.com/noshto/sep"
+)
+
+// tcrFiles are the intermediate files of a TCR registration
+var tcrFiles = Files{
+	Gen:    "tcr.xml",
+	Signed: "tcr.dsig.xml",
+	Reg:    "tcr.reg.xml",
+}
+
+// newTCRPipeline creates a pipeline registering a new TCR
+func newTCRPipeline() *Pipeline {
+	p := NewPipeline("tcr", tcrFiles)
+	p.Stages[StageGenerate] = generateTCRStage
+	p.Stages[StageSign] = signStage
+	p.Stages[StageRegister] = registerTCRStage
+	p.Stages[StageArchive] = archiveTCRStage
+	p.Stages[StageCleanup] = cleanupStage
+	return withJournal(p)
+}
+
+func generateTCRStage(tx *Transaction) error {
+	return gen.GenerateRegisterTCRRequest(&gen.Params{
+		SepConfig: SepConfig,
+		OutFile:   tx.GenFile,
+	})
+}
+
+// registerTCRStage registers the TCR and checks that a TCR code was issued
+func registerTCRStage(tx *Transaction) error {
+	if err := registerStage(tx); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(tx.RegFile)
+	if err != nil {
+		return err
+	}
+	RegisterTCRResponse := sep.RegisterTCRResponse{}
+	if err := xml.Unmarshal(buf, &RegisterTCRResponse); err != nil {
+		return &DeliveryError{Err: fmt.Errorf("invalid response, %v", err)}
+	}
+	if RegisterTCRResponse.Body.RegisterTCRResponse.TCRCode == "" {
+		return responseError(buf)
+	}
+	tx.TCRCode = string(RegisterTCRResponse.Body.RegisterTCRResponse.TCRCode)
+	return nil
+}
+
+// archiveTCRStage records the registered TCR in tcrs.json and stores a new
+// TCR in config.json
+func archiveTCRStage(tx *Transaction) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.SignedFile); err != nil {
+		return err
+	}
+	elem := doc.FindElement("//TCR")
+	if elem == nil {
+		return fmt.Errorf("invalid xml, no RegisterTCRRequest")
+	}
+	elemDoc := etree.NewDocument()
+	elemDoc.SetRoot(elem.Copy())
+	buf, err := elemDoc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	TCR := sep.TCR{}
+	if err := xml.Unmarshal(buf, &TCR); err != nil {
+		return err
+	}
+	TCR.TCRCode = tx.TCRCode
+
+	// another instance may have changed config in the meantime
+	if err := loadConfig(); err != nil {
+		return err
+	}
+	isNew, err := recordTCR(elem, &TCR)
+	if err != nil || !isNew {
+		return err
+	}
+	// a new TCR becomes the default one and is used from now on
+	SessionTCR = ""
+	SepConfig.TCR = &TCR
+	defaultTCR = &TCR
+	return saveSepConfig()
+}
+
+func registerTCR() error {
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+
+	p := withProgress(newTCRPipeline())
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return err
+	}
+
+	if label := gen.Scan("Naziv ENU, prazno za kôd poslovne jedinice: "); label != "" {
+		if _, err := labelTCR(tx.TCRCode, label); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("Detalji ENU su uspešno registrovani i sačuvani")
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+	"github.com/noshto/sep"
+)
+
+// tcrsFileName lists all TCRs registered for the company. The TCR in
+// config.json is the default one.
+const tcrsFileName = "tcrs.json"
+
+// TCR statuses, derived from validity whenever TCRs are loaded
+const (
+	tcrActive   = "active"
+	tcrPending  = "pending"
+	tcrExpired  = "expired"
+	tcrReplaced = "replaced"
+)
+
+// TCR lifecycle events
+const (
+	tcrRegistered  = "registered"
+	tcrUpdated     = "updated"
+	tcrDeactivated = "deactivated"
+	tcrReactivated = "reactivated"
+)
+
+// TCREvent is a change of a TCR kept in its history
+type TCREvent struct {
+	At        time.Time `json:"at"`
+	Action    string    `json:"action"`
+	ValidFrom string    `json:"valid_from,omitempty"`
+	ValidTo   string    `json:"valid_to,omitempty"`
+	// TCRCode is the TCR that replaced this one
+	TCRCode string `json:"tcr_code,omitempty"`
+}
+
+// TCRRecord is a registered TCR with its label, validity and history.
+// Records are never removed, so retired TCRs stay listed.
+type TCRRecord struct {
+	Label        string      `json:"label"`
+	TCR          *sep.TCR    `json:"tcr"`
+	TCRIntID     string      `json:"tcr_int_id,omitempty"`
+	Type         string      `json:"type,omitempty"`
+	ValidFrom    string      `json:"valid_from,omitempty"`
+	ValidTo      string      `json:"valid_to,omitempty"`
+	Status       string      `json:"status"`
+	ReplacedBy   string      `json:"replaced_by,omitempty"`
+	RegisteredAt *time.Time  `json:"registered_at,omitempty"`
+	History      []*TCREvent `json:"history,omitempty"`
+}
+
+// status returns whether invoices can be issued on the TCR at the given
+// time. ValidTo is the last day the TCR is valid.
+func (r *TCRRecord) status(at time.Time) string {
+	day := at.Format("2006-01-02")
+	switch {
+	case r.ReplacedBy != "":
+		return tcrReplaced
+	case r.ValidTo != "" && day > validityDay(r.ValidTo):
+		return tcrExpired
+	case r.ValidFrom != "" && day < validityDay(r.ValidFrom):
+		return tcrPending
+	}
+	return tcrActive
+}
+
+// validityDay returns the date part of ValidFrom or ValidTo
+func validityDay(value string) string {
+	if len(value) > 10 {
+		return value[:10]
+	}
+	return value
+}
+
+// input describes the registration of the TCR with the given end of validity
+func (r *TCRRecord) input(validTo string) *TCRInput {
+	return &TCRInput{
+		BusinUnitCode:  r.TCR.BusinUnitCode,
+		InternalID:     r.TCRIntID,
+		SoftCode:       r.TCR.SoftCode,
+		MaintainerCode: r.TCR.MaintainerCode,
+		Type:           r.Type,
+		ValidFrom:      r.ValidFrom,
+		ValidTo:        validTo,
+	}
+}
+
+func (r *TCRRecord) addEvent(action string) *TCREvent {
+	event := &TCREvent{
+		At:        time.Now(),
+		Action:    action,
+		ValidFrom: r.ValidFrom,
+		ValidTo:   r.ValidTo,
+	}
+	r.History = append(r.History, event)
+	return event
+}
+
+// SessionTCR is the code or label of the TCR selected for this session, empty
+// for the default TCR
+var SessionTCR = ""
+
+// defaultTCR is the TCR stored in config.json, which SepConfig.TCR differs
+// from when another TCR is selected for the session
+var defaultTCR *sep.TCR
+
+// loadTCRs reads tcrs.json. The default TCR is listed even if it was
+// registered before tcrs.json existed.
+func loadTCRs() ([]*TCRRecord, error) {
+	records := []*TCRRecord{}
+	buf, err := ioutil.ReadFile(currentWorkingDirectoryFilePath(tcrsFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &records); err != nil {
+			return nil, err
+		}
+	}
+	valid := []*TCRRecord{}
+	for _, it := range records {
+		if it != nil && it.TCR != nil {
+			valid = append(valid, it)
+		}
+	}
+	records = valid
+	if defaultTCR != nil {
+		found := false
+		for _, it := range records {
+			if it.TCR.TCRCode == defaultTCR.TCRCode {
+				found = true
+			}
+		}
+		if !found {
+			records = append([]*TCRRecord{{
+				Label: defaultTCR.BusinUnitCode,
+				TCR:   defaultTCR,
+			}}, records...)
+		}
+	}
+	now := time.Now()
+	for _, it := range records {
+		it.Status = it.status(now)
+	}
+	return records, nil
+}
+
+// saveTCRs writes tcrs.json and must be called under the data lock
+func saveTCRs(records []*TCRRecord) error {
+	buf, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(currentWorkingDirectoryFilePath(tcrsFileName), buf, 0644)
+}
+
+// findTCRRecord returns the record with the given TCR code or label
+func findTCRRecord(records []*TCRRecord, key string) *TCRRecord {
+	for _, it := range records {
+		if it.TCR.TCRCode == key {
+			return it
+		}
+	}
+	for _, it := range records {
+		if strings.EqualFold(it.Label, key) {
+			return it
+		}
+	}
+	return nil
+}
+
+// findTCR returns the registered TCR with the given code or label
+func findTCR(key string) (*TCRRecord, error) {
+	records, err := loadTCRs()
+	if err != nil {
+		return nil, err
+	}
+	if it := findTCRRecord(records, key); it != nil {
+		return it, nil
+	}
+	return nil, fmt.Errorf("ENU %s nije pronađen", key)
+}
+
+// tcrCode resolves a TCR label to its code; unknown keys are returned as they
+// are, so filters work for TCRs missing from tcrs.json
+func tcrCode(key string) string {
+	if key == "" {
+		return ""
+	}
+	if it, err := findTCR(key); err == nil {
+		return it.TCR.TCRCode
+	}
+	return key
+}
+
+// applySessionTCR makes the TCR selected for the session the one
+// SepConfig.TCR refers to
+func applySessionTCR() error {
+	if SessionTCR == "" {
+		return nil
+	}
+	it, err := findTCR(SessionTCR)
+	if err != nil {
+		return err
+	}
+	SepConfig.TCR = it.TCR
+	return nil
+}
+
+// withTCR runs fn with the TCR given by code or label as SepConfig.TCR. An
+// empty key keeps the TCR of the session.
+func withTCR(key string, fn func() error) error {
+	if key == "" {
+		return fn()
+	}
+	it, err := findTCR(key)
+	if err != nil {
+		return err
+	}
+	tcr := SepConfig.TCR
+	SepConfig.TCR = it.TCR
+	defer func() {
+		SepConfig.TCR = tcr
+	}()
+	return fn()
+}
+
+// newTCRRecord creates the record of a TCR from its registration request
+func newTCRRecord(elem *etree.Element, tcr *sep.TCR) *TCRRecord {
+	now := time.Now()
+	it := &TCRRecord{
+		Label:        tcr.BusinUnitCode,
+		TCR:          tcr,
+		TCRIntID:     elem.SelectAttrValue("TCRIntID", ""),
+		Type:         elem.SelectAttrValue("Type", ""),
+		ValidFrom:    elem.SelectAttrValue("ValidFrom", ""),
+		ValidTo:      elem.SelectAttrValue("ValidTo", ""),
+		RegisteredAt: &now,
+	}
+	if it.TCRIntID != "" {
+		it.Label = strings.Join([]string{tcr.BusinUnitCode, it.TCRIntID}, "/")
+	}
+	return it
+}
+
+// recordTCR adds a registered TCR to tcrs.json or, when a known TCR was
+// registered again with another validity, updates its record and history. It
+// must be called under the data lock and reports whether the TCR is new.
+func recordTCR(elem *etree.Element, tcr *sep.TCR) (bool, error) {
+	records, err := loadTCRs()
+	if err != nil {
+		return false, err
+	}
+	update := newTCRRecord(elem, tcr)
+	for _, it := range records {
+		if it.TCR.TCRCode != tcr.TCRCode {
+			continue
+		}
+		// archiving again after a crash changes nothing
+		if it.ValidFrom == update.ValidFrom && it.ValidTo == update.ValidTo && it.Type == update.Type {
+			return false, nil
+		}
+		action := tcrUpdated
+		switch {
+		case update.ValidTo != "" && (it.ValidTo == "" || update.ValidTo < it.ValidTo):
+			action = tcrDeactivated
+		case it.ValidTo != "" && (update.ValidTo == "" || update.ValidTo > it.ValidTo):
+			action = tcrReactivated
+			it.ReplacedBy = ""
+		}
+		it.Type, it.ValidFrom, it.ValidTo = update.Type, update.ValidFrom, update.ValidTo
+		it.addEvent(action)
+		return false, saveTCRs(records)
+	}
+	update.addEvent(tcrRegistered)
+	return true, saveTCRs(append(records, update))
+}
+
+// checkTCR refuses issuing on a TCR that is expired, replaced or not valid
+// yet at the given time. TCRs missing from tcrs.json are not checked.
+func checkTCR(tcr *sep.TCR, at time.Time) error {
+	records, err := loadTCRs()
+	if err != nil {
+		return err
+	}
+	it := findTCRRecord(records, tcr.TCRCode)
+	if it == nil {
+		return nil
+	}
+	switch it.status(at) {
+	case tcrExpired:
+		return fmt.Errorf("ENU %s je važio do %s", tcr.TCRCode, it.ValidTo)
+	case tcrPending:
+		return fmt.Errorf("ENU %s važi od %s", tcr.TCRCode, it.ValidFrom)
+	case tcrReplaced:
+		return fmt.Errorf("ENU %s je zamijenjen ENU %s", tcr.TCRCode, it.ReplacedBy)
+	}
+	return nil
+}
+
+// labelTCR renames a registered TCR
+func labelTCR(key, label string) (*TCRRecord, error) {
+	if label == "" {
+		return nil, fmt.Errorf("naziv ENU je obavezan")
+	}
+	var record *TCRRecord
+	err := withDataLock(func() error {
+		records, err := loadTCRs()
+		if err != nil {
+			return err
+		}
+		if record = findTCRRecord(records, key); record == nil {
+			return fmt.Errorf("ENU %s nije pronađen", key)
+		}
+		if it := findTCRRecord(records, label); it != nil && it != record {
+			return fmt.Errorf("naziv %s već koristi ENU %s", label, it.TCR.TCRCode)
+		}
+		record.Label = label
+		return saveTCRs(records)
+	})
+	return record, err
+}
+
+// setDefaultTCR stores the TCR in config.json, so it is used by every
+// session that does not select another one
+func setDefaultTCR(key string) (*TCRRecord, error) {
+	var record *TCRRecord
+	err := withDataLock(func() error {
+		if err := loadConfig(); err != nil {
+			return err
+		}
+		records, err := loadTCRs()
+		if err != nil {
+			return err
+		}
+		if record = findTCRRecord(records, key); record == nil {
+			return fmt.Errorf("ENU %s nije pronađen", key)
+		}
+		// the list is saved before the default changes, so the previous
+		// default stays listed
+		if err := saveTCRs(records); err != nil {
+			return err
+		}
+		defaultTCR = record.TCR
+		return saveSepConfig()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, applySessionTCR()
+}
+
+// updateTCR registers a recorded TCR again with the given last day of
+// validity, empty for no end. The TCR keeps its code.
+func updateTCR(p *Pipeline, record *TCRRecord, validTo string) (*Transaction, error) {
+	if validTo != "" {
+		if _, err := time.Parse("2006-01-02", validTo); err != nil {
+			return nil, fmt.Errorf("pogrešan datum %s", validTo)
+		}
+		if record.ValidFrom != "" && validTo < validityDay(record.ValidFrom) {
+			return nil, fmt.Errorf("ENU %s važi od %s", record.TCR.TCRCode, record.ValidFrom)
+		}
+	}
+	in := record.input(validTo)
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeTCRRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return tx, err
+	}
+	if tx.TCRCode != record.TCR.TCRCode {
+		return tx, fmt.Errorf("poreska je registrovala novi ENU %s umjesto izmjene ENU %s", tx.TCRCode, record.TCR.TCRCode)
+	}
+	return tx, nil
+}
+
+// deactivateTCR closes the TCR, which stays valid until the end of validTo,
+// today by default
+func deactivateTCR(p *Pipeline, key, validTo string) (*Transaction, error) {
+	record, err := findTCR(key)
+	if err != nil {
+		return nil, err
+	}
+	if validTo == "" {
+		validTo = time.Now().Format("2006-01-02")
+	}
+	return updateTCR(p, record, validTo)
+}
+
+// reactivateTCR makes a closed TCR valid again, until validTo if given
+func reactivateTCR(p *Pipeline, key, validTo string) (*Transaction, error) {
+	record, err := findTCR(key)
+	if err != nil {
+		return nil, err
+	}
+	if record.ValidTo == "" {
+		return nil, fmt.Errorf("ENU %s nije deaktiviran", record.TCR.TCRCode)
+	}
+	if validTo != "" && validTo <= validityDay(record.ValidTo) {
+		return nil, fmt.Errorf("ENU %s već važi do %s", record.TCR.TCRCode, record.ValidTo)
+	}
+	return updateTCR(p, record, validTo)
+}
+
+// replaceTCR registers a new TCR in place of a retired device. Codes missing
+// from input are taken from the old TCR, which is closed today and marked as
+// replaced. Like every new TCR, the new one becomes the default.
+func replaceTCR(newPipeline func() *Pipeline, key string, in *TCRInput) (*Transaction, error) {
+	record, err := findTCR(key)
+	if err != nil {
+		return nil, err
+	}
+	if record.ReplacedBy != "" {
+		return nil, fmt.Errorf("ENU %s je već zamijenjen ENU %s", record.TCR.TCRCode, record.ReplacedBy)
+	}
+	old := record.input("")
+	if in.BusinUnitCode == "" {
+		in.BusinUnitCode = old.BusinUnitCode
+	}
+	if in.SoftCode == "" {
+		in.SoftCode = old.SoftCode
+	}
+	if in.MaintainerCode == "" {
+		in.MaintainerCode = old.MaintainerCode
+	}
+	if in.Type == "" {
+		in.Type = old.Type
+	}
+	if in.InternalID == "" || (in.BusinUnitCode == old.BusinUnitCode && in.InternalID == old.InternalID) {
+		return nil, fmt.Errorf("novi ENU mora imati drugi interni broj")
+	}
+	// the old TCR can't be closed before it becomes valid
+	closeOn := time.Now().Format("2006-01-02")
+	if record.ValidFrom != "" && validityDay(record.ValidFrom) > closeOn {
+		closeOn = validityDay(record.ValidFrom)
+	}
+
+	p := newPipeline()
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeTCRRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return tx, err
+	}
+
+	if record.ValidTo == "" || validityDay(record.ValidTo) > closeOn {
+		if _, err := updateTCR(newPipeline(), record, closeOn); err != nil {
+			return tx, err
+		}
+	}
+	err = withDataLock(func() error {
+		records, err := loadTCRs()
+		if err != nil {
+			return err
+		}
+		it := findTCRRecord(records, record.TCR.TCRCode)
+		if it == nil {
+			return fmt.Errorf("ENU %s nije pronađen", record.TCR.TCRCode)
+		}
+		it.ReplacedBy = tx.TCRCode
+		it.addEvent(tcrReplaced).TCRCode = tx.TCRCode
+		return saveTCRs(records)
+	})
+	return tx, err
+}
+
+// TCRListItem is a registered TCR as listed by tcr list
+type TCRListItem struct {
+	*TCRRecord
+	Default  bool `json:"default"`
+	Selected bool `json:"selected"`
+}
+
+// listTCRs returns all registered TCRs, marking the default one and the one
+// in use
+func listTCRs() ([]*TCRListItem, error) {
+	records, err := loadTCRs()
+	if err != nil {
+		return nil, err
+	}
+	items := []*TCRListItem{}
+	for _, it := range records {
+		items = append(items, &TCRListItem{
+			TCRRecord: it,
+			Default:   defaultTCR != nil && it.TCR.TCRCode == defaultTCR.TCRCode,
+			Selected:  SepConfig.TCR != nil && it.TCR.TCRCode == SepConfig.TCR.TCRCode,
+		})
+	}
+	return items, nil
+}
+
+// printTCRs prints TCRs as a numbered table
+func printTCRs(items []*TCRListItem) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tNAZIV\tENU\tPOSLOVNA JEDINICA\tVAŽI OD\tVAŽI DO\tSTATUS\t")
+	for i, it := range items {
+		mark := ""
+		if it.Selected {
+			mark = "*"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			i+1,
+			it.Label,
+			it.TCR.TCRCode,
+			it.TCR.BusinUnitCode,
+			it.ValidFrom,
+			it.ValidTo,
+			it.Status,
+			mark,
+		)
+	}
+	w.Flush()
+}
+
+// activeTCRs returns the TCRs invoices can be issued on
+func activeTCRs(items []*TCRListItem) []*TCRListItem {
+	active := []*TCRListItem{}
+	for _, it := range items {
+		if it.Status == tcrActive {
+			active = append(active, it)
+		}
+	}
+	return active
+}
+
+// chooseSessionTCR asks which TCR to use when more than one is active
+func chooseSessionTCR() error {
+	items, err := listTCRs()
+	if err != nil {
+		return err
+	}
+	if SepConfig.TCR != nil {
+		if err := checkTCR(SepConfig.TCR, time.Now()); err != nil {
+			fmt.Printf("UPOZORENJE: %v, izaberite drugi ENU\n", err)
+		}
+	}
+	items = activeTCRs(items)
+	if len(items) < 2 {
+		return nil
+	}
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("Registrovano je više ENU, označen je podrazumijevani")
+	printTCRs(items)
+	for {
+		stringValue := gen.Scan("Izaberite ENU za ovu sesiju, prazno za podrazumijevani: ")
+		if stringValue == "" {
+			return nil
+		}
+		index, err := strconv.Atoi(stringValue)
+		if err != nil || index < 1 || index > len(items) {
+			fmt.Println("Pogrešan broj")
+			continue
+		}
+		SessionTCR = items[index-1].TCR.TCRCode
+		return applySessionTCR()
+	}
+}
+
+// printTCRHistory prints the changes of a TCR, oldest first
+func printTCRHistory(record *TCRRecord) {
+	if len(record.History) == 0 {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VRIJEME\tPROMJENA\tVAŽI OD\tVAŽI DO\tENU\t")
+	for _, it := range record.History {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t\n",
+			it.At.Format("2006-01-02 15:04"),
+			it.Action,
+			it.ValidFrom,
+			it.ValidTo,
+			it.TCRCode,
+		)
+	}
+	w.Flush()
+}
+
+// scanTCRReplacement asks for the codes of the TCR replacing a retired device
+func scanTCRReplacement() *TCRInput {
+	return &TCRInput{
+		InternalID:     gen.Scan("Interni broj novog ENU: "),
+		SoftCode:       gen.Scan("Kôd softvera, prazno za isti: "),
+		MaintainerCode: gen.Scan("Kôd održavaoca, prazno za isti: "),
+	}
+}
+
+func selectTCRMenu() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("UPRAVLJANJE ENU")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	items, err := listTCRs()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		fmt.Println("Nema registrovanih ENU")
+		_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+		return nil
+	}
+	printTCRs(items)
+
+	stringValue := gen.Scan("Izaberite broj ENU, prazno za izlaz: ")
+	if stringValue == "" {
+		return nil
+	}
+	index, err := strconv.Atoi(stringValue)
+	if err != nil || index < 1 || index > len(items) {
+		return fmt.Errorf("pogrešan broj ENU")
+	}
+	it := items[index-1]
+	printTCRHistory(it.TCRRecord)
+	fmt.Println("[1] Koristi u ovoj sesiji")
+	fmt.Println("[2] Postavi kao podrazumijevani")
+	fmt.Println("[3] Promijeni naziv")
+	fmt.Println("[4] Deaktiviraj")
+	fmt.Println("[5] Ponovo aktiviraj")
+	fmt.Println("[6] Zamijeni uređaj")
+	newPipeline := func() *Pipeline {
+		return withProgress(newTCRPipeline())
+	}
+	switch gen.Scan("Izaberite općiju: ") {
+	case "1":
+		SessionTCR = it.TCR.TCRCode
+		if err := applySessionTCR(); err != nil {
+			return err
+		}
+	case "2":
+		if _, err := setDefaultTCR(it.TCR.TCRCode); err != nil {
+			return err
+		}
+	case "3":
+		if _, err := labelTCR(it.TCR.TCRCode, gen.Scan("Novi naziv: ")); err != nil {
+			return err
+		}
+	case "4":
+		if err := loadOrSetSigner(); err != nil {
+			return err
+		}
+		validTo := gen.Scan("Posljednji dan važenja (2021-01-01), prazno za danas: ")
+		if _, err := deactivateTCR(newPipeline(), it.TCR.TCRCode, validTo); err != nil {
+			return err
+		}
+	case "5":
+		if err := loadOrSetSigner(); err != nil {
+			return err
+		}
+		validTo := gen.Scan("Posljednji dan važenja (2021-01-01), prazno bez ograničenja: ")
+		if _, err := reactivateTCR(newPipeline(), it.TCR.TCRCode, validTo); err != nil {
+			return err
+		}
+	case "6":
+		if err := loadOrSetSigner(); err != nil {
+			return err
+		}
+		tx, err := replaceTCR(newPipeline, it.TCR.TCRCode, scanTCRReplacement())
+		if err != nil {
+			return err
+		}
+		if label := gen.Scan("Naziv novog ENU, prazno za kôd poslovne jedinice: "); label != "" {
+			if _, err := labelTCR(tx.TCRCode, label); err != nil {
+				return err
+			}
+		}
+	default:
+		return nil
+	}
+	fmt.Println("Detalji su uspešno sačuvani")
+	return nil
+}
+
+func tcrListCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return listTCRs()
+}
+
+func tcrUseCommand(args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return setDefaultTCR(args[0])
+}
+
+func tcrLabelCommand(args []string) (interface{}, error) {
+	if len(args) != 2 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	return labelTCR(args[0], args[1])
+}
+
+func tcrDeactivateCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("tcr deactivate")
+	validTo := fs.String("valid-to", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	tx, err := deactivateTCR(newTCRPipeline(), fs.Arg(0), *validTo)
+	if tx == nil {
+		return nil, err
+	}
+	return newTransactionOutput(tx), err
+}
+
+func tcrReactivateCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("tcr reactivate")
+	validTo := fs.String("valid-to", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	tx, err := reactivateTCR(newTCRPipeline(), fs.Arg(0), *validTo)
+	if tx == nil {
+		return nil, err
+	}
+	return newTransactionOutput(tx), err
+}
+
+func tcrReplaceCommand(args []string) (interface{}, error) {
+	in := &TCRInput{}
+	fs := newFlagSet("tcr replace")
+	fs.StringVar(&in.InternalID, "internal-id", "", "")
+	fs.StringVar(&in.SoftCode, "soft-code", "", "")
+	fs.StringVar(&in.MaintainerCode, "maintainer-code", "", "")
+	fs.StringVar(&in.ValidFrom, "valid-from", "", "")
+	label := fs.String("label", "", "")
+	if err := fs.Parse(args); err != nil || in.InternalID == "" || fs.NArg() != 1 {
+		return nil, errUsage
+	}
+	if err := requireConfig(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+	tx, err := replaceTCR(newTCRPipeline, fs.Arg(0), in)
+	if tx == nil {
+		return nil, err
+	}
+	if err == nil && *label != "" {
+		_, err = labelTCR(tx.TCRCode, *label)
+	}
+	return newTransactionOutput(tx), err
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Kinds of problems found in the archive
+const (
+	problemMissing      = "missing"
+	problemOrphaned     = "orphaned"
+	problemInconsistent = "inconsistent"
+	problemSignature    = "invalid_signature"
+	problemIIC          = "invalid_iic"
+	problemLedger       = "ledger"
+	problemUnsealed     = "unsealed"
+)
+
+// ArchiveProblem is a file of the archive that failed verification
+type ArchiveProblem struct {
+	File    string `json:"file"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// ArchiveReport is the result of verify-archive
+type ArchiveReport struct {
+	VerifiedAt  time.Time         `json:"verified_at"`
+	Checked     int               `json:"checked"`
+	Valid       int               `json:"valid"`
+	Reformatted int               `json:"reformatted,omitempty"`
+	Ledger      *LedgerReport     `json:"ledger"`
+	Problems    []*ArchiveProblem `json:"problems"`
+}
+
+func (r *ArchiveReport) add(filePath, kind, format string, args ...interface{}) {
+	r.Problems = append(r.Problems, &ArchiveProblem{
+		File:    relativePath(filePath),
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// stripWhitespace removes whitespace between elements, as added by
+// IndentTabs
+func stripWhitespace(e *etree.Element) {
+	blanks := []etree.Token{}
+	for _, it := range e.Child {
+		if cd, ok := it.(*etree.CharData); ok && strings.TrimSpace(cd.Data) == "" {
+			blanks = append(blanks, it)
+		}
+	}
+	for _, it := range blanks {
+		e.RemoveChild(it)
+	}
+	for _, it := range e.ChildElements() {
+		stripWhitespace(it)
+	}
+}
+
+// verifyArchivedRequest checks signature and IIC of an archived request. Early
+// versions of fisc indented requests when archiving them, so a request is
+// also accepted if it verifies without the whitespace between elements.
+func verifyArchivedRequest(request *etree.Element) (reformatted bool, kind string, err error) {
+	invoice := findChild(request, "Invoice")
+	if invoice == nil {
+		return false, problemInconsistent, fmt.Errorf("invalid xml, no Invoice")
+	}
+	cert, err := verifySignature(request)
+	if err != nil {
+		compact := request.Copy()
+		stripWhitespace(compact)
+		if _, compactErr := verifySignature(compact); compactErr != nil {
+			return false, problemSignature, err
+		}
+		reformatted = true
+		if cert, err = signatureCertificate(findChild(request, "Signature")); err != nil {
+			return false, problemSignature, err
+		}
+	}
+	if err := verifyIIC(invoice, cert); err != nil {
+		return reformatted, problemIIC, err
+	}
+	return reformatted, "", nil
+}
+
+// verifyArchivedInvoice checks a request with its response and reports
+// whether both are valid
+func verifyArchivedInvoice(report *ArchiveReport, requestFilePath string) bool {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(requestFilePath); err != nil {
+		report.add(requestFilePath, problemInconsistent, "%v", err)
+		return false
+	}
+	request := doc.Root()
+	if request == nil || request.Tag != "RegisterInvoiceRequest" {
+		report.add(requestFilePath, problemInconsistent, "invalid xml, no RegisterInvoiceRequest")
+		return false
+	}
+	valid := true
+
+	reformatted, kind, err := verifyArchivedRequest(request)
+	if err != nil {
+		report.add(requestFilePath, kind, "%v", err)
+		valid = false
+	} else if reformatted {
+		report.Reformatted++
+	}
+
+	// file name is <IssueDateTime>_<TCRCode>_<IIC>_request.xml
+	if invoice := findChild(request, "Invoice"); invoice != nil {
+		name := filepath.Base(archiveBase(requestFilePath))
+		issueDateTime, _ := time.Parse(time.RFC3339, invoice.SelectAttrValue("IssueDateTime", ""))
+		expected := strings.Join([]string{
+			issueDateTime.Format("20060102150405"),
+			invoice.SelectAttrValue("TCRCode", ""),
+			invoice.SelectAttrValue("IIC", ""),
+		}, "_")
+		if name != expected {
+			report.add(requestFilePath, problemInconsistent, "file name does not match invoice %s", expected)
+			valid = false
+		}
+	}
+
+	responseFilePath := archiveBase(requestFilePath) + "_response.xml"
+	doc = etree.NewDocument()
+	if err := doc.ReadFromFile(responseFilePath); err != nil {
+		if os.IsNotExist(err) {
+			report.add(responseFilePath, problemMissing, "no response for %s", filepath.Base(requestFilePath))
+		} else {
+			report.add(responseFilePath, problemInconsistent, "%v", err)
+		}
+		return false
+	}
+	fic := findDescendant(doc.Root(), "FIC")
+	if fic == nil || strings.TrimSpace(fic.Text()) == "" {
+		// invoices registered before their FIC was lost are archived without
+		// it, with the fault of the subsequent delivery
+		if meta, err := loadArchiveMeta(requestFilePath); err != nil || meta.Fault == "" {
+			report.add(responseFilePath, problemInconsistent, "no FIC in response")
+			valid = false
+		}
+	}
+	requestUUID := ""
+	if header := findChild(request, "Header"); header != nil {
+		requestUUID = header.SelectAttrValue("UUID", "")
+	}
+	if header := findChild(doc.Root(), "Header"); header != nil {
+		if it := header.SelectAttrValue("RequestUUID", ""); it != "" && it != requestUUID {
+			report.add(responseFilePath, problemInconsistent, "response to request %s, not %s", it, requestUUID)
+			valid = false
+		}
+	}
+	return valid
+}
+
+// verifyArchive checks every invoice in records and reports missing,
+// orphaned and inconsistent files, including invoices the index knows of
+// but records do not have
+func verifyArchive() (*ArchiveReport, error) {
+	report := &ArchiveReport{VerifiedAt: time.Now(), Problems: []*ArchiveProblem{}}
+
+	recordsDir := currentWorkingDirectoryFilePath("records")
+	days, err := ioutil.ReadDir(recordsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	requests := map[string]bool{}
+	for _, day := range days {
+		if !day.IsDir() {
+			continue
+		}
+		dayDir := filepath.Join(recordsDir, day.Name())
+		files, err := ioutil.ReadDir(dayDir)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if strings.HasSuffix(fi.Name(), "_request.xml") {
+				requests[filepath.Join(dayDir, fi.Name())] = true
+			}
+		}
+		for _, fi := range files {
+			filePath := filepath.Join(dayDir, fi.Name())
+			switch {
+			case strings.HasSuffix(fi.Name(), "_request.xml"):
+				report.Checked++
+				if verifyArchivedInvoice(report, filePath) {
+					report.Valid++
+				}
+			case strings.HasSuffix(fi.Name(), "_response.xml"),
+				strings.HasSuffix(fi.Name(), "_request.pdf"),
+				strings.HasSuffix(fi.Name(), "_meta.json"):
+				base := filePath[:strings.LastIndex(filePath, "_")]
+				if !requests[base+"_request.xml"] {
+					report.add(filePath, problemOrphaned, "no request for %s", fi.Name())
+				}
+			}
+		}
+	}
+
+	// invoices indexed but no longer in records
+	err = withIndex(func(db *bolt.DB) error {
+		return db.View(func(tx *bolt.Tx) error {
+			return tx.Bucket(invoicesBucket).ForEach(func(k, v []byte) error {
+				e, err := getIndexEntry(tx, string(k))
+				if err != nil {
+					return err
+				}
+				if requestFilePath := absolutePath(e.Request); !requests[requestFilePath] {
+					report.add(requestFilePath, problemMissing, "invoice %s is indexed but not archived", e.IIC)
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the hash chain shows files changed or deleted since they were archived
+	if report.Ledger, err = verifyLedger(); err != nil {
+		return nil, err
+	}
+	if it := report.Ledger.Broken; it != nil {
+		report.add(absolutePath(it.File), problemLedger, "entry %d: %s", it.Seq, it.Reason)
+	}
+	for _, it := range report.Ledger.Unsealed {
+		report.add(absolutePath(it), problemUnsealed, "not in %s", ledgerFileName)
+	}
+
+	sort.SliceStable(report.Problems, func(i, j int) bool {
+		return report.Problems[i].File < report.Problems[j].File
+	})
+	return report, nil
+}
+
+func verifyArchiveCommand(args []string) (interface{}, error) {
+	if len(args) != 0 {
+		return nil, errUsage
+	}
+	report, err := verifyArchive()
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Problems) > 0 {
+		return report, fmt.Errorf("arhiva nije ispravna, problema: %d", len(report.Problems))
+	}
+	return report, nil
+}
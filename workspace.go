@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// lockFileName is the data directory lock
+	lockFileName = "fisc.lock"
+	// lockTimeout is how long to wait for another instance to release the lock
+	lockTimeout = 60 * time.Second
+	// lockStaleAfter is how long a lock of another host may go without being
+	// refreshed before it is considered abandoned
+	lockStaleAfter = 10 * time.Minute
+)
+
+func workspacesDir() string {
+	return currentWorkingDirectoryFilePath("work")
+}
+
+// newWorkspace creates an isolated directory for a single transaction
+func newWorkspace() (string, error) {
+	dir := filepath.Join(workspacesDir(), strings.Join([]string{time.Now().Format("20060102150405"), newUUID()}, "_"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// removeWorkspace removes a transaction workspace; other directories are left
+// untouched
+func removeWorkspace(dir string) error {
+	rel, err := filepath.Rel(workspacesDir(), dir)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return nil
+	}
+	return os.RemoveAll(dir)
+}
+
+// discardTransaction removes files of a failed transaction, unless they are
+// needed to finish it later
+func discardTransaction(tx *Transaction) {
+	if tx.Journal != nil && tx.Journal.status(StageRegister) == journalDone {
+		return
+	}
+	cleanupStage(tx)
+}
+
+// DataLock is the content of the lock file, identifying its owner
+type DataLock struct {
+	Host  string    `json:"host"`
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+// ownerRunning reports whether another fisc process, identified by host and
+// pid, is still running. Processes of other hosts can't be checked and are
+// taken for running.
+func ownerRunning(host string, pid int) bool {
+	if host == "" || pid == 0 {
+		return false
+	}
+	if current, _ := os.Hostname(); host != current {
+		return true
+	}
+	return pid != os.Getpid() && processAlive(pid)
+}
+
+// lockDataDir takes the exclusive lock on the data directory, waiting for
+// other fisc instances to release it. The lock is refreshed while it is held,
+// so instances on other hosts can tell it from an abandoned one. The returned
+// func releases the lock.
+func lockDataDir() (func(), error) {
+	lockFilePath := currentWorkingDirectoryFilePath(lockFileName)
+	host, _ := os.Hostname()
+	buf, err := json.Marshal(&DataLock{Host: host, PID: os.Getpid(), Since: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(lockTimeout)
+	for {
+		f, err := os.OpenFile(lockFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.Write(buf)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockFilePath)
+				return nil, err
+			}
+			return refreshDataLock(lockFilePath), nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		owner := readDataLock(lockFilePath)
+		if dataLockStale(lockFilePath, owner) {
+			// another waiter may have taken it over in the meantime
+			if it := readDataLock(lockFilePath); (it == nil) == (owner == nil) && (it == nil || *it == *owner) {
+				os.Remove(lockFilePath)
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			if owner != nil {
+				return nil, fmt.Errorf("podaci su zaključani od %s (pid %d) od %s", owner.Host, owner.PID, owner.Since.Format("2006-01-02 15:04:05"))
+			}
+			return nil, fmt.Errorf("podaci su zaključani, %s", lockFilePath)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// dataLockStale reports whether the lock was abandoned: its owner on this
+// host is gone, or the owner on another host stopped refreshing it
+func dataLockStale(lockFilePath string, owner *DataLock) bool {
+	fi, err := os.Stat(lockFilePath)
+	if err != nil {
+		return false
+	}
+	unrefreshed := time.Since(fi.ModTime()) > lockStaleAfter
+	if owner == nil {
+		// not written yet, or left broken by a crash
+		return unrefreshed
+	}
+	if !ownerRunning(owner.Host, owner.PID) {
+		return true
+	}
+	host, _ := os.Hostname()
+	return owner.Host != host && unrefreshed
+}
+
+// refreshDataLock keeps touching the lock file until the returned func
+// releases it
+func refreshDataLock(lockFilePath string) func() {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockStaleAfter / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				os.Chtimes(lockFilePath, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		os.Remove(lockFilePath)
+	}
+}
+
+func readDataLock(lockFilePath string) *DataLock {
+	buf, err := ioutil.ReadFile(lockFilePath)
+	if err != nil {
+		return nil
+	}
+	owner := &DataLock{}
+	if err := json.Unmarshal(buf, owner); err != nil {
+		return nil
+	}
+	return owner
+}
+
+// dataLock is the data directory lock held by this process. It is shared by
+// nested withDataLock calls of the goroutine holding it, e.g. the archive
+// stage updating clients.
+var dataLock struct {
+	sync.Mutex
+	owner  uint64
+	depth  int
+	unlock func()
+}
+
+// dataLockReleased wakes goroutines waiting for another one to release
+// dataLock
+var dataLockReleased = sync.NewCond(&dataLock.Mutex)
+
+// withDataLock runs fn while holding the data directory lock. Calls made
+// from fn reuse the lock instead of waiting for it, calls from other
+// goroutines wait until it is released.
+func withDataLock(fn func() error) error {
+	id := goroutineID()
+	dataLock.Lock()
+	for dataLock.depth > 0 && dataLock.owner != id {
+		dataLockReleased.Wait()
+	}
+	if dataLock.depth == 0 {
+		unlock, err := lockDataDir()
+		if err != nil {
+			dataLock.Unlock()
+			return err
+		}
+		dataLock.owner = id
+		dataLock.unlock = unlock
+	}
+	dataLock.depth++
+	dataLock.Unlock()
+
+	defer func() {
+		dataLock.Lock()
+		dataLock.depth--
+		if dataLock.depth == 0 {
+			dataLock.unlock()
+			dataLock.unlock = nil
+			dataLock.owner = 0
+			dataLockReleased.Broadcast()
+		}
+		dataLock.Unlock()
+	}()
+	return fn()
+}
+
+// goroutineID returns the ID of the calling goroutine, which its stack trace
+// starts with
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	// goroutine 18 [running]:
+	fields := bytes.Fields(buf)
+	if len(fields) < 2 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(string(fields[1]), 10, 64)
+	return id
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDataLockWaitsForOtherGoroutines(t *testing.T) {
+	WorkDir = t.TempDir()
+
+	held := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		done <- withDataLock(func() error {
+			close(held)
+			<-release
+			return nil
+		})
+	}()
+	<-held
+
+	entered := make(chan struct{})
+	go func() {
+		done <- withDataLock(func() error {
+			close(entered)
+			return nil
+		})
+	}()
+	select {
+	case <-entered:
+		t.Fatal("another goroutine took the lock while it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-entered
+
+	// nested calls of the goroutine holding the lock reuse it
+	err := withDataLock(func() error {
+		return withDataLock(func() error { return nil })
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/noshto/gen"
+)
+
+// wtnFiles are the intermediate files of a warehouse transfer note
+var wtnFiles = Files{
+	Gen:    "wtn.xml",
+	IIC:    "wtn.iic.xml",
+	Signed: "wtn.dsig.xml",
+	Reg:    "wtn.reg.xml",
+	PDF:    "wtn.pdf",
+}
+
+// wtnDir is the folder of a records day holding transfer notes, kept apart
+// from invoices
+const wtnDir = "wtn"
+
+// newWTNPipeline creates a pipeline registering a warehouse transfer note.
+// The generate stage is set by the caller.
+func newWTNPipeline() *Pipeline {
+	p := NewPipeline("wtn", wtnFiles)
+	p.Stages[StageIIC] = writeWTNICStage
+	p.Stages[StageSign] = signStage
+	p.Stages[StageRegister] = registerWTNStage
+	p.Stages[StageRender] = renderWTNStage
+	p.Stages[StageArchive] = archiveWTNStage
+	p.Stages[StageCleanup] = cleanupStage
+	return withJournal(p)
+}
+
+// writeWTNICStage computes the WTNIC of the generated transfer note
+func writeWTNICStage(tx *Transaction) error {
+	signer, err := currentSigner()
+	if err != nil {
+		return err
+	}
+	if err := signer.WriteWTNIC(tx.GenFile, tx.IICFile); err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.IICFile); err != nil {
+		return err
+	}
+	wtn := doc.FindElement("//WTN")
+	if wtn == nil {
+		return fmt.Errorf("invalid xml, no WTN")
+	}
+	tx.WTNIC = wtn.SelectAttrValue("WTNIC", "")
+	return nil
+}
+
+// registerWTNStage registers the transfer note and checks that a FWTNIC was
+// issued
+func registerWTNStage(tx *Transaction) error {
+	if err := registerStage(tx); err != nil {
+		return err
+	}
+	buf, err := ioutil.ReadFile(tx.RegFile)
+	if err != nil {
+		return err
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buf); err != nil {
+		return &DeliveryError{Err: fmt.Errorf("invalid response, %v", err)}
+	}
+	fwtnic := findDescendant(doc.Root(), "FWTNIC")
+	if fwtnic == nil || strings.TrimSpace(fwtnic.Text()) == "" {
+		return responseError(buf)
+	}
+	tx.FWTNIC = strings.TrimSpace(fwtnic.Text())
+	return nil
+}
+
+// wtnPointLabels name the kinds of premises on the printed transfer note
+var wtnPointLabels = map[string]string{
+	"WAREHOUSE":               "skladište",
+	"EXHIBITION":              "izložbeni prostor",
+	"STORE":                   "prodavnica",
+	"SALE":                    "prodaja",
+	"ANOTHERPERSONSWAREHOUSE": "skladište drugog lica",
+	"CUSTOMSWAREHOUSE":        "carinsko skladište",
+	"OTHER":                   "ostalo",
+}
+
+// renderWTNStage writes the transfer note PDF from the registered request
+func renderWTNStage(tx *Transaction) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.SignedFile); err != nil {
+		return err
+	}
+	wtn := doc.FindElement("//WTN")
+	if wtn == nil {
+		return fmt.Errorf("invalid xml, no WTN")
+	}
+	issuer := findChild(wtn, "Issuer")
+	attr := func(e *etree.Element, key string) string {
+		if e == nil {
+			return ""
+		}
+		return e.SelectAttrValue(key, "")
+	}
+	dateTimeCreated, err := time.Parse(time.RFC3339, attr(wtn, "DateTimeCreated"))
+	if err != nil {
+		return err
+	}
+
+	p := newTextPDF()
+	p.line(16, true, "OTPREMNICA")
+	p.line(11, false, fmt.Sprintf("Broj: %s", attr(wtn, "WTNNum")))
+	p.space(8)
+	p.line(10, true, attr(issuer, "Name"))
+	p.line(9, false, fmt.Sprintf("PIB: %s", attr(issuer, "IDNum")))
+	p.line(9, false, strings.Join([]string{attr(issuer, "Address"), attr(issuer, "Town")}, ", "))
+	p.space(8)
+
+	labels := []float64{0, 140}
+	p.columns(9, false, labels, "Datum kreiranja:", dateTimeCreated.Format("02.01.2006 15:04"))
+	p.columns(9, false, labels, "Datum prevoza:", attr(wtn, "TransDate"))
+	p.columns(9, false, labels, "Polazište:", fmt.Sprintf("%s, %s (%s)", attr(wtn, "StartAddr"), attr(wtn, "StartCity"), wtnPointLabels[attr(wtn, "StartPoint")]))
+	p.columns(9, false, labels, "Odredište:", fmt.Sprintf("%s, %s (%s)", attr(wtn, "DestinAddr"), attr(wtn, "DestinCity"), wtnPointLabels[attr(wtn, "DestinPoint")]))
+	ownership := "sopstveno"
+	if attr(wtn, "VehOwnership") == "THIRDPARTY" {
+		ownership = "treće lice"
+	}
+	p.columns(9, false, labels, "Vozilo:", fmt.Sprintf("%s (%s)", attr(wtn, "VehPlates"), ownership))
+	p.columns(9, false, labels, "Kôd operatera:", attr(wtn, "OperatorCode"))
+	p.space(8)
+
+	columns := []float64{0, 30, 330, 410, 450}
+	p.rule()
+	p.columns(9, true, columns, "RB", "Naziv", "Šifra", "Jed.", "Količina")
+	p.rule()
+	items := []*etree.Element{}
+	if it := findChild(wtn, "Items"); it != nil {
+		items = it.ChildElements()
+	}
+	for i, it := range items {
+		name := []rune(it.SelectAttrValue("N", ""))
+		if len(name) > 55 {
+			name = name[:55]
+		}
+		p.columns(9, false, columns, strconv.Itoa(i+1), string(name), it.SelectAttrValue("C", ""), it.SelectAttrValue("U", ""), it.SelectAttrValue("Q", ""))
+	}
+	p.rule()
+	p.space(8)
+
+	p.columns(8, false, []float64{0, 90}, "IKOF otpremnice:", tx.WTNIC)
+	p.columns(8, false, []float64{0, 90}, "JIK otpremnice:", tx.FWTNIC)
+	return ioutil.WriteFile(tx.PDFFile, p.bytes(), 0644)
+}
+
+// archiveWTNStage copies the results into records/<DATE>/wtn and puts the
+// PDF next to fisc, like invoices
+func archiveWTNStage(tx *Transaction) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromFile(tx.SignedFile); err != nil {
+		return err
+	}
+	request := doc.FindElement("//RegisterWTNRequest")
+	wtn := findChild(request, "WTN")
+	if wtn == nil {
+		return fmt.Errorf("invalid xml, no WTN")
+	}
+	dateTimeCreated, err := time.Parse(time.RFC3339, wtn.SelectAttrValue("DateTimeCreated", ""))
+	if err != nil {
+		return err
+	}
+
+	dir := currentWorkingDirectoryFilePath(filepath.Join("records", dateTimeCreated.Format("2006-01-02"), wtnDir))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := strings.Join([]string{
+		dateTimeCreated.Format("20060102150405"),
+		wtn.SelectAttrValue("BusinUnitCode", ""),
+		wtn.SelectAttrValue("WTNIC", ""),
+	}, "_")
+	base := filepath.Join(dir, name)
+
+	// like invoices, the signed request is kept as it is
+	reqDoc := etree.NewDocument()
+	reqDoc.SetRoot(request.Copy())
+	attachScope(reqDoc.Root(), request)
+	if err := reqDoc.WriteToFile(base + "_request.xml"); err != nil {
+		return err
+	}
+
+	doc = etree.NewDocument()
+	if err := doc.ReadFromFile(tx.RegFile); err != nil {
+		return err
+	}
+	response := doc.FindElement("//RegisterWTNResponse")
+	if response == nil {
+		return fmt.Errorf("invalid xml, no RegisterWTNResponse")
+	}
+	respDoc := etree.NewDocument()
+	respDoc.SetRoot(response.Copy())
+	respDoc.IndentTabs()
+	respDoc.Root().SetTail("")
+	if err := respDoc.WriteToFile(base + "_response.xml"); err != nil {
+		return err
+	}
+
+	if err := copyFile(tx.PDFFile, base+"_request.pdf"); err != nil {
+		return err
+	}
+	tx.PDFFilePath = currentWorkingDirectoryFilePath(name + "_request.pdf")
+	if err := copyFile(tx.PDFFile, tx.PDFFilePath); err != nil {
+		return err
+	}
+	tx.Folder = dir
+	return nil
+}
+
+// scanWTNInput asks the user for transfer note details
+func scanWTNInput() (*WTNInput, error) {
+	in := &WTNInput{}
+	var err error
+	if in.OrdNum, err = strconv.ParseUint(gen.Scan("Redni broj otpremnice: "), 10, 64); err != nil {
+		return nil, err
+	}
+	in.VehPlates = gen.Scan("Registarske tablice vozila: ")
+	fmt.Println("Vlasništvo vozila")
+	fmt.Println("[1] Sopstveno")
+	fmt.Println("[2] Treće lice")
+	if gen.Scan("Vlasništvo: ") == "2" {
+		in.VehOwnership = "THIRDPARTY"
+	}
+	in.StartAddr = gen.Scan("Adresa polazišta: ")
+	in.StartCity = gen.Scan("Grad polazišta: ")
+	in.StartPoint = gen.Scan("Vrsta polazišta (WAREHOUSE, STORE, ...), prazno za WAREHOUSE: ")
+	in.DestinAddr = gen.Scan("Adresa odredišta: ")
+	in.DestinCity = gen.Scan("Grad odredišta: ")
+	in.DestinPoint = gen.Scan("Vrsta odredišta (WAREHOUSE, STORE, ...), prazno za STORE: ")
+	in.TransDate = gen.Scan("Datum prevoza (u formati yyyy-MM-dd), prazno za danas: ")
+
+	for {
+		fmt.Println()
+		item := WTNItemInput{Name: gen.Scan("Naziv stavke, prazno za kraj: ")}
+		if item.Name == "" {
+			break
+		}
+		item.Code = gen.Scan("Šifra: ")
+		item.Unit = gen.Scan("Jedinica mjere, prazno za kom: ")
+		if item.Quantity, err = strconv.ParseFloat(gen.Scan("Količina: "), 64); err != nil {
+			return nil, err
+		}
+		in.Items = append(in.Items, item)
+	}
+	return in, in.Validate()
+}
+
+func registerWTN() error {
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+	fmt.Println("REGISTRACIJA OTPREMNICE")
+	fmt.Println()
+	fmt.Println("---------------------------------------------------------------")
+
+	if err := loadOrSetSigner(); err != nil {
+		return err
+	}
+	in, err := scanWTNInput()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println()
+	fmt.Printf("Otpremnica %d: %s, %s -> %s, %s, stavki: %d\n", in.OrdNum, in.StartAddr, in.StartCity, in.DestinAddr, in.DestinCity, len(in.Items))
+	fmt.Println("Nastavite sa slanjem")
+	fmt.Println("[1] Da")
+	fmt.Println("[2] Ne")
+	if gen.Scan("Nastavite sa slanjem: ") != "1" {
+		return fmt.Errorf("slanje otkazano")
+	}
+
+	p := withProgress(newWTNPipeline())
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeWTNRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return err
+	}
+
+	fmt.Printf("Rezultate sačuvani u %s\n", tx.Folder)
+	fmt.Printf("PDF fajl sačuvan u %s\n", tx.PDFFilePath)
+	_ = gen.Scan("Pritisnite bilo koji taster da biste izašli u glavno meni: ")
+	return nil
+}
+
+func wtnRegisterCommand(args []string) (interface{}, error) {
+	fs := newFlagSet("wtn register")
+	input := fs.String("input", "", "")
+	if err := fs.Parse(args); err != nil || *input == "" || fs.NArg() != 0 {
+		return nil, errUsage
+	}
+	if err := requireTCR(); err != nil {
+		return nil, err
+	}
+	in, err := loadWTNInput(argPath(*input))
+	if err != nil {
+		return nil, err
+	}
+	if err := in.Validate(); err != nil {
+		return nil, err
+	}
+	if err := requireSigner(); err != nil {
+		return nil, err
+	}
+
+	p := newWTNPipeline()
+	p.Stages[StageGenerate] = func(tx *Transaction) error {
+		return writeWTNRequest(in, tx.GenFile)
+	}
+	tx, err := p.NewTransaction()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Run(tx); err != nil {
+		discardTransaction(tx)
+		return newTransactionOutput(tx), err
+	}
+	return newTransactionOutput(tx), nil
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+
+	"github.com/beevik/etree"
+)
+
+// XML signature algorithms used by the tax service
+const (
+	dsigNamespace      = "http://www.w3.org/2000/09/xmldsig#"
+	algExcC14N         = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped       = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256       = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algSHA256          = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algSHA1            = "http://www.w3.org/2000/09/xmldsig#sha1"
+	xmlNamespace       = "http://www.w3.org/XML/1998/namespace"
+	xmlnsAttributeName = "xmlns"
+)
+
+// canonicalize serializes the element using exclusive XML canonicalization
+// without comments
+func canonicalize(e *etree.Element) []byte {
+	b := &bytes.Buffer{}
+	writeCanonical(b, e, map[string]string{})
+	return b.Bytes()
+}
+
+func writeCanonical(b *bytes.Buffer, e *etree.Element, rendered map[string]string) {
+	// namespaces visibly utilized by the element and its attributes
+	used := map[string]string{e.Space: lookupNamespace(e, e.Space)}
+	attrs := []etree.Attr{}
+	for _, a := range e.Attr {
+		if a.Space == xmlnsAttributeName || (a.Space == "" && a.Key == xmlnsAttributeName) {
+			continue
+		}
+		if a.Space != "" && a.Space != "xml" {
+			used[a.Space] = lookupNamespace(e, a.Space)
+		}
+		attrs = append(attrs, a)
+	}
+
+	prefixes := []string{}
+	scope := map[string]string{}
+	for prefix, uri := range rendered {
+		scope[prefix] = uri
+	}
+	for prefix, uri := range used {
+		current, isRendered := rendered[prefix]
+		if isRendered && current == uri {
+			continue
+		}
+		// there is no default namespace to undeclare
+		if !isRendered && prefix == "" && uri == "" {
+			continue
+		}
+		prefixes = append(prefixes, prefix)
+		scope[prefix] = uri
+	}
+	sort.Strings(prefixes)
+
+	attrNamespace := func(a etree.Attr) string {
+		if a.Space == "" {
+			return ""
+		}
+		if a.Space == "xml" {
+			return xmlNamespace
+		}
+		return lookupNamespace(e, a.Space)
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		ni, nj := attrNamespace(attrs[i]), attrNamespace(attrs[j])
+		if ni != nj {
+			return ni < nj
+		}
+		return attrs[i].Key < attrs[j].Key
+	})
+
+	b.WriteString("<")
+	b.WriteString(e.FullTag())
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:`)
+			b.WriteString(prefix)
+			b.WriteString(`="`)
+		}
+		b.WriteString(escapeCanonicalAttr(scope[prefix]))
+		b.WriteString(`"`)
+	}
+	for _, a := range attrs {
+		b.WriteString(" ")
+		b.WriteString(a.FullKey())
+		b.WriteString(`="`)
+		b.WriteString(escapeCanonicalAttr(a.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+
+	for _, t := range e.Child {
+		switch child := t.(type) {
+		case *etree.Element:
+			writeCanonical(b, child, scope)
+		case *etree.CharData:
+			b.WriteString(escapeCanonicalText(child.Data))
+		}
+	}
+
+	b.WriteString("</")
+	b.WriteString(e.FullTag())
+	b.WriteString(">")
+}
+
+// lookupNamespace returns namespace URI bound to prefix in scope of e
+func lookupNamespace(e *etree.Element, prefix string) string {
+	for it := e; it != nil; it = it.Parent() {
+		for _, a := range it.Attr {
+			if prefix == "" && a.Space == "" && a.Key == xmlnsAttributeName {
+				return a.Value
+			}
+			if prefix != "" && a.Space == xmlnsAttributeName && a.Key == prefix {
+				return a.Value
+			}
+		}
+	}
+	return ""
+}
+
+var canonicalTextReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+
+var canonicalAttrReplacer = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+func escapeCanonicalText(s string) string {
+	return canonicalTextReplacer.Replace(s)
+}
+
+func escapeCanonicalAttr(s string) string {
+	return canonicalAttrReplacer.Replace(s)
+}
+
+// findChild returns the first child element with the given local name
+func findChild(e *etree.Element, tag string) *etree.Element {
+	if e == nil {
+		return nil
+	}
+	for _, child := range e.ChildElements() {
+		if child.Tag == tag {
+			return child
+		}
+	}
+	return nil
+}
+
+// findDescendant returns the first descendant element with the given local
+// name, regardless of its namespace prefix
+func findDescendant(e *etree.Element, tag string) *etree.Element {
+	if e == nil {
+		return nil
+	}
+	for _, child := range e.ChildElements() {
+		if child.Tag == tag {
+			return child
+		}
+		if found := findDescendant(child, tag); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// signatureCertificate returns the certificate embedded in the signature
+func signatureCertificate(signature *etree.Element) (*x509.Certificate, error) {
+	elem := findDescendant(signature, "X509Certificate")
+	if elem == nil {
+		return nil, fmt.Errorf("invalid signature, no X509Certificate")
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(elem.Text()), ""))
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func digestAlgorithm(uri string) (hash.Hash, crypto.Hash, error) {
+	switch uri {
+	case algSHA256:
+		return sha256.New(), crypto.SHA256, nil
+	case algSHA1:
+		return sha1.New(), crypto.SHA1, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported digest algorithm %s", uri)
+}
+
+// verifySignature validates the enveloped signature of a signed request and
+// returns the signing certificate
+func verifySignature(root *etree.Element) (*x509.Certificate, error) {
+	signature := findChild(root, "Signature")
+	if signature == nil {
+		return nil, fmt.Errorf("invalid signature, no Signature")
+	}
+	signedInfo := findChild(signature, "SignedInfo")
+	if signedInfo == nil {
+		return nil, fmt.Errorf("invalid signature, no SignedInfo")
+	}
+	signatureMethod := findChild(signedInfo, "SignatureMethod")
+	if signatureMethod == nil || signatureMethod.SelectAttrValue("Algorithm", "") != algRSASHA256 {
+		return nil, fmt.Errorf("invalid signature, unsupported signature method")
+	}
+	reference := findChild(signedInfo, "Reference")
+	digestMethod := findChild(reference, "DigestMethod")
+	digestValue := findChild(reference, "DigestValue")
+	signatureValue := findChild(signature, "SignatureValue")
+	if reference == nil || digestMethod == nil || digestValue == nil || signatureValue == nil {
+		return nil, fmt.Errorf("invalid signature, incomplete SignedInfo")
+	}
+	uri := reference.SelectAttrValue("URI", "")
+	if uri != "" && uri != "#"+root.SelectAttrValue("Id", "") {
+		return nil, fmt.Errorf("invalid signature, reference %s does not match request", uri)
+	}
+
+	// digest of the request without the signature
+	h, _, err := digestAlgorithm(digestMethod.SelectAttrValue("Algorithm", ""))
+	if err != nil {
+		return nil, err
+	}
+	unsigned := root.Copy()
+	unsigned.RemoveChild(findChild(unsigned, "Signature"))
+	attachScope(unsigned, root)
+	h.Write(canonicalize(unsigned))
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != strings.TrimSpace(digestValue.Text()) {
+		return nil, fmt.Errorf("invalid signature, digest mismatch")
+	}
+
+	cert, err := signatureCertificate(signature)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, isRSA := cert.PublicKey.(*rsa.PublicKey)
+	if !isRSA {
+		return nil, fmt.Errorf("invalid signature, certificate key is not RSA")
+	}
+	signatureBytes, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(signatureValue.Text()), ""))
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(canonicalize(signedInfo))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, sum[:], signatureBytes); err != nil {
+		return nil, fmt.Errorf("invalid signature, %v", err)
+	}
+	return cert, nil
+}
+
+// attachScope copies namespace declarations in scope of src onto detached
+// copy dst, so it canonicalizes the same way
+func attachScope(dst, src *etree.Element) {
+	for it := src.Parent(); it != nil; it = it.Parent() {
+		for _, a := range it.Attr {
+			isDecl := a.Space == xmlnsAttributeName || (a.Space == "" && a.Key == xmlnsAttributeName)
+			if isDecl && dst.SelectAttr(a.FullKey()) == nil {
+				dst.CreateAttr(a.FullKey(), a.Value)
+			}
+		}
+	}
+}
+
+// plainIIC returns the string signed to obtain IIC of an invoice
+func plainIIC(invoice *etree.Element) string {
+	seller := findChild(invoice, "Seller")
+	return strings.Join([]string{
+		seller.SelectAttrValue("IDNum", ""),
+		invoice.SelectAttrValue("IssueDateTime", ""),
+		invoice.SelectAttrValue("InvOrdNum", ""),
+		invoice.SelectAttrValue("BusinUnitCode", ""),
+		invoice.SelectAttrValue("TCRCode", ""),
+		invoice.SelectAttrValue("SoftCode", ""),
+		invoice.SelectAttrValue("TotPrice", ""),
+	}, "|")
+}
+
+// plainWTNIC returns the string signed to obtain WTNIC of a transfer note
+func plainWTNIC(wtn *etree.Element) string {
+	issuer := findChild(wtn, "Issuer")
+	return strings.Join([]string{
+		issuer.SelectAttrValue("IDNum", ""),
+		wtn.SelectAttrValue("DateTimeCreated", ""),
+		wtn.SelectAttrValue("WTNOrdNum", ""),
+		wtn.SelectAttrValue("BusinUnitCode", ""),
+		wtn.SelectAttrValue("SoftCode", ""),
+	}, "|")
+}
+
+// iicFromSignature returns IIC derived from IIC signature
+func iicFromSignature(signature []byte) string {
+	sum := md5.Sum(signature)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// verifyIIC checks IIC and IIC signature of an invoice against certificate
+func verifyIIC(invoice *etree.Element, cert *x509.Certificate) error {
+	if findChild(invoice, "Seller") == nil {
+		return fmt.Errorf("invalid invoice, no Seller")
+	}
+	publicKey, isRSA := cert.PublicKey.(*rsa.PublicKey)
+	if !isRSA {
+		return fmt.Errorf("certificate key is not RSA")
+	}
+	signature, err := hex.DecodeString(invoice.SelectAttrValue("IICSignature", ""))
+	if err != nil {
+		return fmt.Errorf("invalid IIC signature, %v", err)
+	}
+	sum := sha256.Sum256([]byte(plainIIC(invoice)))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, sum[:], signature); err != nil {
+		return fmt.Errorf("invalid IIC signature, %v", err)
+	}
+	if !strings.EqualFold(iicFromSignature(signature), invoice.SelectAttrValue("IIC", "")) {
+		return fmt.Errorf("IIC does not match IIC signature")
+	}
+	return nil
+}
+
+// verifyWTNIC checks WTNIC and WTNIC signature of a transfer note against
+// certificate
+func verifyWTNIC(wtn *etree.Element, cert *x509.Certificate) error {
+	if findChild(wtn, "Issuer") == nil {
+		return fmt.Errorf("invalid transfer note, no Issuer")
+	}
+	publicKey, isRSA := cert.PublicKey.(*rsa.PublicKey)
+	if !isRSA {
+		return fmt.Errorf("certificate key is not RSA")
+	}
+	signature, err := hex.DecodeString(wtn.SelectAttrValue("WTNICSignature", ""))
+	if err != nil {
+		return fmt.Errorf("invalid WTNIC signature, %v", err)
+	}
+	sum := sha256.Sum256([]byte(plainWTNIC(wtn)))
+	if err := rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, sum[:], signature); err != nil {
+		return fmt.Errorf("invalid WTNIC signature, %v", err)
+	}
+	if !strings.EqualFold(iicFromSignature(signature), wtn.SelectAttrValue("WTNIC", "")) {
+		return fmt.Errorf("WTNIC does not match WTNIC signature")
+	}
+	return nil
+}